@@ -0,0 +1,225 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+	"github.com/watercraft/ketch/msg"
+)
+
+// Servers exchange digests of their replicas in memberlist push/pull
+// and compare them to find where their states diverge.  Each server
+// only repairs its own state, and only where that is safe:
+//
+// 1. Split master: both servers run the replica as master.  If the peer
+//    holds an unexpired lease and we don't, we demote our copy.
+// 2. Orphaned epoch: we hold a revoked epoch that the master no longer
+//    uses.  Its acceptor state can't grant a lease, so we remove it.
+// 3. Deleted by master: our master no longer has the replica.  It may
+//    have been deleted while we were down, or the master may have lost
+//    it; we only report this.
+//
+// Divergences found are kept as divergence resources until the next
+// exchange with the same peer.  Name conflicts are found from the
+// catalog instead; see names.go.
+
+// DivergenceMgr manages divergences found by state exchange.
+type DivergenceMgr struct {
+	ResourceMgr
+}
+
+func (k *Ketch) installDivergenceMgr() {
+	m := &DivergenceMgr{
+		ResourceMgr: ResourceMgr{
+			myType:    api.TypeDivergence,
+			assignIDs: true,
+			named:     true,
+			persist:   false,
+		},
+	}
+	m.Init(k, m)
+}
+
+func (m *DivergenceMgr) InitResource(in api.Resource) (error, int) {
+	return nil, http.StatusOK
+}
+
+func (m *DivergenceMgr) GetList() api.ResourceList {
+	return nil
+}
+
+func (m *DivergenceMgr) UpdateAfterLoad(resource api.Resource) bool {
+	return false
+}
+
+// localDigest returns the digest of replicas on this server.
+// Called read locked.
+func (k *Ketch) localDigest() *msg.Digest {
+
+	uptime := durationMs(k.clockUptime())
+	digest := &msg.Digest{
+		ServerID: k.runtime.ID,
+	}
+	for _, resource := range k.resourceMgr[api.TypeReplica].resource {
+		replica := resource.(*api.Replica)
+		rd := msg.ReplicaDigest{
+			ID:             replica.ID,
+			Name:           replica.Name,
+			CurrentEpochID: replica.CurrentEpochID,
+			MasterServerID: replica.MasterServerID,
+			Busy:           (replica.PendingState != "") || (replica.SwitchoverServerID != nil),
+			Demoted:        replica.Demoted,
+			LeaseOwner:     holdsLease(uptime, replica),
+		}
+		for _, epoch := range replica.Epochs {
+			rd.EpochIDs = append(rd.EpochIDs, epoch.ID)
+		}
+		digest.Replicas = append(digest.Replicas, rd)
+	}
+	digest.Catalog = k.catalogDigest()
+	return digest
+}
+
+// holdsLease returns true if this server holds a lease on the current
+// epoch of the replica that is unexpired at uptime.
+func holdsLease(uptime int64, replica *api.Replica) bool {
+	if replica.CurrentEpochID == nil {
+		return false
+	}
+	epoch, ok := replica.Epochs[replica.CurrentEpochID.String()]
+	return ok && epoch.LeaseOwner && (uptime < epoch.LeaseConfirmedUptime)
+}
+
+// mergeDigest compares the digest of a peer with our state, repairing
+// what is safe to repair, and records the divergences found.
+// Called locked.
+func (k *Ketch) mergeDigest(digest *msg.Digest) {
+
+	if uuid.Equal(digest.ServerID, k.runtime.ID) {
+		return
+	}
+	k.GetUptime()
+	peer := digest.ServerID.String()
+	if resource, ok := k.resourceMgr[api.TypeServer].resource[digest.ServerID]; ok {
+		peer = resource.(*api.Server).Name
+	}
+	k.GetUptime()
+	k.mergeCatalogDigest(digest.Catalog)
+	replicaMgr := k.resourceMgr[api.TypeReplica]
+	epochMgr := k.resourceMgr[api.TypeEpoch]
+	var found []*api.Divergence
+
+	remote := make(map[uuid.UUID]bool)
+	for i := range digest.Replicas {
+		rd := &digest.Replicas[i]
+		remote[rd.ID] = true
+		if !rd.ClaimsMaster() {
+			continue
+		}
+
+		// Both claim master; fence ours if only the peer holds a lease
+		var replica *api.Replica
+		if resource, ok := replicaMgr.resource[rd.ID]; ok {
+			replica = resource.(*api.Replica)
+		}
+		if (replica != nil) && claimsMaster(replica) {
+			divergence := &api.Divergence{
+				Kind:      api.DivergenceSplitMaster,
+				Replica:   rd.Name,
+				ReplicaID: rd.ID,
+				EpochID:   replica.CurrentEpochID,
+				Repaired:  rd.LeaseOwner && !holdsLease(k.uptime, replica),
+			}
+			if divergence.Repaired {
+				demoteReplica(replicaMgr, replica)
+				delete(k.replicaDue, replica.ID)
+			}
+			found = append(found, divergence)
+		}
+
+		// Remove revoked epochs the master no longer uses
+		used := make(map[uuid.UUID]bool)
+		for _, id := range rd.EpochIDs {
+			used[id] = true
+		}
+		if replica != nil {
+			for _, epoch := range replica.Epochs {
+				used[epoch.ID] = true
+			}
+		}
+		for _, resource := range epochMgr.resource {
+			epoch := resource.(*api.Epoch)
+			if (epoch.ReplicaID != rd.ID) || (epoch.SuccessorEpochID == nil) || used[epoch.ID] {
+				continue
+			}
+			delete(epochMgr.resource, epoch.ID)
+			epochMgr.saveResource(epoch.ID)
+			epochID := epoch.ID
+			found = append(found, &api.Divergence{
+				Kind:      api.DivergenceOrphanedEpoch,
+				Replica:   rd.Name,
+				ReplicaID: rd.ID,
+				EpochID:   &epochID,
+				Repaired:  true,
+			})
+		}
+	}
+
+	// Report replicas our master no longer has
+	for _, resource := range replicaMgr.resource {
+		replica := resource.(*api.Replica)
+		if (replica.MasterServerID == nil) || !uuid.Equal(*replica.MasterServerID, digest.ServerID) ||
+			(replica.PendingState == api.StateDelete) || remote[replica.ID] {
+			continue
+		}
+		found = append(found, &api.Divergence{
+			Kind:      api.DivergenceDeletedByMaster,
+			Replica:   replica.Name,
+			ReplicaID: replica.ID,
+		})
+	}
+
+	// Replace divergences from the last exchange with this peer
+	divergenceMgr := k.resourceMgr[api.TypeDivergence]
+	for _, resource := range divergenceMgr.GetResources() {
+		divergence := resource.(*api.Divergence)
+		if uuid.Equal(divergence.PeerID, digest.ServerID) && (divergence.Kind != api.DivergenceNameConflict) {
+			divergenceMgr.DeleteResource(divergence.Name)
+		}
+	}
+	for _, divergence := range found {
+		divergence.Name = fmt.Sprintf("%s/%s/%s", divergence.Kind, divergence.Replica, peer)
+		if divergence.Kind == api.DivergenceOrphanedEpoch {
+			divergence.Name += "/" + divergence.EpochID.String()
+		}
+		divergence.Peer = peer
+		divergence.PeerID = digest.ServerID
+		entry := k.log.WithFields(Locate(logrus.Fields{
+			"kind":     divergence.Kind,
+			"replica":  divergence.Replica,
+			"peer":     peer,
+			"epochID":  divergence.EpochID,
+			"repaired": divergence.Repaired,
+		}))
+		if divergence.Repaired {
+			entry.Info("Repaired divergence from peer")
+		} else {
+			entry.Error("Divergence from peer")
+		}
+		divergenceMgr.CreateResources(api.ResourceList{divergence})
+	}
+}
+
+// claimsMaster returns true if this server runs the replica as master.
+func claimsMaster(replica *api.Replica) bool {
+	return (replica.MasterServerID == nil) && (replica.CurrentEpochID != nil) &&
+		(replica.PendingState == "") && (replica.SwitchoverServerID == nil) && !replica.Demoted
+}
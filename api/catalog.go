@@ -0,0 +1,60 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"github.com/satori/go.uuid"
+)
+
+// TypeCatalog is both the type and URL component for the catalog resource.
+const TypeCatalog Type = "catalog"
+
+// CatalogMember is a quorum member of a replica in the catalog.
+type CatalogMember struct {
+	// Server and ServerID name the server hosting the member.
+	Server   string    `json:"server"`
+	ServerID uuid.UUID `json:"serverID"`
+	// MemberType is the type of quorum member: sync, async or witness.
+	MemberType ReplicaQuorumMemberType `json:"memberType,omitempty"`
+	// DataState is the state of the member's data as seen by the master.
+	DataState TypeDataState `json:"dataState,omitempty"`
+}
+
+// CatalogEntry describes a replica anywhere in the cluster as last
+// published by its master.  The Common ID is the replica ID.
+// This object is not persisted in the saved configuration.
+type CatalogEntry struct {
+	Common
+	// Master and MasterServerID name the server running the master.
+	Master         string    `json:"master"`
+	MasterServerID uuid.UUID `json:"masterServerID"`
+	// EpochID is the current epoch of the replica, if any.
+	EpochID *uuid.UUID `json:"epochID,omitempty"`
+	// DBState is the state of the master database.
+	DBState DBState `json:"dbState,omitempty"`
+	// QuorumGroupSize is the target size of the quorum group.
+	QuorumGroupSize uint `json:"quorumGroupSize"`
+	// Members are the quorum members of the current epoch.
+	Members []CatalogMember `json:"members,omitempty"`
+	// Reserving is set until a majority of servers confirm the name
+	// of a new replica; the replica may still give up its name.
+	Reserving bool `json:"reserving,omitempty"`
+	// Version orders entries for the replica; the highest wins.
+	Version uint64 `json:"version"`
+}
+
+func (c *CatalogEntry) Clone() Resource {
+	entry := *c
+	if c.EpochID != nil {
+		id := *c.EpochID
+		entry.EpochID = &id
+	}
+	entry.Members = append([]CatalogMember(nil), c.Members...)
+	return &entry
+}
+
+func (c *CatalogEntry) GetCommon() *Common {
+	return &c.Common
+}
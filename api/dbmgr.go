@@ -5,7 +5,7 @@
 package api
 
 import (
-	"os/exec"
+	"os"
 )
 
 // TypeDBmgr is both the type and URL component for the dbmgr resource.
@@ -21,6 +21,14 @@ const (
 	DBStateDown         DBState = "down"
 )
 
+// Process is a running database command.
+type Process interface {
+	// Signal sends a signal to the process.
+	Signal(sig os.Signal) error
+	// Wait waits for the process to exit.
+	Wait() error
+}
+
 // DBMgr represents a dbmgr that is used to manage the running state of the database.
 // This object is not persisted in the saved configuration.
 type DBMgr struct {
@@ -31,8 +39,26 @@ type DBMgr struct {
 	DBDir string `json:"dbDir,omitempty"`
 	// Port is the port number that the running database is listening on
 	Port uint16 `json:"port,omitempty"`
-	// RunCmd is the command object for the running database.
-	RunCmd *exec.Cmd `json:"-"`
+	// PGVersion is the postgres version of the database directory
+	PGVersion string `json:"pgVersion,omitempty"`
+	// LSN is the last WAL position read from the running database:
+	// the current write position on a master and the replay position
+	// on a slave.
+	LSN uint64 `json:"lsn,omitempty"`
+	// LSNPending is true while a WAL position query is running.
+	LSNPending bool `json:"-"`
+	// Password is the password of the database user as last set in
+	// the database; a master changes it before restarting with a new one.
+	Password string `json:"-"`
+	// PasswordPending is true while a password change is running.
+	PasswordPending bool `json:"-"`
+	// StartPending is true while a database command is queued to start;
+	// RunCmd is set once it has.
+	StartPending bool `json:"-"`
+	// StopPending is set to stop a database command as soon as it starts.
+	StopPending bool `json:"-"`
+	// RunCmd is the process for the running database command.
+	RunCmd Process `json:"-"`
 	// RunEnv is a set of environment variables for the command
 	RunEnv []string `json:"-"`
 }
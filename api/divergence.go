@@ -0,0 +1,58 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"github.com/satori/go.uuid"
+)
+
+// TypeDivergence is both the type and URL component for the divergence resource.
+const TypeDivergence Type = "divergence"
+
+// DivergenceKind is the way the state of a replica differs between servers.
+type DivergenceKind string
+
+const (
+	// Both servers run the replica as master.
+	DivergenceSplitMaster DivergenceKind = "split-master"
+	// This server holds a revoked epoch that the master no longer uses.
+	DivergenceOrphanedEpoch DivergenceKind = "orphaned-epoch"
+	// The master of a replica on this server no longer has it.
+	DivergenceDeletedByMaster DivergenceKind = "deleted-by-master"
+	// Another replica in the catalog holds the name of this one.
+	DivergenceNameConflict DivergenceKind = "name-conflict"
+)
+
+// Divergence is a difference in replica state between this server and
+// a peer, found by comparing state digests.
+// This object is not persisted in the saved configuration.
+type Divergence struct {
+	Common
+	// Kind is the way the states differ.
+	Kind DivergenceKind `json:"kind"`
+	// Replica and ReplicaID name the replica.
+	Replica   string    `json:"replica"`
+	ReplicaID uuid.UUID `json:"replicaID"`
+	// Peer and PeerID name the server compared with.
+	Peer   string    `json:"peer"`
+	PeerID uuid.UUID `json:"peerID"`
+	// EpochID is the epoch concerned, if any.
+	EpochID *uuid.UUID `json:"epochID,omitempty"`
+	// Repaired is true if this server repaired the divergence.
+	Repaired bool `json:"repaired"`
+}
+
+func (d *Divergence) Clone() Resource {
+	divergence := *d
+	if d.EpochID != nil {
+		id := *d.EpochID
+		divergence.EpochID = &id
+	}
+	return &divergence
+}
+
+func (d *Divergence) GetCommon() *Common {
+	return &d.Common
+}
@@ -20,6 +20,12 @@ func NewByType(myType Type) Resource {
 		return new(Epoch)
 	case TypeReplica:
 		return new(Replica)
+	case TypeFault:
+		return new(Fault)
+	case TypeDivergence:
+		return new(Divergence)
+	case TypeCatalog:
+		return new(CatalogEntry)
 	}
 	return nil
 }
@@ -41,7 +41,7 @@ type AcceptorState struct {
 	HighestPromised BallotNumber `json:"highestPromised,omitempty"`
 	// ProposalOwnerID is the server ID that owns the last accepted proposal
 	ProposalOwnerID uuid.UUID `json:"proposalOwnerID"`
-	// ProposalExpireUptime is the time since boot of host in seconds
+	// ProposalExpireUptime is the time since boot of host in milliseconds
 	// when the accepted proposal expires and another can be accepted.
 	ProposalExpireUptime int64 `json:"expireUptime"`
 }
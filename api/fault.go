@@ -0,0 +1,76 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"github.com/satori/go.uuid"
+)
+
+// TypeFault is both the type and URL component for the fault resource.
+const TypeFault Type = "fault"
+
+// FaultAction is the action applied to messages matching a fault.
+type FaultAction string
+
+const (
+	// Drop discards the message.
+	FaultActionDrop FaultAction = "drop"
+	// Delay delivers the message after the fault delay.
+	FaultActionDelay FaultAction = "delay"
+	// Duplicate delivers the message twice.
+	FaultActionDuplicate FaultAction = "duplicate"
+	// Reorder holds the message until the next matching message
+	// between the same pair of servers is delivered, or until the
+	// fault delay expires.
+	FaultActionReorder FaultAction = "reorder"
+)
+
+// FaultDirection selects whether a fault applies to sent or received messages.
+type FaultDirection string
+
+const (
+	FaultDirectionSend    FaultDirection = "send"
+	FaultDirectionReceive FaultDirection = "receive"
+)
+
+// Fault is a rule to inject network faults into protocol messages.
+// This object is not persisted in the saved configuration.
+type Fault struct {
+	Common
+	// Action is applied to matching messages.
+	Action FaultAction `json:"action"`
+	// Direction limits the fault to sent or received messages; both if empty.
+	Direction FaultDirection `json:"direction,omitempty"`
+	// Src and Dest limit the fault to messages between servers by name; any if empty.
+	Src  string `json:"src,omitempty"`
+	Dest string `json:"dest,omitempty"`
+	// SrcID and DestID are the server IDs resolved from Src and Dest.
+	SrcID  *uuid.UUID `json:"srcID,omitempty"`
+	DestID *uuid.UUID `json:"destID,omitempty"`
+	// MsgTypes limits the fault to message types by name (e.g. LeasePrepareResp); any if empty.
+	MsgTypes []string `json:"msgTypes,omitempty"`
+	// Probability of applying the fault to a matching message; always if zero.
+	Probability float64 `json:"probability,omitempty"`
+	// Delay is the duration for delay and reorder actions (e.g. 500ms).
+	Delay string `json:"delay,omitempty"`
+}
+
+func (f *Fault) Clone() Resource {
+	fault := *f
+	if f.SrcID != nil {
+		id := *f.SrcID
+		fault.SrcID = &id
+	}
+	if f.DestID != nil {
+		id := *f.DestID
+		fault.DestID = &id
+	}
+	fault.MsgTypes = append([]string(nil), f.MsgTypes...)
+	return &fault
+}
+
+func (f *Fault) GetCommon() *Common {
+	return &f.Common
+}
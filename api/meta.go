@@ -7,6 +7,7 @@ package api
 import (
 	"encoding/json"
 	"net"
+	"strconv"
 
 	"github.com/satori/go.uuid"
 )
@@ -56,6 +57,11 @@ type Endpoint struct {
 	Port uint16 `json:"port"`
 }
 
+// String returns the endpoint in host:port form.
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.Addr.String(), strconv.Itoa(int(e.Port)))
+}
+
 // Data provides the data portion of an API response.
 type Data struct {
 	// Type describes the type of object.
@@ -15,12 +15,26 @@ const TypeReplica Type = "replica"
 type TypeDataState string
 
 const (
+	// Uninitialized means the peer has not yet created its replica.
+	DataStateUninitialized TypeDataState = "uninitialized"
 	// InSync means the associated data is up to date.
 	DataStateInSync TypeDataState = "in-sync"
 	// CatchUp means the associated data need to be brought up-to-date.
 	DataStateCatchUp TypeDataState = "catch-up"
 )
 
+// DataDisposition is what becomes of database files when a replica is deleted.
+type DataDisposition string
+
+const (
+	// Keep leaves the data directory in place.
+	DataDispositionKeep DataDisposition = "keep"
+	// Archive renames the data directory with a timestamp suffix.
+	DataDispositionArchive DataDisposition = "archive"
+	// Remove removes the data directory.
+	DataDispositionRemove DataDisposition = "remove"
+)
+
 // ReplicaQuorumMemberType is the type of a replica quorum member.
 type ReplicaQuorumMemberType string
 
@@ -30,7 +44,7 @@ const (
 	// Data members that store async copies of the managed data, with state "catch-up" above.
 	ReplicaQuorumMemberTypeAsync ReplicaQuorumMemberType = "async"
 	// Witness members participate in the epoch lease protocol
-	// and can store an asynchronous copy of the managed data.
+	// but store no copy of the managed data.
 	ReplicaQuorumMemberTypeWitness ReplicaQuorumMemberType = "witness"
 )
 
@@ -51,7 +65,7 @@ type QuorumMember struct {
 	Common
 	// Type is the type of quorum member, either data or witness.
 	MemberType ReplicaQuorumMemberType `json:"memberType,omitempty"`
-	// State of the peer's data, either in-sync or catch-up
+	// State of the peer's data, either uninitialized, catch-up or in-sync
 	DataState TypeDataState `json:"dataState,omitempty"`
 	// Accepted tracks Paxos Lease request/reply status.
 	// Used for both prepare and propose phases.
@@ -76,9 +90,14 @@ type EpochSpec struct {
 	LeasePhase LeasePhase `json:"leasePhase"`
 	// LeaseOwner is true when we hold the lease
 	LeaseOwner bool `json:"leaseOwner"`
-	// LeaseExpireUptime is the time since boot of host in seconds
-	// when the lease expires, if held
+	// LeaseExpireUptime is the time since boot of host in milliseconds
+	// when the lease last proposed expires
 	LeaseExpireUptime int64 `json:"leaseExpireUptime"`
+	// LeaseConfirmedUptime is the time since boot of host in
+	// milliseconds when the lease last accepted by a majority of
+	// acceptors expires, if held.  A proposal that is lost leaves it
+	// as it was, so the lease is only taken to be in force until then.
+	LeaseConfirmedUptime int64 `json:"leaseConfirmedUptime"`
 }
 
 // DBSpec provides configuration for the managed database
@@ -112,16 +131,96 @@ type Replica struct {
 	// QuorumGroupSize sets the target size of the quorum group.  The
 	// data quorum size will be a majority within the quorum.
 	QuorumGroupSize uint `json:"quorumGroupSize"`
+	// SyncMemberCount is the number of synchronous data members,
+	// including the master.  The remaining members are async.
+	// Defaults to a majority of the quorum group.
+	SyncMemberCount uint `json:"syncMemberCount"`
+	// WitnessCount is the number of witness members that vote in
+	// the epoch and lease protocols but store no data.  Witnesses
+	// are the last members chosen for an epoch.
+	WitnessCount uint `json:"witnessCount,omitempty"`
+	// Spread constrains how quorum members are placed across servers
+	// by their labels.
+	Spread []SpreadConstraint `json:"spread,omitempty"`
 	// HomeServerID is the server ID where the replica originated from.
 	// It is used to place the first synchoronous copy for the next failover.
 	HomeServerID uuid.UUID `json:"homeServerID"`
 	// MasterServerID is the server ID that created this replica.
 	// Progress the state machine only if this server drops from the list.
 	MasterServerID *uuid.UUID `json:"masterServerID,omitempty"`
+	// SwitchoverServerID is the server chosen to take over as master
+	// in a planned switchover.
+	SwitchoverServerID *uuid.UUID `json:"switchoverServerID,omitempty"`
+	// PriorMasterServerID is the old master in a planned switchover.
+	// The new master waits out its lease rather than treating it as
+	// a conflict.
+	PriorMasterServerID *uuid.UUID `json:"priorMasterServerID,omitempty"`
+	// Demoted is set when this server fenced its copy of the replica
+	// after losing the lease or finding its state inconsistent.  The
+	// database stays stopped until the replica is recovered.
+	Demoted bool `json:"demoted,omitempty"`
+	// RebalanceServerID is a server the next epoch leaves out, to
+	// move the replica's member there to a less loaded server.
+	RebalanceServerID *uuid.UUID `json:"rebalanceServerID,omitempty"`
+	// DataDisposition is what becomes of the data directory once a
+	// pending delete completes.
+	DataDisposition DataDisposition `json:"dataDisposition,omitempty"`
+	// RetiringServerIDs are servers dropped from the quorum that have
+	// yet to tear down their copy of the replica.
+	RetiringServerIDs []uuid.UUID `json:"retiringServerIDs,omitempty"`
+	// RestartServerIDs are members yet to restart their database with
+	// changed settings, one at a time, before the master hands over.
+	RestartServerIDs []uuid.UUID `json:"restartServerIDs,omitempty"`
+	// MasterPort is the port the master's database still serves on
+	// while a change of port rolls out; zero when it is DBConfig.Port.
+	MasterPort uint16 `json:"masterPort,omitempty"`
 	// DBConfig is configuration for the managed database.
 	DBConfig DBSpec `json:"dbConfig"`
 }
 
+// Switchover is the request body to move the master role of a replica.
+type Switchover struct {
+	// Server is the name of the in-sync member to take over as master.
+	// If empty, the first in-sync sync member is chosen.
+	Server string `json:"server,omitempty"`
+}
+
+// ReplicaPatch is the request body to change a live replica.  Only
+// fields that are set are changed.  A change of quorum closes the
+// current epoch and opens a new one, so the database is unavailable
+// meanwhile.  A change of port or password restarts members one at a
+// time and cannot be combined with a change of quorum.
+type ReplicaPatch struct {
+	// QuorumGroupSize changes the size of the quorum group.  The sync
+	// member count returns to a majority unless also given.
+	QuorumGroupSize *uint `json:"quorumGroupSize,omitempty"`
+	SyncMemberCount *uint `json:"syncMemberCount,omitempty"`
+	WitnessCount    *uint `json:"witnessCount,omitempty"`
+	// Spread replaces the spread constraints; an empty list removes them.
+	Spread *[]SpreadConstraint `json:"spread,omitempty"`
+	// DBConfig changes database settings.  The username cannot be
+	// changed.
+	DBConfig *DBSpecPatch `json:"dbConfig,omitempty"`
+}
+
+// SpreadConstraint limits the quorum members of a replica placed on
+// servers with the same value of a label, such as no two members in the
+// same zone.  Servers without the label share the empty value.
+type SpreadConstraint struct {
+	// Label is the server label key, such as zone or rack.
+	Label string `json:"label"`
+	// MaxPerValue is the most members on servers with the same value
+	// of the label.  Defaults to one.
+	MaxPerValue uint `json:"maxPerValue,omitempty"`
+}
+
+// DBSpecPatch provides the database settings of a ReplicaPatch.
+type DBSpecPatch struct {
+	Password   *string `json:"password,omitempty"`
+	Port       *uint16 `json:"port,omitempty"`
+	ClosedPort *uint16 `json:"closedPort,omitempty"`
+}
+
 func (r *Replica) Clone() Resource {
 	replica := *r
 	if r.CurrentEpochID != nil {
@@ -132,16 +231,44 @@ func (r *Replica) Clone() Resource {
 		id := *r.PriorEpochID
 		replica.PriorEpochID = &id
 	}
-	for key, value := range replica.Epochs {
-		if value != nil {
-			newvalue := *value
-			replica.Epochs[key] = &newvalue
+	if r.Epochs != nil {
+		replica.Epochs = make(map[string]*EpochSpec)
+		for key, value := range r.Epochs {
+			if value != nil {
+				newvalue := *value
+				if value.Quorum != nil {
+					newvalue.Quorum = append([]QuorumMember(nil), value.Quorum...)
+				}
+				value = &newvalue
+			}
+			replica.Epochs[key] = value
 		}
 	}
 	if r.MasterServerID != nil {
 		id := *r.MasterServerID
 		replica.MasterServerID = &id
 	}
+	if r.SwitchoverServerID != nil {
+		id := *r.SwitchoverServerID
+		replica.SwitchoverServerID = &id
+	}
+	if r.PriorMasterServerID != nil {
+		id := *r.PriorMasterServerID
+		replica.PriorMasterServerID = &id
+	}
+	if r.RetiringServerIDs != nil {
+		replica.RetiringServerIDs = append([]uuid.UUID(nil), r.RetiringServerIDs...)
+	}
+	if r.RestartServerIDs != nil {
+		replica.RestartServerIDs = append([]uuid.UUID(nil), r.RestartServerIDs...)
+	}
+	if r.RebalanceServerID != nil {
+		id := *r.RebalanceServerID
+		replica.RebalanceServerID = &id
+	}
+	if r.Spread != nil {
+		replica.Spread = append([]SpreadConstraint(nil), r.Spread...)
+	}
 	return &replica
 }
 
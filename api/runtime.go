@@ -4,10 +4,6 @@
 
 package api
 
-import (
-	"time"
-)
-
 // TypeRuntime is both the type and URL component for the runtime resource.
 const TypeRuntime Type = "runtime"
 
@@ -17,10 +13,29 @@ type Runtime struct {
 	Common
 	// Endpoint is the IP and port used to reach this server.
 	Endpoint Endpoint `json:"endpoint"`
-	// BootTime is the time reboot of the system hosting Ketch.
-	BootTime time.Time `json:"boottime"`
+	// BootID identifies the boot of the system hosting Ketch;
+	// it changes on reboot.
+	BootID string `json:"bootID"`
+	// BootSource is where BootID came from: boot_id, btime or utmp.
+	BootSource string `json:"bootSource"`
+	// Drain is set while the server is drained for maintenance.
+	Drain DrainState `json:"drain,omitempty"`
+	// StateVersion is the format of the state this server saves.
+	StateVersion uint `json:"stateVersion,omitempty"`
 }
 
+// DrainState is the progress of draining a server for maintenance.
+type DrainState string
+
+const (
+	// DrainStateDraining means the server takes no new quorum members
+	// and its replicas are moving to other servers.
+	DrainStateDraining DrainState = "draining"
+	// DrainStateDrained means the server hosts no replicas and is safe
+	// to stop.
+	DrainStateDrained DrainState = "drained"
+)
+
 func (r *Runtime) Clone() Resource {
 	runtime := *r
 	return &runtime
@@ -12,10 +12,42 @@ type Server struct {
 	Common // Anonymous Name and ID fields
 	// Endpoint is the IP and port used to reach this server.
 	Endpoint Endpoint `json:"endpoint"`
+	// Witness is true if the server only hosts witness quorum members.
+	Witness bool `json:"witness,omitempty"`
+	// Labels describe the server, such as its zone and rack, for
+	// spreading quorum members.
+	Labels map[string]string `json:"labels,omitempty"`
+	// KetchVersion and ProtocolVersion are the versions of Ketch and
+	// of its messages the server runs.
+	KetchVersion    string `json:"ketchVersion,omitempty"`
+	ProtocolVersion uint8  `json:"protocolVersion,omitempty"`
+	// PGVersion is the version of the server's postgres executables.
+	PGVersion string `json:"pgVersion,omitempty"`
+	// FreeDisk is the space available in the server's data
+	// directory, in bytes.
+	FreeDisk uint64 `json:"freeDisk"`
+	// ReplicaCount is the number of replicas the server hosts.
+	ReplicaCount uint `json:"replicaCount"`
+	// Weight is the relative capacity of the server for placement.
+	Weight uint `json:"weight,omitempty"`
+	// Drain is set while the server is drained for maintenance.
+	Drain DrainState `json:"drain,omitempty"`
+	// Flaps is the number of times the server has left the membership
+	// as seen by the server reporting it.
+	Flaps uint `json:"flaps,omitempty"`
+	// Probation is set while the server is back after being taken as
+	// down and is not yet placed in new epochs.
+	Probation bool `json:"probation,omitempty"`
 }
 
 func (s *Server) Clone() Resource {
 	server := *s
+	if s.Labels != nil {
+		server.Labels = make(map[string]string)
+		for key, value := range s.Labels {
+			server.Labels[key] = value
+		}
+	}
 	return &server
 }
 
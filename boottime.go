@@ -5,21 +5,107 @@
 package ketch
 
 import (
+	"bufio"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/Sirupsen/logrus"
 )
 
+// Ketch tells a host reboot, which restarts uptime and so invalidates
+// persisted lease times, from a restart of Ketch alone by comparing the
+// boot identity saved in the runtime with the current one.  Several
+// sources are supported since containers and minimal distros often
+// lack utmp.
+
 const (
+	// Boot identity sources
+	BootSourceBootID string = "boot_id"
+	BootSourceBtime  string = "btime"
+	BootSourceUtmp   string = "utmp"
+
+	// Location of kernel boot ID
+	kBootIDFile string = "/proc/sys/kernel/random/boot_id"
+	// Location of kernel statistics with boot time
+	kProcStatFile string = "/proc/stat"
 	// Location of utmp file
 	kUtmpFile string = "/var/run/utmp"
 	// Type of reboot record
 	kTypeBootTime int16 = 2
 )
 
+// BootIdentity identifies the current boot of the host.
+type BootIdentity interface {
+	// BootID returns a value that stays the same until the host
+	// reboots, and the name of the source it came from.
+	BootID() (id string, source string, err error)
+}
+
+// BootIDFile reads the random ID the Linux kernel generates on boot.
+// Path defaults to /proc/sys/kernel/random/boot_id.
+type BootIDFile struct {
+	Path string
+}
+
+// BootID returns the kernel boot ID.
+func (b BootIDFile) BootID() (string, string, error) {
+	path := b.Path
+	if path == "" {
+		path = kBootIDFile
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", BootSourceBootID, err
+	}
+	id := strings.TrimSpace(string(data))
+	if id == "" {
+		return "", BootSourceBootID, fmt.Errorf("Empty boot ID in %s", path)
+	}
+	return id, BootSourceBootID, nil
+}
+
+// ProcStatBootTime reads the boot time in seconds from the btime line
+// of kernel statistics.  Path defaults to /proc/stat.  The kernel
+// derives btime from the wall clock, so a clock step may change it by
+// a second; that is taken for a reboot, which costs availability but
+// not safety.
+type ProcStatBootTime struct {
+	Path string
+}
+
+// BootID returns the boot time from kernel statistics.
+func (b ProcStatBootTime) BootID() (string, string, error) {
+	path := b.Path
+	if path == "" {
+		path = kProcStatFile
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", BootSourceBtime, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if (len(fields) != 2) || (fields[0] != "btime") {
+			continue
+		}
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return "", BootSourceBtime, fmt.Errorf("Bad btime in %s: %v", path, err)
+		}
+		return time.Unix(sec, 0).UTC().Format(time.RFC3339), BootSourceBtime, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", BootSourceBtime, err
+	}
+	return "", BootSourceBtime, fmt.Errorf("No btime in %s", path)
+}
+
 // Structures for reading utmp
 type ExitStatus struct {
 	X__e_termination int16
@@ -46,48 +132,77 @@ type Utmp struct {
 	X__glibc_reserved [20]byte
 }
 
-// bootTime returns the last reboot time
-func (k *Ketch) getBootTime() (*time.Time, error) {
+// UtmpBootTime reads the time of the reboot record in the glibc utmp
+// file.  Path defaults to /var/run/utmp.
+type UtmpBootTime struct {
+	Path string
+}
 
-	// Open utmp file
-	file, err := os.Open(kUtmpFile)
+// BootID returns the time of the last reboot record.
+func (b UtmpBootTime) BootID() (string, string, error) {
+	path := b.Path
+	if path == "" {
+		path = kUtmpFile
+	}
+	file, err := os.Open(path)
 	if err != nil {
-		k.log.WithFields(Locate(logrus.Fields{
-			"utmpFile": kUtmpFile,
-			"err":      err,
-		})).Error("Failed to open utmp file")
-		return nil, err
+		return "", BootSourceUtmp, err
 	}
-	defer func() {
-		err := file.Close()
-		if err != nil {
-			k.log.WithFields(Locate(logrus.Fields{
-				"utmpFile": kUtmpFile,
-				"err":      err,
-			})).Info("Failed to close utmp file")
-		}
-	}()
+	defer file.Close()
 
 	// Read until we find a reboot record
 	var data Utmp
 	for {
 		err = binary.Read(file, binary.LittleEndian, &data)
+		if err == io.EOF {
+			return "", BootSourceUtmp, fmt.Errorf("No reboot record in %s", path)
+		}
 		if err != nil {
-			var msg string
-			if err == io.EOF {
-				msg = "Failed to find reboot record"
-			} else {
-				msg = "Failed read"
-			}
-			k.log.WithFields(Locate(logrus.Fields{
-				"utmpFile": kUtmpFile,
-				"err":      err,
-			})).Error(msg)
-			return nil, err
+			return "", BootSourceUtmp, fmt.Errorf("Failed to read %s: %v", path, err)
 		}
 		if data.Type == kTypeBootTime {
-			bootTime := time.Unix(int64(data.Tv.Sec), int64(data.Tv.Usec))
-			return &bootTime, nil
+			bootTime := time.Unix(int64(data.Tv.Sec), int64(data.Tv.Usec)*int64(time.Microsecond))
+			return bootTime.UTC().Format(time.RFC3339Nano), BootSourceUtmp, nil
 		}
 	}
 }
+
+// BootIdentities tries each identity in turn and returns the first
+// that is available.
+type BootIdentities []BootIdentity
+
+// BootID returns the first boot identity available.
+func (l BootIdentities) BootID() (string, string, error) {
+	var errs []string
+	for _, identity := range l {
+		id, source, err := identity.BootID()
+		if err == nil {
+			return id, source, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", source, err))
+	}
+	return "", "", fmt.Errorf("No boot identity available (%s)", strings.Join(errs, "; "))
+}
+
+// DefaultBootIdentity returns the kernel boot ID, falling back to
+// btime from /proc/stat and then to utmp.
+func DefaultBootIdentity() BootIdentity {
+	return BootIdentities{BootIDFile{}, ProcStatBootTime{}, UtmpBootTime{}}
+}
+
+// BootIdentityBySource returns the boot identity for a source name,
+// or the default for an empty name.
+func BootIdentityBySource(source string) (BootIdentity, error) {
+	switch source {
+	case "":
+		return DefaultBootIdentity(), nil
+	case BootSourceBootID:
+		return BootIDFile{}, nil
+	case BootSourceBtime:
+		return ProcStatBootTime{}, nil
+	case BootSourceUtmp:
+		return UtmpBootTime{}, nil
+	}
+	return nil, fmt.Errorf("Unknown boot identity source %q; use %s, %s or %s",
+		source, BootSourceBootID, BootSourceBtime, BootSourceUtmp)
+}
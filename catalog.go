@@ -0,0 +1,339 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"net/http"
+	"reflect"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/memberlist"
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+	"github.com/watercraft/ketch/msg"
+)
+
+// The master of each replica publishes a catalog entry for it by
+// gossip, so that any server can tell where a replica runs.  Entries
+// are republished when they change and every kCatalogRefreshPeriods
+// lease periods.  An entry not refreshed within kCatalogExpirePeriods
+// lease periods is dropped, as is one withdrawn by its master when the
+// replica is deleted.  Versions order the entries of a replica across
+// changes of master: a master publishes one more than the highest
+// version it has seen.  Memberlist sends a broadcast to only a few
+// members, so each server gossips on the updates that are new to it.
+// The catalog is also exchanged in push/pull, which fills in the
+// catalog of a joining server and repairs updates lost in gossip.
+
+const (
+	// Lease periods between republishing unchanged entries
+	kCatalogRefreshPeriods int64 = 2
+	// Lease periods without refresh before an entry is dropped
+	kCatalogExpirePeriods int64 = 7
+)
+
+// CatalogMgr manages the catalog of replicas in the cluster.
+type CatalogMgr struct {
+	ResourceMgr
+	// received is the uptime when an entry or withdrawal was last
+	// received, by replica ID
+	received map[uuid.UUID]int64
+	// withdrawn is the version of withdrawn entries, by replica ID
+	withdrawn map[uuid.UUID]uint64
+	// published is the entry last published by this server and
+	// publishedUptime when, by replica ID
+	published       map[uuid.UUID]*api.CatalogEntry
+	publishedUptime map[uuid.UUID]int64
+	// reserving is the progress of new replicas mastered here in
+	// reserving their names and reserved is set once one holds its
+	// name, by replica ID
+	reserving map[uuid.UUID]*nameReservation
+	reserved  map[uuid.UUID]bool
+	// grants are the names this server granted, by name
+	grants map[string]*nameGrant
+}
+
+func (k *Ketch) installCatalogMgr() {
+	m := &CatalogMgr{
+		ResourceMgr: ResourceMgr{
+			myType:    api.TypeCatalog,
+			assignIDs: false,
+			named:     false,
+			persist:   false,
+		},
+		received:        make(map[uuid.UUID]int64),
+		withdrawn:       make(map[uuid.UUID]uint64),
+		published:       make(map[uuid.UUID]*api.CatalogEntry),
+		publishedUptime: make(map[uuid.UUID]int64),
+		reserving:       make(map[uuid.UUID]*nameReservation),
+		reserved:        make(map[uuid.UUID]bool),
+		grants:          make(map[string]*nameGrant),
+	}
+	k.catalogMgr = m
+	m.Init(k, m)
+}
+
+func (m *CatalogMgr) InitResource(in api.Resource) (error, int) {
+	return nil, http.StatusOK
+}
+
+func (m *CatalogMgr) GetList() api.ResourceList {
+	return nil
+}
+
+func (m *CatalogMgr) UpdateAfterLoad(resource api.Resource) bool {
+	return false
+}
+
+// catalogBroadcast is a catalog update queued for gossip.  A newer
+// update for the same replica replaces it.
+type catalogBroadcast struct {
+	replicaID uuid.UUID
+	buf       []byte
+}
+
+func (b *catalogBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(*catalogBroadcast)
+	return ok && uuid.Equal(o.replicaID, b.replicaID)
+}
+
+func (b *catalogBroadcast) Message() []byte {
+	return b.buf
+}
+
+func (b *catalogBroadcast) Finished() {
+}
+
+// version returns the highest version seen for a replica.
+func (m *CatalogMgr) version(id uuid.UUID) uint64 {
+	version := m.withdrawn[id]
+	if resource, ok := m.resource[id]; ok {
+		if v := resource.(*api.CatalogEntry).Version; v > version {
+			version = v
+		}
+	}
+	if entry, ok := m.published[id]; ok && entry.Version > version {
+		version = entry.Version
+	}
+	return version
+}
+
+// publishCatalog publishes the entries of replicas mastered here,
+// withdraws those of replicas deleted here and drops expired entries.
+// Called locked.
+func (k *Ketch) publishCatalog() {
+
+	m := k.catalogMgr
+	replicaMgr := k.resourceMgr[api.TypeReplica]
+	refresh := kCatalogRefreshPeriods * durationMs(k.config.LeasePeriod)
+	expire := kCatalogExpirePeriods * durationMs(k.config.LeasePeriod)
+
+	for _, resource := range replicaMgr.resource {
+		replica := resource.(*api.Replica)
+		if (replica.MasterServerID != nil) || replica.Demoted ||
+			((replica.CurrentEpochID == nil) && !newReplica(replica)) {
+			// Another server publishes the replica, if anyone
+			delete(m.published, replica.ID)
+			delete(m.publishedUptime, replica.ID)
+			continue
+		}
+		entry := k.catalogEntry(replica)
+		if last, ok := m.published[replica.ID]; ok {
+			entry.Version = last.Version
+			if reflect.DeepEqual(entry, last) && (k.uptime < m.publishedUptime[replica.ID]+refresh) {
+				continue
+			}
+		}
+		entry.Version = m.version(replica.ID) + 1
+		k.publishCatalogEntry(entry, false)
+	}
+
+	// Withdraw entries of replicas deleted here
+	for id := range m.reserving {
+		if _, ok := replicaMgr.resource[id]; !ok {
+			delete(m.reserving, id)
+		}
+	}
+	for id := range m.reserved {
+		if _, ok := replicaMgr.resource[id]; !ok {
+			delete(m.reserved, id)
+		}
+	}
+	for id, entry := range m.published {
+		if _, ok := replicaMgr.resource[id]; ok {
+			continue
+		}
+		withdrawn := entry.Clone().(*api.CatalogEntry)
+		withdrawn.Version = m.version(id) + 1
+		k.publishCatalogEntry(withdrawn, true)
+	}
+
+	// Drop entries and withdrawals no longer refreshed
+	for id, uptime := range m.received {
+		if k.uptime < uptime+expire {
+			continue
+		}
+		if resource, ok := m.resource[id]; ok {
+			k.log.WithFields(Locate(logrus.Fields{
+				"replica": resource.GetCommon().Name,
+				"master":  resource.(*api.CatalogEntry).Master,
+			})).Info("Catalog entry expired")
+		}
+		delete(m.resource, id)
+		delete(m.withdrawn, id)
+		delete(m.received, id)
+	}
+
+	// Report replicas that share a name
+	k.reportNameConflicts()
+}
+
+// catalogEntry returns the catalog entry for a replica mastered here.
+func (k *Ketch) catalogEntry(replica *api.Replica) *api.CatalogEntry {
+
+	entry := &api.CatalogEntry{
+		Common: api.Common{
+			Name:         replica.Name,
+			ID:           replica.ID,
+			State:        replica.State,
+			PendingState: replica.PendingState,
+		},
+		Master:          k.runtime.Name,
+		MasterServerID:  k.runtime.ID,
+		QuorumGroupSize: replica.QuorumGroupSize,
+		Reserving:       newReplica(replica) && !k.catalogMgr.reserved[replica.ID],
+	}
+	if replica.CurrentEpochID == nil {
+		return entry
+	}
+	id := *replica.CurrentEpochID
+	entry.EpochID = &id
+	if resource, ok := k.resourceMgr[api.TypeDBMgr].resource[replica.ID]; ok {
+		entry.DBState = resource.(*api.DBMgr).DBState
+	}
+	if epoch, ok := replica.Epochs[replica.CurrentEpochID.String()]; ok {
+		for _, member := range epoch.Quorum {
+			entry.Members = append(entry.Members, api.CatalogMember{
+				Server:     member.Name,
+				ServerID:   member.ID,
+				MemberType: member.MemberType,
+				DataState:  member.DataState,
+			})
+		}
+	}
+	return entry
+}
+
+// publishCatalogEntry records an entry locally and queues it for gossip.
+// Called locked.
+func (k *Ketch) publishCatalogEntry(entry *api.CatalogEntry, deleted bool) {
+
+	m := k.catalogMgr
+	update := &msg.MsgCatalogUpdate{
+		Common: msg.Common{
+			Type:      msg.MsgTypeCatalogUpdate,
+			SrcID:     k.runtime.ID,
+			ReplicaID: entry.ID,
+		},
+		Entry:   *entry,
+		Deleted: deleted,
+	}
+	k.mergeCatalogEntry(entry, deleted)
+	if deleted {
+		delete(m.published, entry.ID)
+		delete(m.publishedUptime, entry.ID)
+	} else {
+		m.published[entry.ID] = entry
+		m.publishedUptime[entry.ID] = k.uptime
+	}
+	k.queueCatalogUpdate(update)
+}
+
+// onCatalogUpdate merges a catalog update gossiped by another server
+// and gossips it on if it is new.
+// Called locked.
+func (k *Ketch) onCatalogUpdate(update *msg.MsgCatalogUpdate) {
+
+	if uuid.Equal(update.SrcID, k.runtime.ID) {
+		return
+	}
+	if k.mergeCatalogEntry(&update.Entry, update.Deleted) {
+		k.queueCatalogUpdate(update)
+	}
+}
+
+// queueCatalogUpdate queues a catalog update for gossip.
+func (k *Ketch) queueCatalogUpdate(update *msg.MsgCatalogUpdate) {
+
+	buf, err := msg.ToBytes(update)
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"replica": update.Entry.Name,
+			"err":     err,
+		})).Error("Failed to encode catalog update")
+		return
+	}
+	k.broadcasts.QueueBroadcast(&catalogBroadcast{
+		replicaID: update.ReplicaID,
+		buf:       buf,
+	})
+}
+
+// mergeCatalogEntry keeps an entry or withdrawal if it is newer than
+// what we have for the replica.  Returns true if kept.
+// Called locked.
+func (k *Ketch) mergeCatalogEntry(entry *api.CatalogEntry, deleted bool) bool {
+
+	m := k.catalogMgr
+	if entry.Version <= m.version(entry.ID) {
+		return false
+	}
+	if deleted {
+		delete(m.resource, entry.ID)
+		m.withdrawn[entry.ID] = entry.Version
+		for name, grant := range m.grants {
+			if uuid.Equal(grant.replicaID, entry.ID) {
+				delete(m.grants, name)
+			}
+		}
+	} else {
+		m.resource[entry.ID] = entry.Clone()
+		delete(m.withdrawn, entry.ID)
+	}
+	m.received[entry.ID] = k.uptime
+	return true
+}
+
+// catalogDigest returns the catalog for push/pull.
+// Called locked.
+func (k *Ketch) catalogDigest() []msg.CatalogDigest {
+
+	m := k.catalogMgr
+	var catalog []msg.CatalogDigest
+	for _, resource := range m.resource {
+		catalog = append(catalog, msg.CatalogDigest{
+			Entry: *resource.(*api.CatalogEntry),
+		})
+	}
+	for id, version := range m.withdrawn {
+		catalog = append(catalog, msg.CatalogDigest{
+			Entry: api.CatalogEntry{
+				Common:  api.Common{ID: id},
+				Version: version,
+			},
+			Deleted: true,
+		})
+	}
+	return catalog
+}
+
+// mergeCatalogDigest merges the catalog of a peer from push/pull.
+// Called locked.
+func (k *Ketch) mergeCatalogDigest(catalog []msg.CatalogDigest) {
+	for i := range catalog {
+		k.mergeCatalogEntry(&catalog[i].Entry, catalog[i].Deleted)
+	}
+}
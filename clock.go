@@ -0,0 +1,97 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Clock provides the monotonic time used for leases.
+type Clock interface {
+	// Uptime returns the time elapsed since the host booted.
+	Uptime() (time.Duration, error)
+	// After returns a channel that receives the wall time once
+	// d has elapsed on this clock.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock reads the host boot time clock, which is monotonic
+// and keeps counting while the host is suspended.
+type SystemClock struct{}
+
+// Uptime returns time since boot from CLOCK_BOOTTIME.
+func (c SystemClock) Uptime() (time.Duration, error) {
+	var ts unix.Timespec
+	err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ts.Nano()), nil
+}
+
+// After waits on the system timer.
+func (c SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// FakeClock is a clock that only moves when advanced.
+// It allows lease timing to be exercised without waiting.
+type FakeClock struct {
+	sync.Mutex
+	uptime  time.Duration
+	waiters []fakeClockWaiter
+}
+
+type fakeClockWaiter struct {
+	deadline time.Duration
+	ch       chan time.Time
+}
+
+// NewFakeClock returns a fake clock starting at the given uptime.
+func NewFakeClock(uptime time.Duration) *FakeClock {
+	return &FakeClock{uptime: uptime}
+}
+
+// Uptime returns the current fake uptime.
+func (c *FakeClock) Uptime() (time.Duration, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.uptime, nil
+}
+
+// After returns a channel that fires when the clock is advanced past d.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- time.Now()
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeClockWaiter{
+		deadline: c.uptime + d,
+		ch:       ch,
+	})
+	return ch
+}
+
+// Advance moves the clock forward and fires any expired waiters.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.uptime += d
+	waiters := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.deadline <= c.uptime {
+			waiter.ch <- time.Now()
+			continue
+		}
+		waiters = append(waiters, waiter)
+	}
+	c.waiters = waiters
+}
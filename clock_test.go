@@ -0,0 +1,98 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"testing"
+	"time"
+)
+
+// fired returns true if ch has received.
+func fired(ch <-chan time.Time) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSystemClock(t *testing.T) {
+	var clock SystemClock
+	first, err := clock.Uptime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first <= 0 {
+		t.Fatalf("Uptime is %v, expected positive", first)
+	}
+
+	// Uptime advances with the host clock
+	select {
+	case <-clock.After(10 * time.Millisecond):
+	case <-time.After(time.Second):
+		t.Fatal("Waiter did not fire")
+	}
+	second, err := clock.Uptime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second < first {
+		t.Fatalf("Uptime went back from %v to %v", first, second)
+	}
+}
+
+func TestFakeClockUptime(t *testing.T) {
+	clock := NewFakeClock(time.Hour)
+	uptime, err := clock.Uptime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uptime != time.Hour {
+		t.Fatalf("Uptime is %v, expected %v", uptime, time.Hour)
+	}
+	clock.Advance(1500 * time.Millisecond)
+	uptime, _ = clock.Uptime()
+	if uptime != time.Hour+1500*time.Millisecond {
+		t.Fatalf("Uptime is %v after advancing, expected %v", uptime, time.Hour+1500*time.Millisecond)
+	}
+}
+
+func TestFakeClockAfter(t *testing.T) {
+	clock := NewFakeClock(time.Hour)
+
+	// Waiters fire once the clock reaches their deadline, not before
+	short := clock.After(time.Second)
+	long := clock.After(3 * time.Second)
+	clock.Advance(999 * time.Millisecond)
+	if fired(short) || fired(long) {
+		t.Fatal("Waiter fired before its deadline")
+	}
+	clock.Advance(time.Millisecond)
+	if !fired(short) {
+		t.Fatal("Waiter did not fire at its deadline")
+	}
+	if fired(long) {
+		t.Fatal("Later waiter fired with an earlier one")
+	}
+
+	// Advancing past a deadline fires the waiter once
+	clock.Advance(5 * time.Second)
+	if !fired(long) {
+		t.Fatal("Waiter did not fire past its deadline")
+	}
+	clock.Advance(5 * time.Second)
+	if fired(short) || fired(long) {
+		t.Fatal("Waiter fired more than once")
+	}
+
+	// A wait that has already elapsed fires at once
+	if !fired(clock.After(0)) {
+		t.Fatal("Zero wait did not fire at once")
+	}
+	if !fired(clock.After(-time.Second)) {
+		t.Fatal("Negative wait did not fire at once")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
 
 	"github.com/watercraft/ketch"
 	"github.com/watercraft/ketch/api"
@@ -67,6 +68,32 @@ func HandleGetServer(w http.ResponseWriter, req *http.Request) {
 	writeResourceBody(w, api.TypeServer, list)
 }
 
+func HandlePostServerDrain(w http.ResponseWriter, req *http.Request) {
+	handleServerDrain(w, req, true)
+}
+
+func HandlePostServerUndrain(w http.ResponseWriter, req *http.Request) {
+	handleServerDrain(w, req, false)
+}
+
+// handleServerDrain drains or undrains the named server.
+func handleServerDrain(w http.ResponseWriter, req *http.Request, drain bool) {
+
+	name := mux.Vars(req)["name"]
+	runtime, err, status := Crew.DrainServer(name, drain)
+	if err != nil {
+		WriteError(w, err, status)
+		return
+	}
+	log.WithFields(ketch.Locate(logrus.Fields{
+		"name":  name,
+		"drain": drain,
+	})).Info("Changed server drain")
+
+	// Return runtime
+	writeResourceBody(w, api.TypeRuntime, api.ResourceList{runtime})
+}
+
 func HandleGetEpoch(w http.ResponseWriter, req *http.Request) {
 	list := Crew.GetResources(api.TypeEpoch)
 	writeResourceBody(w, api.TypeEpoch, list)
@@ -100,7 +127,136 @@ func HandlePostReplica(w http.ResponseWriter, req *http.Request) {
 	writeResourceBody(w, api.TypeReplica, list)
 }
 
+func HandlePostReplicaSwitchover(w http.ResponseWriter, req *http.Request) {
+
+	// Unmarshal optional switchover request
+	var switchover api.Switchover
+	if req.ContentLength != 0 {
+		decoder := json.NewDecoder(req.Body)
+		err := decoder.Decode(&switchover)
+		if err != nil {
+			WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+		defer req.Body.Close()
+	}
+
+	// Start switchover
+	name := mux.Vars(req)["name"]
+	replica, err, status := Crew.SwitchoverReplica(name, switchover.Server)
+	if err != nil {
+		WriteError(w, err, status)
+		return
+	}
+	log.WithFields(ketch.Locate(logrus.Fields{
+		"name":   name,
+		"server": switchover.Server,
+	})).Info("Started replica switchover")
+
+	// Return replica
+	writeResourceBody(w, api.TypeReplica, api.ResourceList{replica})
+}
+
+func HandlePatchReplica(w http.ResponseWriter, req *http.Request) {
+
+	// Unmarshal replica patch
+	var patch api.ReplicaPatch
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&patch)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	defer req.Body.Close()
+
+	// Start update
+	name := mux.Vars(req)["name"]
+	replica, err, status := Crew.UpdateReplica(name, &patch)
+	if err != nil {
+		WriteError(w, err, status)
+		return
+	}
+	log.WithFields(ketch.Locate(logrus.Fields{
+		"name": name,
+	})).Info("Started replica update")
+
+	// Return replica
+	writeResourceBody(w, api.TypeReplica, api.ResourceList{replica})
+}
+
+func HandleDeleteReplica(w http.ResponseWriter, req *http.Request) {
+
+	name := mux.Vars(req)["name"]
+	data := api.DataDisposition(req.URL.Query().Get("data"))
+	replica, err, status := Crew.DeleteReplica(name, data)
+	if err != nil {
+		WriteError(w, err, status)
+		return
+	}
+	log.WithFields(ketch.Locate(logrus.Fields{
+		"name": name,
+		"data": data,
+	})).Info("Started replica delete")
+
+	// Return replica being deleted
+	writeResourceBody(w, api.TypeReplica, api.ResourceList{replica})
+}
+
 func HandleGetDBmgr(w http.ResponseWriter, req *http.Request) {
 	list := Crew.GetResources(api.TypeDBMgr)
 	writeResourceBody(w, api.TypeDBMgr, list)
 }
+
+func HandleGetDivergence(w http.ResponseWriter, req *http.Request) {
+	list := Crew.GetResources(api.TypeDivergence)
+	writeResourceBody(w, api.TypeDivergence, list)
+}
+
+func HandleGetCatalog(w http.ResponseWriter, req *http.Request) {
+	list := Crew.GetResources(api.TypeCatalog)
+	writeResourceBody(w, api.TypeCatalog, list)
+}
+
+func HandleGetFault(w http.ResponseWriter, req *http.Request) {
+	list := Crew.GetResources(api.TypeFault)
+	writeResourceBody(w, api.TypeFault, list)
+}
+
+func HandlePostFault(w http.ResponseWriter, req *http.Request) {
+
+	// Unmarshal resouce list
+	list, err := api.UnmarshalList(api.TypeFault, req)
+	if err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Add faults
+	list, err, status := Crew.CreateResources(api.TypeFault, list)
+	if err != nil {
+		WriteError(w, err, status)
+		return
+	}
+	log.WithFields(ketch.Locate(logrus.Fields{
+		"count": len(list),
+	})).Info("Created faults")
+
+	// Return faults created
+	writeResourceBody(w, api.TypeFault, list)
+}
+
+func HandleDeleteFault(w http.ResponseWriter, req *http.Request) {
+
+	name := mux.Vars(req)["name"]
+	fault, err, status := Crew.DeleteResource(api.TypeFault, name)
+	if err != nil {
+		WriteError(w, err, status)
+		return
+	}
+	log.WithFields(ketch.Locate(logrus.Fields{
+		"name": name,
+	})).Info("Deleted fault")
+
+	// Return fault deleted
+	writeResourceBody(w, api.TypeFault, api.ResourceList{fault})
+}
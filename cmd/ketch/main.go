@@ -7,6 +7,7 @@ package main
 import (
 	"net"
 	"os"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/hashicorp/memberlist"
@@ -24,7 +25,7 @@ func main() {
 	// Build CLI
 	app := cli.NewApp()
 	app.Name = "ketch"
-	app.Version = "1.0.0"
+	app.Version = ketch.Version
 	app.Usage = "Service for managing database replication. Once started, deploy and monitor databases with 'ketchctl'."
 	app.Action = func(c *cli.Context) error {
 		cli.ShowAppHelp(c)
@@ -80,6 +81,85 @@ func main() {
 			Usage:  "Directory for database executables",
 			EnvVar: "KETCH_DB_BIN_DIR",
 		},
+		cli.BoolFlag{
+			Name:   "witness",
+			Usage:  "Only host witness quorum members, which store no data",
+			EnvVar: "KETCH_WITNESS",
+		},
+		cli.StringSliceFlag{
+			Name:   "label",
+			Usage:  "Label for this server as key=value, e.g. zone=us-east-1a; may be repeated",
+			EnvVar: "KETCH_LABELS",
+		},
+		cli.UintFlag{
+			Name:   "weight",
+			Value:  1,
+			Usage:  "Relative capacity of this server; a server with twice the weight is given twice the replicas",
+			EnvVar: "KETCH_WEIGHT",
+		},
+		cli.Uint64Flag{
+			Name:   "min-free-disk-mb",
+			Value:  1024,
+			Usage:  "Free space in MB below which a server is chosen for quorum members only when no other fits",
+			EnvVar: "KETCH_MIN_FREE_DISK_MB",
+		},
+		cli.DurationFlag{
+			Name:   "rebalance-interval",
+			Value:  10 * time.Minute,
+			Usage:  "Least time between moves of quorum members off overloaded servers; 0 disables rebalancing",
+			EnvVar: "KETCH_REBALANCE_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "boot-source",
+			Usage:  "Source of host boot identity: boot_id, btime or utmp; the first available if unset",
+			EnvVar: "KETCH_BOOT_SOURCE",
+		},
+		cli.DurationFlag{
+			Name:   "retransmit-interval",
+			Value:  time.Second,
+			Usage:  "Time between retries of protocol requests, e.g. 250ms.",
+			EnvVar: "KETCH_RETRANSMIT_INTERVAL",
+		},
+		cli.DurationFlag{
+			Name:   "lease-period",
+			Value:  9 * time.Second,
+			Usage:  "Length of a master lease. Must be the same on all servers.",
+			EnvVar: "KETCH_LEASE_PERIOD",
+		},
+		cli.DurationFlag{
+			Name:   "lease-renew-before",
+			Value:  3 * time.Second,
+			Usage:  "Renew a master lease this long before it expires.",
+			EnvVar: "KETCH_LEASE_RENEW_BEFORE",
+		},
+		cli.DurationFlag{
+			Name:   "lease-grace",
+			Value:  time.Second,
+			Usage:  "Time acceptors hold a lease past its period. Must be the same on all servers.",
+			EnvVar: "KETCH_LEASE_GRACE",
+		},
+		cli.DurationFlag{
+			Name:   "lease-fence-before",
+			Usage:  "Stop a master database this long before its lease expires, if not yet renewed; 1s or half of --lease-renew-before if unset.",
+			EnvVar: "KETCH_LEASE_FENCE_BEFORE",
+		},
+		cli.DurationFlag{
+			Name:   "member-down-after",
+			Value:  2 * time.Second,
+			Usage:  "Close the epochs of a quorum member once it has been missing from the membership this long.",
+			EnvVar: "KETCH_MEMBER_DOWN_AFTER",
+		},
+		cli.DurationFlag{
+			Name:   "member-up-after",
+			Value:  5 * time.Second,
+			Usage:  "Leave a server that was down out of new epochs until it has been back this long.",
+			EnvVar: "KETCH_MEMBER_UP_AFTER",
+		},
+		cli.BoolFlag{
+			Name:   "enable-faults",
+			Usage:  "Serve the fault injection API, for testing only",
+			EnvVar: "KETCH_ENABLE_FAULTS",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -118,6 +198,29 @@ func runKetch(c *cli.Context) error {
 	config.Log = log
 	config.DataDir = c.GlobalString("data-dir")
 	config.DBBinDir = c.GlobalString("db-bin-dir")
+	config.Witness = c.GlobalBool("witness")
+	config.Labels, err = ketch.ParseLabels(c.GlobalStringSlice("label"))
+	if err != nil {
+		log.WithFields(ketch.Locate(logrus.Fields{
+			"err": err,
+		})).Fatal("Invalid label")
+	}
+	config.Weight = c.GlobalUint("weight")
+	config.MinFreeDisk = c.GlobalUint64("min-free-disk-mb") << 20
+	config.RebalanceInterval = c.GlobalDuration("rebalance-interval")
+	config.BootIdentity, err = ketch.BootIdentityBySource(c.GlobalString("boot-source"))
+	if err != nil {
+		log.WithFields(ketch.Locate(logrus.Fields{
+			"err": err,
+		})).Fatal("Invalid boot source")
+	}
+	config.RetransmitInterval = c.GlobalDuration("retransmit-interval")
+	config.LeasePeriod = c.GlobalDuration("lease-period")
+	config.LeaseRenewBefore = c.GlobalDuration("lease-renew-before")
+	config.LeaseGrace = c.GlobalDuration("lease-grace")
+	config.LeaseFenceBefore = c.GlobalDuration("lease-fence-before")
+	config.MemberDownAfter = c.GlobalDuration("member-down-after")
+	config.MemberUpAfter = c.GlobalDuration("member-up-after")
 	config.ListConfig = memberlist.DefaultLocalConfig()
 	config.ListConfig.Name = server
 	config.ListConfig.BindAddr = ips[0]
@@ -133,6 +236,6 @@ func runKetch(c *cli.Context) error {
 			"err":     err,
 		})).Fatal("Failed to join members")
 	}
-	ListenAndServe(c.GlobalString("api-server"), c.GlobalUint("api-port"))
+	ListenAndServe(c.GlobalString("api-server"), c.GlobalUint("api-port"), c.GlobalBool("enable-faults"))
 	return nil
 }
@@ -48,15 +48,30 @@ func NewLogger() *Logger {
 	return &Logger{logrus.New()}
 }
 
-func ListenAndServe(server string, port uint) {
+// ListenAndServe() serves the management API.  Fault injection is only
+// served if enabled, so a production server cannot be told to drop its
+// protocol messages.
+func ListenAndServe(server string, port uint, enableFaults bool) {
 
 	mux := mux.NewRouter()
 	mux.HandleFunc(string(api.URLBase+api.TypeRuntime), HandleGetRuntime).Methods("GET")
 	mux.HandleFunc(string(api.URLBase+api.TypeServer), HandleGetServer).Methods("GET")
+	mux.HandleFunc(string(api.URLBase+api.TypeServer)+"/{name}/drain", HandlePostServerDrain).Methods("POST")
+	mux.HandleFunc(string(api.URLBase+api.TypeServer)+"/{name}/undrain", HandlePostServerUndrain).Methods("POST")
 	mux.HandleFunc(string(api.URLBase+api.TypeEpoch), HandleGetEpoch).Methods("GET")
 	mux.HandleFunc(string(api.URLBase+api.TypeReplica), HandleGetReplica).Methods("GET")
 	mux.HandleFunc(string(api.URLBase+api.TypeReplica), HandlePostReplica).Methods("POST")
+	mux.HandleFunc(string(api.URLBase+api.TypeReplica)+"/{name}", HandleDeleteReplica).Methods("DELETE")
+	mux.HandleFunc(string(api.URLBase+api.TypeReplica)+"/{name}", HandlePatchReplica).Methods("PATCH")
+	mux.HandleFunc(string(api.URLBase+api.TypeReplica)+"/{name}/switchover", HandlePostReplicaSwitchover).Methods("POST")
 	mux.HandleFunc(string(api.URLBase+api.TypeDBMgr), HandleGetDBmgr).Methods("GET")
+	if enableFaults {
+		mux.HandleFunc(string(api.URLBase+api.TypeFault), HandleGetFault).Methods("GET")
+		mux.HandleFunc(string(api.URLBase+api.TypeFault), HandlePostFault).Methods("POST")
+		mux.HandleFunc(string(api.URLBase+api.TypeFault)+"/{name}", HandleDeleteFault).Methods("DELETE")
+	}
+	mux.HandleFunc(string(api.URLBase+api.TypeDivergence), HandleGetDivergence).Methods("GET")
+	mux.HandleFunc(string(api.URLBase+api.TypeCatalog), HandleGetCatalog).Methods("GET")
 
 	n := negroni.New(
 		negroni.NewRecovery(),
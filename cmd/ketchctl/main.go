@@ -6,6 +6,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -101,6 +102,21 @@ func main() {
 					Usage:  "Get list of local database managers.",
 					Action: getCmd,
 				},
+				{
+					Name:   "fault",
+					Usage:  "Get list of local fault injection rules. Requires ketch run with --enable-faults.",
+					Action: getCmd,
+				},
+				{
+					Name:   "catalog",
+					Usage:  "Get list of replicas across the cluster.",
+					Action: getCmd,
+				},
+				{
+					Name:   "divergence",
+					Usage:  "Get list of state differences found with peers.",
+					Action: getCmd,
+				},
 			},
 		},
 		{
@@ -119,6 +135,104 @@ func main() {
 						},
 					},
 				},
+				{
+					Name:   "fault",
+					Usage:  "Create a fault injection rule. Requires ketch run with --enable-faults.",
+					Action: createCmd,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "filename, f",
+							Value: "-",
+							Usage: "Filename to use as input for create.",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "delete",
+			Usage: "Deletes a resource.",
+			Subcommands: []cli.Command{
+				{
+					Name:      "replica",
+					Usage:     "Delete a replica from all quorum members. Must be run against the current master.",
+					ArgsUsage: "<name>",
+					Action:    deleteCmd,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "data, d",
+							Value: string(api.DataDispositionKeep),
+							Usage: "What becomes of the database files: keep, archive or remove.",
+						},
+					},
+				},
+				{
+					Name:      "fault",
+					Usage:     "Delete a fault injection rule. Requires ketch run with --enable-faults.",
+					ArgsUsage: "<name>",
+					Action:    deleteCmd,
+				},
+			},
+		},
+		{
+			Name:  "patch",
+			Usage: "Changes a resource.",
+			Subcommands: []cli.Command{
+				{
+					Name:      "replica",
+					Usage:     "Change quorum or database settings of a replica. Must be run against the current master.",
+					ArgsUsage: "<name>",
+					Action:    patchCmd,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "filename, f",
+							Value: "-",
+							Usage: "Filename with the settings to change.",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "switchover",
+			Usage: "Moves the master role of a resource to another server.",
+			Subcommands: []cli.Command{
+				{
+					Name:      "replica",
+					Usage:     "Switch over a replica to an in-sync member. Must be run against the current master.",
+					ArgsUsage: "<name>",
+					Action:    switchoverCmd,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "to, t",
+							Usage: "Name of the server to take over; defaults to any in-sync member.",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "drain",
+			Usage: "Moves replicas off a server for maintenance.",
+			Subcommands: []cli.Command{
+				{
+					Name:      "server",
+					Usage:     "Drain a server; get server shows it drained once it is safe to stop.",
+					ArgsUsage: "<name>",
+					Action:    drainCmd,
+				},
+			},
+		},
+		{
+			Name:  "undrain",
+			Usage: "Returns a drained server to service.",
+			Subcommands: []cli.Command{
+				{
+					Name:      "server",
+					Usage:     "Undrain a server.",
+					ArgsUsage: "<name>",
+					Action:    undrainCmd,
+				},
 			},
 		},
 	}
@@ -211,3 +325,207 @@ func createCmd(c *cli.Context) error {
 	// Output response
 	return outputResponse(resp)
 }
+
+// deleteCmd
+// deletes the resouce spcified in the subcommand name by the name argument.
+func deleteCmd(c *cli.Context) error {
+
+	// Read configuration
+	configPath := filepath.Join(configDir, configFile)
+	config, err := readConfig(c, configPath)
+	if err != nil {
+		return err
+	}
+
+	// Resource name to delete
+	if c.NArg() != 1 {
+		return cli.NewExitError(fmt.Sprintf("Must specify name of %s to delete", c.Command.Name), 1)
+	}
+	name := c.Args().First()
+
+	// Make request
+	url := "http://" + config.Server + ":" + strconv.Itoa(int(config.Port)) + string(api.URLBase) + c.Command.Name + "/" + name
+	if data := c.String("data"); data != "" {
+		url += "?data=" + data
+	}
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to build request to %s, error: %v", url, err), 1)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if resp == nil {
+		err = fmt.Errorf("No response from server")
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed request to %s, error: %v", url, err), 1)
+	}
+	defer resp.Body.Close()
+
+	// Output response
+	return outputResponse(resp)
+}
+
+// patchCmd
+// changes the resouce spcified in the subcommand name by the name argument using the file as input.
+func patchCmd(c *cli.Context) error {
+
+	// Read configuration
+	configPath := filepath.Join(configDir, configFile)
+	config, err := readConfig(c, configPath)
+	if err != nil {
+		return err
+	}
+
+	// Resource name to change
+	if c.NArg() != 1 {
+		return cli.NewExitError(fmt.Sprintf("Must specify name of %s to patch", c.Command.Name), 1)
+	}
+	name := c.Args().First()
+
+	// Read settings to change
+	in := os.Stdin
+	path := c.String("filename")
+	if path != "-" {
+		in, err = os.Open(path)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Failed to open file %s, error: %v", path, err), 1)
+		}
+	}
+	defer in.Close()
+	buf := bytes.NewBuffer(nil)
+	io.Copy(buf, in)
+	body, err := yaml.YAMLToJSON(buf.Bytes())
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to parse patch from %s, error: %v", path, err), 1)
+	}
+
+	// Make request
+	url := "http://" + config.Server + ":" + strconv.Itoa(int(config.Port)) + string(api.URLBase) + c.Command.Name + "/" + name
+	req, err := http.NewRequest("PATCH", url, bytes.NewReader(body))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to build request to %s, error: %v", url, err), 1)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if resp == nil {
+		err = fmt.Errorf("No response from server")
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed request to %s, error: %v", url, err), 1)
+	}
+	defer resp.Body.Close()
+
+	// Output response
+	return outputResponse(resp)
+}
+
+// switchoverCmd
+// moves the master role of the resouce spcified in the subcommand name by the name argument.
+func switchoverCmd(c *cli.Context) error {
+
+	// Read configuration
+	configPath := filepath.Join(configDir, configFile)
+	config, err := readConfig(c, configPath)
+	if err != nil {
+		return err
+	}
+
+	// Resource name to switch over
+	if c.NArg() != 1 {
+		return cli.NewExitError(fmt.Sprintf("Must specify name of %s to switch over", c.Command.Name), 1)
+	}
+	name := c.Args().First()
+	body, err := json.Marshal(api.Switchover{Server: c.String("to")})
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to build switchover request, error: %v", err), 1)
+	}
+
+	// Make request
+	url := "http://" + config.Server + ":" + strconv.Itoa(int(config.Port)) + string(api.URLBase) + c.Command.Name + "/" + name + "/switchover"
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if resp == nil {
+		err = fmt.Errorf("No response from server")
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed request to %s, error: %v", url, err), 1)
+	}
+	defer resp.Body.Close()
+
+	// Output response
+	return outputResponse(resp)
+}
+
+// drainCmd
+// drains the server named by the name argument.
+func drainCmd(c *cli.Context) error {
+	return postDrain(c, "drain")
+}
+
+// undrainCmd
+// undrains the server named by the name argument.
+func undrainCmd(c *cli.Context) error {
+	return postDrain(c, "undrain")
+}
+
+// postDrain
+// posts action to the API of the server named by the name argument,
+// found at its member address.
+func postDrain(c *cli.Context, action string) error {
+
+	// Read configuration
+	configPath := filepath.Join(configDir, configFile)
+	config, err := readConfig(c, configPath)
+	if err != nil {
+		return err
+	}
+
+	// Server name to drain
+	if c.NArg() != 1 {
+		return cli.NewExitError(fmt.Sprintf("Must specify name of %s to %s", c.Command.Name, action), 1)
+	}
+	name := c.Args().First()
+
+	// Look up the address of the server
+	url := "http://" + config.Server + ":" + strconv.Itoa(int(config.Port)) + string(api.URLBase) + string(api.TypeServer)
+	resp, err := http.Get(url)
+	if resp == nil {
+		err = fmt.Errorf("No response from server")
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed request to %s, error: %v", url, err), 1)
+	}
+	defer resp.Body.Close()
+	var resc api.ResourceBody
+	err = json.NewDecoder(resp.Body).Decode(&resc)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to parse server list, error: %v", err), 1)
+	}
+	addr := ""
+	for _, item := range resc.Data {
+		var server api.Server
+		err = json.Unmarshal(item.Attributes, &server)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Failed to parse server list, error: %v", err), 1)
+		}
+		if server.Name == name {
+			addr = server.Endpoint.Addr.String()
+		}
+	}
+	if addr == "" {
+		return cli.NewExitError(fmt.Sprintf("Server %s not found", name), 1)
+	}
+
+	// Make request
+	url = "http://" + addr + ":" + strconv.Itoa(int(config.Port)) + string(api.URLBase) + c.Command.Name + "/" + name + "/" + action
+	resp, err = http.Post(url, "application/json", nil)
+	if resp == nil {
+		err = fmt.Errorf("No response from server")
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed request to %s, error: %v", url, err), 1)
+	}
+	defer resp.Body.Close()
+
+	// Output response
+	return outputResponse(resp)
+}
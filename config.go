@@ -5,6 +5,8 @@
 package ketch
 
 import (
+	"fmt"
+	"math"
 	"net"
 	"os"
 	"os/signal"
@@ -15,6 +17,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
 	"github.com/hashicorp/memberlist"
+	"github.com/satori/go.uuid"
 
 	"github.com/watercraft/ketch/api"
 	"github.com/watercraft/ketch/msg"
@@ -27,6 +30,9 @@ const (
 	kDatabaseDirMode os.FileMode = 0700
 	// Mode to create Ketch database
 	kDatabaseMode os.FileMode = 0600
+	// Format of saved state: 1 saves lease times in milliseconds
+	// rather than seconds
+	kStateVersion uint = 1
 )
 
 // Config
@@ -43,19 +49,174 @@ type Config struct {
 
 	// DBBinDir is the directory for database executables.
 	DBBinDir string
+
+	// Transport carries protocol messages between members.
+	// Messages are sent over memberlist UDP if not set.
+	Transport Transport
+
+	// Clock provides uptime for lease timing.
+	// The system boot time clock is used if not set.
+	Clock Clock
+
+	// BootIdentity tells a host reboot from a restart of Ketch.
+	// The first available of the kernel boot ID, btime in /proc/stat
+	// and utmp is used if not set.
+	BootIdentity BootIdentity
+
+	// DBRunner starts database commands.
+	// Commands are run from DBBinDir if not set.
+	DBRunner DBRunner
+
+	// Witness limits this server to witness quorum members,
+	// which vote in epochs and leases but store no data.
+	Witness bool
+
+	// Labels describe this server, such as its zone and rack.  They
+	// are advertised to other servers and matched against the spread
+	// constraints of replicas.
+	Labels map[string]string
+
+	// Weight is the relative capacity of this server for placement;
+	// a server with twice the weight is given twice the replicas.
+	// Defaults to 1.
+	Weight uint
+
+	// MinFreeDisk is the free space in bytes below which a server's
+	// data directory is chosen for quorum members only when no other
+	// server fits.
+	MinFreeDisk uint64
+
+	// RebalanceInterval is the least time between moves of quorum
+	// members off overloaded servers by replicas mastered here.
+	// Rebalancing is off if zero.
+	RebalanceInterval time.Duration
+
+	// RetransmitInterval is the time between retries of protocol
+	// requests that are waiting on responses.
+	RetransmitInterval time.Duration
+
+	// LeasePeriod is the length of a master lease, renewed
+	// LeaseRenewBefore it expires.  Acceptors hold a lease for
+	// LeaseGrace past the period.  Shorter leases fail over faster
+	// but need prompt messaging, as on a LAN.  All servers must use
+	// the same LeasePeriod and LeaseGrace; peers that differ are
+	// refused membership.  Millisecond resolution; defaults apply to
+	// zero values.
+	LeasePeriod      time.Duration
+	LeaseRenewBefore time.Duration
+	LeaseGrace       time.Duration
+
+	// LeaseFenceBefore is how long before the lease expires that a
+	// master database not yet renewed is stopped.  Must be shorter
+	// than LeaseRenewBefore.
+	LeaseFenceBefore time.Duration
+
+	// MemberDownAfter is how long a quorum member must be missing from
+	// the membership before the epochs it is in are closed, so a brief
+	// gossip hiccup does not restart replicas.  A server that returns
+	// after being taken as down is left out of new epochs until it has
+	// stayed for MemberUpAfter.  Defaults apply to zero values.
+	MemberDownAfter time.Duration
+	MemberUpAfter   time.Duration
+}
+
+// setTimingDefaults fills in default timing and checks it is usable.
+func (c *Config) setTimingDefaults() error {
+	if c.RetransmitInterval == 0 {
+		c.RetransmitInterval = defaultRetransmitInterval
+	}
+	if c.LeasePeriod == 0 {
+		c.LeasePeriod = defaultLeasePeriod
+	}
+	if c.LeaseRenewBefore == 0 {
+		c.LeaseRenewBefore = defaultLeaseRenewBefore
+	}
+	if c.LeaseGrace == 0 {
+		c.LeaseGrace = defaultLeaseGrace
+	}
+	if c.LeaseFenceBefore == 0 {
+		c.LeaseFenceBefore = defaultLeaseFenceBefore
+		// Fence halfway through a short renewal window
+		if c.LeaseFenceBefore >= c.LeaseRenewBefore {
+			c.LeaseFenceBefore = c.LeaseRenewBefore / 2
+		}
+	}
+	if c.MemberDownAfter == 0 {
+		c.MemberDownAfter = defaultMemberDownAfter
+	}
+	if c.MemberUpAfter == 0 {
+		c.MemberUpAfter = defaultMemberUpAfter
+	}
+	switch {
+	case c.RetransmitInterval < time.Millisecond:
+		return fmt.Errorf("Retransmit interval must be at least 1ms")
+	case c.LeaseGrace < time.Millisecond:
+		return fmt.Errorf("Lease grace must be at least 1ms")
+	case c.LeasePeriod > time.Duration(math.MaxUint32)*time.Millisecond:
+		return fmt.Errorf("Lease period must be less than %v", time.Duration(math.MaxUint32)*time.Millisecond)
+	case c.LeaseRenewBefore <= c.RetransmitInterval:
+		return fmt.Errorf("Lease renew before (%v) must be longer than retransmit interval (%v)", c.LeaseRenewBefore, c.RetransmitInterval)
+	case c.LeaseRenewBefore <= c.LeaseFenceBefore:
+		return fmt.Errorf("Lease renew before (%v) must be longer than lease fence before (%v)", c.LeaseRenewBefore, c.LeaseFenceBefore)
+	case c.LeasePeriod <= c.LeaseRenewBefore:
+		return fmt.Errorf("Lease period (%v) must be longer than lease renew before (%v)", c.LeasePeriod, c.LeaseRenewBefore)
+	case (c.MemberDownAfter < 0) || (c.MemberUpAfter < 0):
+		return fmt.Errorf("Member down after (%v) and up after (%v) must not be negative", c.MemberDownAfter, c.MemberUpAfter)
+	}
+	return nil
 }
 
 // Create
-// Build ketch Ketch object from config.
+// Build ketch Ketch object from config.  Ketch keeps a copy of config
+// and of its memberlist configuration, so the defaults filled in here
+// are not written back to the caller.
 func Create(config *Config) (*Ketch, error) {
 
 	// Initialize Ketch
 	var k Ketch
 	k.log = config.Log
-	k.config = config
+	copied := *config
+	listConfig := *config.ListConfig
+	copied.ListConfig = &listConfig
+	k.config = &copied
+	if k.config.Clock == nil {
+		k.config.Clock = SystemClock{}
+	}
+	err := k.config.setTimingDefaults()
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"err": err,
+		})).Error("Invalid timing configuration")
+		return nil, err
+	}
+	if k.config.Weight == 0 {
+		k.config.Weight = 1
+	}
+	if k.config.Weight > math.MaxUint32 {
+		err = fmt.Errorf("Weight must be at most %d", uint32(math.MaxUint32))
+		k.log.WithFields(Locate(logrus.Fields{
+			"weight": k.config.Weight,
+			"err":    err,
+		})).Error("Invalid weight")
+		return nil, err
+	}
+	err = validateLabels(k.config.Labels)
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"labels": k.config.Labels,
+			"err":    err,
+		})).Error("Invalid labels")
+		return nil, err
+	}
+	if k.config.DBRunner == nil {
+		k.config.DBRunner = &ExecRunner{
+			Log:    k.log,
+			BinDir: k.config.DBBinDir,
+		}
+	}
 
 	// Create directory for Ketch database if it doesn't exist
-	err := os.MkdirAll(k.config.DataDir, kDatabaseDirMode)
+	err = os.MkdirAll(k.config.DataDir, kDatabaseDirMode)
 	if err != nil {
 		k.log.WithFields(Locate(logrus.Fields{
 			"datadir": k.config.DataDir,
@@ -80,12 +241,15 @@ func Create(config *Config) (*Ketch, error) {
 		return nil, err
 	}
 
-	// Get time of the last system reboot
-	k.bootTime, err = k.getBootTime()
+	// Identify the current boot of the host
+	if k.config.BootIdentity == nil {
+		k.config.BootIdentity = DefaultBootIdentity()
+	}
+	k.bootID, k.bootSource, err = k.config.BootIdentity.BootID()
 	if err != nil {
 		k.log.WithFields(Locate(logrus.Fields{
 			"err": err,
-		})).Error("Failed to get reboot time")
+		})).Error("Failed to identify host boot")
 		return nil, err
 	}
 
@@ -98,12 +262,14 @@ func Create(config *Config) (*Ketch, error) {
 	if k.runtime == nil {
 		k.runtime = &api.Runtime{
 			Common: api.Common{
-				Name: config.ListConfig.Name,
+				Name: k.config.ListConfig.Name,
 			},
-			BootTime: *k.bootTime,
+			BootID:       k.bootID,
+			BootSource:   k.bootSource,
+			StateVersion: kStateVersion,
 			Endpoint: api.Endpoint{
-				Addr: net.ParseIP(config.ListConfig.BindAddr),
-				Port: uint16(config.ListConfig.BindPort),
+				Addr: net.ParseIP(k.config.ListConfig.BindAddr),
+				Port: uint16(k.config.ListConfig.BindPort),
 			},
 		}
 		list := api.ResourceList{k.runtime}
@@ -118,11 +284,48 @@ func Create(config *Config) (*Ketch, error) {
 	// Initialize channels for incoming events
 	k.incomingMsgCh = make(chan msg.Msg, 10)
 	k.wakeServiceLoopCh = make(chan bool, 10)
+	k.watchdogs = make(map[uuid.UUID]*leaseWatchdog)
+	k.workers = make(map[uuid.UUID]*replicaWorker)
+	k.serverHealth = make(map[uuid.UUID]*serverHealth)
+	k.replicaDue = make(map[uuid.UUID]time.Duration)
+
+	// Install fault manager ahead of the transport that consults it
+	k.installFaultMgr()
+
+	// Open transport for protocol messages
+	k.transport = k.config.Transport
+	if k.transport == nil {
+		k.transport = NewMemberlistTransport()
+	}
+	err = k.transport.Open(&k, k.receiveMsg)
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"err": err,
+		})).Error("Failed to open transport")
+		return nil, err
+	}
+
+	// Queue gossip for members known once memberlist is running
+	k.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes: func() int {
+			if k.list == nil {
+				return 1
+			}
+			return k.list.NumMembers()
+		},
+		RetransmitMult: k.config.ListConfig.RetransmitMult,
+	}
+
+	// Describe this server in node meta
+	k.pgVersion = k.readPGVersion()
+	k.advertised = k.nodeInfo()
 
 	// Create Hashicorp Memberlist in memory object
-	config.ListConfig.Delegate = &k
-	config.ListConfig.DisableTcpPings = true
-	k.list, err = memberlist.Create(config.ListConfig)
+	k.config.ListConfig.Delegate = &k
+	k.config.ListConfig.Alive = &k
+	k.config.ListConfig.Events = &k
+	k.config.ListConfig.DisableTcpPings = true
+	k.list, err = memberlist.Create(k.config.ListConfig)
 	if err != nil {
 		k.log.WithFields(Locate(logrus.Fields{
 			"err": err,
@@ -135,21 +338,29 @@ func Create(config *Config) (*Ketch, error) {
 	k.installEpochMgr()
 	k.installReplicaMgr()
 	k.installDBMgrMgr()
+	k.installDivergenceMgr()
+	k.installCatalogMgr()
+
+	// Drop lease state from before this restart
+	k.reconcileLeases()
+	k.flushSaves()
 
 	// Catch stop signals
-	sigCh := make(chan os.Signal, 5)
-	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	k.sigCh = make(chan os.Signal, 5)
+	signal.Notify(k.sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		k.handleSignals(sigCh)
+		k.handleSignals(k.sigCh)
 	}()
 
 	// Launch service loop
+	k.shutdownCh = make(chan struct{})
+	k.loopWg.Add(2)
 	go k.dispatchIncomingMsgs()
 	go k.serviceLoop()
 
 	k.log.WithFields(Locate(logrus.Fields{
 		"dbpath":  dbpath,
-		"runtime": config.ListConfig.Name,
+		"runtime": k.config.ListConfig.Name,
 	})).Info("Open Ketch runtime")
 
 	return &k, nil
@@ -5,14 +5,14 @@
 package ketch
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/Sirupsen/logrus"
@@ -30,6 +30,12 @@ type DBMgr struct {
 	ResourceMgr
 }
 
+// maxWalSenders returns the number of WAL sender connections for the
+// master; one per standby plus two for a pg_basebackup streaming WAL.
+func maxWalSenders(replica *api.Replica) uint {
+	return replica.QuorumGroupSize - replica.WitnessCount + 1
+}
+
 func (k *Ketch) installDBMgrMgr() {
 	m := &DBMgr{
 		ResourceMgr: ResourceMgr{
@@ -58,81 +64,286 @@ func (k *Ketch) handleSignals(sigCh chan os.Signal) {
 	for _ = range sigCh {
 		k.Lock()
 		defer k.Unlock()
-		for _, resource := range k.resourceMgr[api.TypeDBMgr].resource {
-			dbmgr := resource.(*api.DBMgr)
-			if (dbmgr.RunCmd != nil) && (dbmgr.RunCmd.Process != nil) {
-				// "Fast" shutdown
-				dbmgr.RunCmd.Process.Signal(syscall.SIGINT)
-			}
-		}
+		k.stopDatabases()
+		k.flushSaves()
 		os.Exit(1)
 	}
 }
 
+// stopDatabases signals all running databases to stop.
+// Called locked.
+func (k *Ketch) stopDatabases() {
+	for _, resource := range k.resourceMgr[api.TypeDBMgr].resource {
+		stopDB(resource.(*api.DBMgr))
+	}
+}
+
+// run starts a database command on the worker of the replica and sets
+// the database manager to nextState once it exits cleanly.
+// Called locked.
 func run(m *ResourceMgr, dbmgr *api.DBMgr, nextState api.State, stdin io.Reader, command string, args ...string) {
-	m.k.log.WithFields(Locate(logrus.Fields{
-		"cmd":  command,
-		"args": args,
-	})).Info("Start")
-	dbmgr.RunCmd = exec.Command(path.Join(m.k.config.DBBinDir, command), args...)
-	dbmgr.RunCmd.Env = dbmgr.RunEnv
-	cmdOut, err := dbmgr.RunCmd.StdoutPipe()
-	if err != nil {
-		m.k.log.WithFields(Locate(logrus.Fields{
-			"dbmgr": dbmgr,
-			"err":   err,
-			"cmd":   command,
-			"args":  args,
-		})).Error("Failed to initialize output pipe")
+	k := m.k
+	dbmgr.RunCmd = nil
+	dbmgr.StartPending = true
+	k.replicaWork(dbmgr.ID, func() {
+		// Skip the command if Ketch stopped while it was queued
+		k.Lock()
+		select {
+		case <-k.shutdownCh:
+			dbmgr.StartPending = false
+			dbmgr.StopPending = false
+			k.Unlock()
+			return
+		default:
+		}
+		env := dbmgr.RunEnv
+		k.Unlock()
+
+		k.log.WithFields(Locate(logrus.Fields{
+			"cmd":  command,
+			"args": args,
+		})).Info("Start")
+		proc, err := k.config.DBRunner.Start(command, args, env, stdin)
+		if err != nil {
+			k.log.WithFields(Locate(logrus.Fields{
+				"dbmgr": dbmgr,
+				"err":   err,
+				"cmd":   command,
+				"args":  args,
+			})).Error("Failed to start command")
+		}
+
+		k.Lock()
+		dbmgr.StartPending = false
+		if proc == nil {
+			dbmgr.StopPending = false
+			dbmgr.PendingState = ""
+			k.Unlock()
+			return
+		}
+		dbmgr.RunCmd = proc
+		if dbmgr.StopPending {
+			// Stopped while starting
+			dbmgr.StopPending = false
+			proc.Signal(syscall.SIGINT)
+		}
+		k.Unlock()
+
+		err = proc.Wait()
+		k.Lock()
+		defer k.Unlock()
+		dbmgr.PendingState = ""
+		if (err != nil) && (err.Error() != "exec: not started") {
+			k.log.WithFields(Locate(logrus.Fields{
+				"dbmgr": dbmgr,
+				"err":   err,
+				"cmd":   command,
+				"args":  args,
+			})).Error("Command exited with error")
+			return
+		}
+		k.log.WithFields(Locate(logrus.Fields{
+			"cmd":  command,
+			"args": args,
+		})).Info("Completed")
+		dbmgr.State = nextState
+	})
+}
+
+// stopDB signals the database command to stop, or marks it to stop as
+// soon as it starts.
+// Called locked.
+func stopDB(dbmgr *api.DBMgr) {
+	if dbmgr.RunCmd == nil {
+		dbmgr.StopPending = dbmgr.StartPending
+		return
+	}
+	// "Fast" shutdown
+	dbmgr.RunCmd.Signal(syscall.SIGINT)
+}
+
+// queryLSN starts a query of the WAL position of the database: the
+// current write position on a running master, the replay position on a
+// running slave and the last checkpoint on a stopped database.  The
+// result is stored in dbmgr.LSN when the query completes, unless the
+// database started or stopped meanwhile.  Only one query is
+// outstanding per database.
+func queryLSN(m *ResourceMgr, replica *api.Replica, dbmgr *api.DBMgr) {
+	if dbmgr.LSNPending ||
+		((dbmgr.State != api.StateOpen) && (dbmgr.State != api.StateClosed)) {
+		return
 	}
-	scanOut := bufio.NewScanner(cmdOut)
+	state := dbmgr.State
+
+	// Read the control file of a stopped database
+	if state == api.StateClosed {
+		dbmgr.LSNPending = true
+		go func() {
+			out, err := m.k.config.DBRunner.Output("pg_controldata", []string{dbmgr.DBDir}, nil)
+			var lsn uint64
+			if err == nil {
+				lsn, err = parseCheckpointLSN(string(out))
+			}
+			setLSN(m, dbmgr, state, lsn, err)
+		}()
+		return
+	}
+
+	// Function names changed from xlog to wal in postgres 10
+	var query string
+	legacy := !pgVersionAtLeast(dbmgr.PGVersion, 10, 0)
+	switch {
+	case dbmgr.DBState == api.DBStateSlave && legacy:
+		query = "SELECT pg_last_xlog_replay_location()"
+	case dbmgr.DBState == api.DBStateSlave:
+		query = "SELECT pg_last_wal_replay_lsn()"
+	case legacy:
+		query = "SELECT pg_current_xlog_location()"
+	default:
+		query = "SELECT pg_current_wal_lsn()"
+	}
+	args := psqlArgs(m, replica, dbmgr, query)
+	env := dbmgr.RunEnv
+
+	dbmgr.LSNPending = true
 	go func() {
-		for scanOut.Scan() {
-			m.k.log.WithFields(Locate(logrus.Fields{
-				"cmd": command,
-			})).Info(scanOut.Text())
+		out, err := m.k.config.DBRunner.Output("psql", args, env)
+		var lsn uint64
+		if err == nil {
+			lsn, err = parseLSN(strings.TrimSpace(string(out)))
 		}
+		setLSN(m, dbmgr, state, lsn, err)
 	}()
-	cmdErr, err := dbmgr.RunCmd.StderrPipe()
+}
+
+// setLSN completes a WAL position query started in state.
+func setLSN(m *ResourceMgr, dbmgr *api.DBMgr, state api.State, lsn uint64, err error) {
+	m.k.Lock()
+	defer m.k.Unlock()
+	dbmgr.LSNPending = false
 	if err != nil {
+		// Expected while the database is starting
 		m.k.log.WithFields(Locate(logrus.Fields{
 			"dbmgr": dbmgr,
 			"err":   err,
-			"cmd":   command,
-			"args":  args,
-		})).Error("Failed to initialize error pipe")
+		})).Info("Failed to query WAL position")
+		return
 	}
-	scanErr := bufio.NewScanner(cmdErr)
-	go func() {
-		for scanErr.Scan() {
-			// All postgres output goes to stderr; don't flag
-			m.k.log.WithFields(Locate(logrus.Fields{
-				"cmd": command,
-			})).Error(scanErr.Text())
-		}
-	}()
-	dbmgr.RunCmd.Stdin = stdin
-	dbmgr.RunCmd.Start()
+	if dbmgr.State != state {
+		return
+	}
+	dbmgr.LSN = lsn
+}
+
+// psqlArgs returns the arguments for psql to run query on the running
+// database over its local socket.
+func psqlArgs(m *ResourceMgr, replica *api.Replica, dbmgr *api.DBMgr, query string) []string {
+	return []string{
+		"--host", m.k.config.DataDir,
+		"--port", fmt.Sprintf("%d", dbmgr.Port),
+		"--username", replica.DBConfig.Username,
+		"--dbname", "postgres",
+		"--no-align", "--tuples-only",
+		"--command", query,
+	}
+}
+
+// setDBPassword starts a change of the database user's password on a
+// running master to the configured one.  Once done, commands run with
+// the new password.  Returns true when the password is current.
+func setDBPassword(m *ResourceMgr, replica *api.Replica, dbmgr *api.DBMgr) bool {
+	if dbmgr.Password == replica.DBConfig.Password {
+		return true
+	}
+	if dbmgr.PasswordPending || (dbmgr.State != api.StateOpen) {
+		return false
+	}
+	password := replica.DBConfig.Password
+	query := fmt.Sprintf("ALTER ROLE \"%s\" WITH PASSWORD '%s'",
+		strings.Replace(replica.DBConfig.Username, "\"", "\"\"", -1),
+		strings.Replace(password, "'", "''", -1))
+	args := psqlArgs(m, replica, dbmgr, query)
+	env := dbmgr.RunEnv
+
+	dbmgr.PasswordPending = true
 	go func() {
-		err := dbmgr.RunCmd.Wait()
+		_, err := m.k.config.DBRunner.Output("psql", args, env)
 		m.k.Lock()
 		defer m.k.Unlock()
-		dbmgr.PendingState = ""
-		if (err != nil) && (err.Error() != "exec: not started") {
+		dbmgr.PasswordPending = false
+		if err != nil {
 			m.k.log.WithFields(Locate(logrus.Fields{
 				"dbmgr": dbmgr,
 				"err":   err,
-				"cmd":   command,
-				"args":  args,
-			})).Error("Command exited with error")
+			})).Error("Failed to change database password")
 			return
 		}
-		m.k.log.WithFields(Locate(logrus.Fields{
-			"cmd":  command,
-			"args": args,
-		})).Info("Completed")
-		dbmgr.State = nextState
+		dbmgr.Password = password
+		dbmgr.RunEnv = []string{fmt.Sprintf("PGPASSWORD=%s", password)}
 	}()
+	return false
+}
+
+// parseCheckpointLSN returns the last checkpoint location from
+// pg_controldata output.
+func parseCheckpointLSN(out string) (uint64, error) {
+	const label = "Latest checkpoint location:"
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, label) {
+			return parseLSN(strings.TrimSpace(strings.TrimPrefix(line, label)))
+		}
+	}
+	return 0, fmt.Errorf("Missing checkpoint location")
+}
+
+// parseLSN converts a postgres WAL position of the form "16/B374D848"
+// to a number.  An empty position, as reported by a slave that has not
+// replayed any WAL, is zero.
+func parseLSN(in string) (uint64, error) {
+	if in == "" {
+		return 0, nil
+	}
+	parts := strings.Split(in, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Invalid WAL position %q", in)
+	}
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	return hi<<32 | lo, nil
+}
+
+// Returns true when the database is stopped.
+func stopReplicaDB(m *ResourceMgr, replica *api.Replica) bool {
+
+	resource, ok := m.k.resourceMgr[api.TypeDBMgr].resource[replica.ID]
+	if !ok {
+		return true
+	}
+	dbmgr := resource.(*api.DBMgr)
+	if dbmgr.State != api.StateOpen {
+		return dbmgr.PendingState == ""
+	}
+	if dbmgr.PendingState != "" {
+		// Already stopping
+		return false
+	}
+	if (dbmgr.RunCmd == nil) && !dbmgr.StartPending {
+		m.k.log.WithFields(Locate(logrus.Fields{
+			"dbmgr": dbmgr,
+		})).Error("Database manager open without command")
+		return false
+	}
+	// "Fast" shutdown sends remaining WAL to connected slaves
+	dbmgr.PendingState = api.StateClosed
+	dbmgr.LSN = 0
+	stopDB(dbmgr)
+	return false
 }
 
 // Returns true when the database is up on the service port
@@ -144,32 +355,51 @@ func runReplicaOnPort(m *ResourceMgr, replica *api.Replica, dbState api.DBState,
 	if ok {
 		dbmgr = resource.(*api.DBMgr)
 	} else {
+		// Wait out disposal of the data of an earlier copy
+		if w, ok := m.k.workers[replica.ID]; ok && !w.idle() {
+			return false
+		}
 		dbmgr = &api.DBMgr{
 			Common:  replica.Common,
 			DBState: dbState,
 		}
 		dbmgr.State = api.StateUninitialized
-		dbmgr.RunEnv = []string{fmt.Sprintf("PGPASSWORD=%s", replica.DBConfig.Password)}
+		dbmgr.PendingState = ""
+		dbmgr.Password = replica.DBConfig.Password
+		dbmgr.RunEnv = []string{fmt.Sprintf("PGPASSWORD=%s", dbmgr.Password)}
 		m.k.resourceMgr[api.TypeDBMgr].resource[dbmgr.ID] = dbmgr
 	}
 
 	// If database already running...
 	if dbmgr.State == api.StateOpen {
-		// Already on correct port, return
-		if dbmgr.Port == port {
+		// Already on correct port and in correct state, return
+		if (dbmgr.Port == port) && (dbmgr.DBState == dbState) &&
+			(dbmgr.Password == replica.DBConfig.Password) {
 			return true
 		}
-		if (dbmgr.RunCmd == nil) || (dbmgr.RunCmd.Process == nil) {
+		if (dbmgr.RunCmd == nil) && !dbmgr.StartPending {
 			m.k.log.WithFields(Locate(logrus.Fields{
 				"dbmgr": dbmgr,
 			})).Error("Database manager open without command")
 			return false
 		}
+		// A master changes the password before restarting; slaves
+		// take the new one from the environment when restarted.
+		if (dbmgr.DBState != api.DBStateSlave) && !setDBPassword(m, replica, dbmgr) {
+			return false
+		}
 		// "Fast" shutdown to restart on correct port
-		dbmgr.RunCmd.Process.Signal(syscall.SIGINT)
+		stopDB(dbmgr)
 		return false
 	}
 
+	// A former master rejoins as a slave by rewinding its data
+	if (dbmgr.State == api.StateClosed) && (dbState == api.DBStateSlave) &&
+		(dbmgr.DBState != api.DBStateSlave) && (dbmgr.PendingState == "") {
+		dbmgr.State = api.StateUninitialized
+		dbmgr.DBState = dbState
+	}
+
 	// Create directory if it does not exist
 	dbmgr.DBDir = path.Join(m.k.config.DataDir, replica.ID.String())
 	info, err := os.Stat(dbmgr.DBDir)
@@ -229,7 +459,7 @@ func runReplicaOnPort(m *ResourceMgr, replica *api.Replica, dbState api.DBState,
 				run(m, dbmgr, api.StateClosed, nil, "pg_basebackup",
 					"--pgdata", dbmgr.DBDir,
 					"--host", master,
-					"--port", fmt.Sprintf("%d", dbmgr.Port),
+					"--port", fmt.Sprintf("%d", masterPort(replica)),
 					"--username", replica.DBConfig.Username,
 					"-X", "stream", "-P")
 			} else {
@@ -242,9 +472,12 @@ func runReplicaOnPort(m *ResourceMgr, replica *api.Replica, dbState api.DBState,
 			}
 			return false
 		} else if dbState == api.DBStateSlave {
+			dbmgr.PendingState = api.StateClosed
+			dbmgr.Port = port
 			run(m, dbmgr, api.StateClosed, nil, "pg_rewind",
 				"--target-pgdata", dbmgr.DBDir,
-				"--source-server", fmt.Sprintf("'host=%s port=%d user=%s application_name=%s'", master, dbmgr.Port, replica.DBConfig.Username, m.k.runtime.ID))
+				"--source-server", fmt.Sprintf("'host=%s port=%d user=%s application_name=%s'", master, masterPort(replica), replica.DBConfig.Username, m.k.runtime.ID))
+			return false
 		}
 		dbmgr.State = api.StateClosed
 
@@ -262,7 +495,13 @@ func runReplicaOnPort(m *ResourceMgr, replica *api.Replica, dbState api.DBState,
 	case api.StateClosed:
 		// Start server
 		dbmgr.State = api.StateOpen
+		dbmgr.DBState = dbState
 		dbmgr.Port = port
+		dbmgr.LSN = 0
+		if dbState == api.DBStateSlave {
+			dbmgr.Password = replica.DBConfig.Password
+			dbmgr.RunEnv = []string{fmt.Sprintf("PGPASSWORD=%s", dbmgr.Password)}
+		}
 		err = os.Remove(pwFile)
 		if err != nil && !os.IsNotExist(err) {
 			m.k.log.WithFields(Locate(logrus.Fields{
@@ -272,11 +511,19 @@ func runReplicaOnPort(m *ResourceMgr, replica *api.Replica, dbState api.DBState,
 			})).Error("Failed to remove password file")
 			return false
 		}
+		pgVersion, err := ioutil.ReadFile(path.Join(dbmgr.DBDir, "PG_VERSION"))
+		if err != nil {
+			m.k.log.WithFields(Locate(logrus.Fields{
+				"dbmgr": dbmgr,
+				"err":   err,
+			})).Error("Failed to read database version file")
+		}
+		dbmgr.PGVersion = strings.TrimSpace(string(pgVersion))
 		if dbState == api.DBStateSlave {
 			recoveryConf := path.Join(dbmgr.DBDir, "recovery.conf")
 			out := []byte("standby_mode='on'\n" +
 				fmt.Sprintf("primary_conninfo='host=%s port=%d user=%s application_name=%s'\n",
-					master, dbmgr.Port, replica.DBConfig.Username, m.k.runtime.ID) +
+					master, masterPort(replica), replica.DBConfig.Username, m.k.runtime.ID) +
 				"recovery_target_timeline='latest'\n" +
 				fmt.Sprintf("trigger_file='%s'\n", path.Join(dbmgr.DBDir, "trigger_file")))
 			err = ioutil.WriteFile(recoveryConf, out, DBFileMode)
@@ -290,11 +537,14 @@ func runReplicaOnPort(m *ResourceMgr, replica *api.Replica, dbState api.DBState,
 			run(m, dbmgr, api.StateClosed, nil, "postgres",
 				"-D", dbmgr.DBDir,
 				"-c", "listen_addresses=",
-				"-c", fmt.Sprintf("unix_socket_directories=%s", m.k.config.DataDir))
+				"-c", fmt.Sprintf("unix_socket_directories=%s", m.k.config.DataDir),
+				"-c", fmt.Sprintf("port=%d", dbmgr.Port))
 		} else {
+			// Local access is for WAL position queries; slaves
+			// inherit this file from the master.
 			hbaConf := path.Join(dbmgr.DBDir, "pg_hba.conf")
-			out := []byte(fmt.Sprintf("host all %s 0.0.0.0/0 md5\nhost replication %s 0.0.0.0/0 md5\n",
-				replica.DBConfig.Username, replica.DBConfig.Username))
+			out := []byte(fmt.Sprintf("local all %s md5\nhost all %s 0.0.0.0/0 md5\nhost replication %s 0.0.0.0/0 md5\n",
+				replica.DBConfig.Username, replica.DBConfig.Username, replica.DBConfig.Username))
 			err = ioutil.WriteFile(hbaConf, out, DBFileMode)
 			if err != nil {
 				m.k.log.WithFields(Locate(logrus.Fields{
@@ -310,8 +560,8 @@ func runReplicaOnPort(m *ResourceMgr, replica *api.Replica, dbState api.DBState,
 				"-c", fmt.Sprintf("listen_addresses=%s", m.k.runtime.Endpoint.Addr.String()),
 				"-c", "wal_level=hot_standby",
 				"-c", "synchronous_commit=on",
-				"-c", "max_wal_senders=3",
-				"-c", "synchronous_standby_names=''")
+				"-c", fmt.Sprintf("max_wal_senders=%d", maxWalSenders(replica)),
+				"-c", fmt.Sprintf("synchronous_standby_names=%s", syncStandbyNames(m, replica, dbmgr.PGVersion)))
 		}
 		return true
 	}
@@ -5,69 +5,198 @@
 package ketch
 
 import (
+	"encoding/binary"
+	"fmt"
+
 	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/memberlist"
 
 	"github.com/watercraft/ketch/msg"
 )
 
+// Node meta is the runtime ID followed by the format version of the
+// rest.  Later versions keep the layout up to node info and only add to
+// node info, whose decoding skips what it does not know, so servers of
+// any version from kNodeMetaMinVersion on can be members together and
+// a cluster can be upgraded one server at a time.  Servers from before
+// the version was added advertise the ID alone, and take node meta of
+// any other size as having no ID, so they cannot be members of the same
+// cluster as servers that advertise more.
+const (
+	// Size of the runtime ID at the start of node meta
+	kNodeMetaIDSize int = 16
+	// Offset of the format version, following the runtime ID
+	kNodeMetaVersionOffset int = kNodeMetaIDSize
+	// Offset of the flags, following the version
+	kNodeMetaFlagsOffset int = kNodeMetaVersionOffset + 1
+	// Offset and size of lease timing, following the flags: lease
+	// period and grace in milliseconds
+	kNodeMetaTimingOffset int = kNodeMetaFlagsOffset + 1
+	kNodeMetaTimingSize   int = 8
+	// Offset of node info, which takes the rest of node meta
+	kNodeMetaInfoOffset int = kNodeMetaTimingOffset + kNodeMetaTimingSize
+)
+
+const (
+	// Format version of node meta following the runtime ID
+	kNodeMetaVersion byte = 1
+	// Oldest format version of node meta accepted from peers
+	kNodeMetaMinVersion byte = 1
+)
+
+const (
+	// Node meta flags, following the version
+	kNodeMetaWitness byte = 1 << iota
+)
+
 func (k *Ketch) NodeMeta(limit int) []byte {
-	k.Lock()
-	defer k.Unlock()
+	k.RLock()
+	defer k.RUnlock()
 
 	k.log.WithFields(Locate(logrus.Fields{
 		"limit": limit,
 		"id":    k.runtime.ID,
 	})).Info("NodeMeta")
-	return k.runtime.ID.Bytes()
+	var flags byte
+	if k.config.Witness {
+		flags |= kNodeMetaWitness
+	}
+	meta := append(k.runtime.ID.Bytes(), kNodeMetaVersion, flags)
+	timing := make([]byte, kNodeMetaTimingSize)
+	binary.BigEndian.PutUint32(timing[0:], uint32(durationMs(k.config.LeasePeriod)))
+	binary.BigEndian.PutUint32(timing[4:], uint32(durationMs(k.config.LeaseGrace)))
+	meta = append(meta, timing...)
+	info, err := msg.NodeInfoToBytes(k.advertised)
+	if (err != nil) || (len(meta)+len(info) > limit) {
+		k.log.WithFields(Locate(logrus.Fields{
+			"limit": limit,
+			"size":  len(meta) + len(info),
+			"err":   err,
+		})).Error("Failed to encode node info")
+		return meta
+	}
+	return append(meta, info...)
 }
 
-func (k *Ketch) NotifyMsg(buf []byte) {
+// nodeMetaSupported returns true if node meta is in a format this
+// version reads, beyond the runtime ID.
+func nodeMetaSupported(meta []byte) bool {
+	return (len(meta) > kNodeMetaVersionOffset) && (meta[kNodeMetaVersionOffset] >= kNodeMetaMinVersion)
+}
 
-	// Decode message
-	msg, err := msg.FromBytes(buf)
-	if err != nil {
+// nodeMetaFlags returns the flags from node meta, if present.
+func nodeMetaFlags(meta []byte) byte {
+	if !nodeMetaSupported(meta) || (len(meta) <= kNodeMetaFlagsOffset) {
+		return 0
+	}
+	return meta[kNodeMetaFlagsOffset]
+}
+
+// nodeMetaTiming returns the lease period and grace in milliseconds
+// from node meta, if present.
+func nodeMetaTiming(meta []byte) (period uint32, grace uint32, ok bool) {
+	if !nodeMetaSupported(meta) || (len(meta) < kNodeMetaTimingOffset+kNodeMetaTimingSize) {
+		return 0, 0, false
+	}
+	timing := meta[kNodeMetaTimingOffset:]
+	return binary.BigEndian.Uint32(timing[0:]), binary.BigEndian.Uint32(timing[4:]), true
+}
+
+// NotifyAlive refuses peers whose lease timing differs from ours.  An
+// acceptor that expires a lease before its proposer does lets a second
+// master take over while the first still believes it holds the lease.
+// Peers of other versions are accepted as long as their node meta and
+// protocol versions are ones we support, so a cluster can be upgraded
+// one server at a time.  Peers from before node meta was versioned
+// can't tell our server ID or read our lease times, so they are refused.
+func (k *Ketch) NotifyAlive(peer *memberlist.Node) error {
+
+	period, grace, ok := nodeMetaTiming(peer.Meta)
+	if !ok {
+		err := fmt.Errorf("Peer %s node meta format is not supported", peer.Name)
 		k.log.WithFields(Locate(logrus.Fields{
+			"peer": peer.Name,
 			"err":  err,
-			"size": len(buf),
-			"buf":  buf,
-		})).Error("Failed to decode incoming message")
-		return
+		})).Error("Refused peer from an unsupported version")
+		return err
 	}
-
-	select {
-	case k.incomingMsgCh <- msg:
-	default:
+	info := nodeMetaInfo(peer.Meta)
+	if (info != nil) && (info.ProtocolVersion < msg.MinProtocolVersion) {
+		err := fmt.Errorf("Peer %s protocol version %d is not supported", peer.Name, info.ProtocolVersion)
 		k.log.WithFields(Locate(logrus.Fields{
-			"size": len(buf),
-			"msg":  msg,
-		})).Error("Incomming message channel full, discarding message")
+			"peer":         peer.Name,
+			"ketchVersion": info.KetchVersion,
+			"err":          err,
+		})).Error("Refused peer from an unsupported version")
+		return err
+	}
+	if (int64(period) == durationMs(k.config.LeasePeriod)) &&
+		(int64(grace) == durationMs(k.config.LeaseGrace)) {
+		return nil
+	}
+	err := fmt.Errorf("Peer %s lease timing is incompatible", peer.Name)
+	k.log.WithFields(Locate(logrus.Fields{
+		"peer":        peer.Name,
+		"leasePeriod": period,
+		"leaseGrace":  grace,
+		"err":         err,
+	})).Error("Refused peer with incompatible lease timing")
+	return err
+}
+
+func (k *Ketch) NotifyMsg(buf []byte) {
+
+	// Catalog updates arrive by gossip whatever the transport
+	if (len(buf) > 0) && (msg.MsgType(buf[0]) == msg.MsgTypeCatalogUpdate) {
+		k.receiveMsg(buf)
+		return
 	}
 
-	return
+	// Pass user messages to the memberlist transport, if in use
+	if k.notifyMsg != nil {
+		k.notifyMsg(buf)
+	}
 }
 
+// GetBroadcasts returns catalog updates to piggyback on gossip.
 func (k *Ketch) GetBroadcasts(overhead, limit int) [][]byte {
-
-	k.log.WithFields(Locate(logrus.Fields{
-		"overhead": overhead,
-		"limit":    limit,
-	})).Debug("GetBroadcasts")
-	return [][]byte{}
+	return k.broadcasts.GetBroadcasts(overhead, limit)
 }
 
+// LocalState returns the digest of our replicas for push/pull.
 func (k *Ketch) LocalState(join bool) []byte {
+	k.RLock()
+	defer k.RUnlock()
 
-	k.log.WithFields(Locate(logrus.Fields{
-		"join": join,
-	})).Debug("LocalState")
-	return []byte{}
+	buf, err := msg.DigestToBytes(k.localDigest())
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"join": join,
+			"err":  err,
+		})).Error("Failed to encode state digest")
+		return []byte{}
+	}
+	return buf
 }
 
+// MergeRemoteState compares a peer's digest with our state.
 func (k *Ketch) MergeRemoteState(buf []byte, join bool) {
 
-	k.log.WithFields(Locate(logrus.Fields{
-		"buf":  buf,
-		"join": join,
-	})).Info("MergeRemoteState")
-	return
+	// Peers that predate digests send nothing
+	if len(buf) == 0 {
+		return
+	}
+	digest, err := msg.DigestFromBytes(buf)
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"join": join,
+			"err":  err,
+		})).Error("Failed to decode state digest")
+		return
+	}
+
+	k.Lock()
+	k.mergeDigest(digest)
+	k.Unlock()
+	k.flushSaves()
 }
@@ -0,0 +1,61 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/msg"
+)
+
+// testNodeMeta returns node meta of the given format version, lease
+// timing and protocol version.
+func testNodeMeta(t *testing.T, version byte, period, grace time.Duration, protocol uint8) []byte {
+	meta := append(uuid.NewV4().Bytes(), version, 0)
+	timing := make([]byte, kNodeMetaTimingSize)
+	binary.BigEndian.PutUint32(timing[0:], uint32(durationMs(period)))
+	binary.BigEndian.PutUint32(timing[4:], uint32(durationMs(grace)))
+	info, err := msg.NodeInfoToBytes(&msg.NodeInfo{
+		KetchVersion:    "test",
+		ProtocolVersion: protocol,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(append(meta, timing...), info...)
+}
+
+func TestNotifyAlive(t *testing.T) {
+	k := newTestKetch(NewFakeClock(time.Hour))
+	period, grace := k.config.LeasePeriod, k.config.LeaseGrace
+
+	cases := []struct {
+		what   string
+		meta   []byte
+		accept bool
+	}{
+		{"same version", testNodeMeta(t, kNodeMetaVersion, period, grace, msg.ProtocolVersion), true},
+		{"newer version", testNodeMeta(t, kNodeMetaVersion+1, period, grace, msg.ProtocolVersion+1), true},
+		{"oldest version", testNodeMeta(t, kNodeMetaMinVersion, period, grace, msg.MinProtocolVersion), true},
+		{"other lease period", testNodeMeta(t, kNodeMetaVersion, period+time.Second, grace, msg.ProtocolVersion), false},
+		{"other lease grace", testNodeMeta(t, kNodeMetaVersion+1, period, grace+time.Millisecond, msg.ProtocolVersion), false},
+		{"older protocol", testNodeMeta(t, kNodeMetaVersion, period, grace, msg.MinProtocolVersion-1), false},
+		{"unversioned", uuid.NewV4().Bytes(), false},
+	}
+	for _, c := range cases {
+		err := k.NotifyAlive(&memberlist.Node{Name: "peer", Meta: c.meta})
+		if c.accept && (err != nil) {
+			t.Errorf("Peer with %s refused: %v", c.what, err)
+		}
+		if !c.accept && (err == nil) {
+			t.Errorf("Peer with %s accepted", c.what)
+		}
+	}
+}
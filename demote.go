@@ -0,0 +1,92 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/watercraft/ketch/api"
+	"github.com/watercraft/ketch/msg"
+)
+
+// A replica is demoted when this server loses its lease or finds the
+// replica's state inconsistent.  Only that replica is fenced: its
+// database is stopped and it gives up any lease.  The service loop then
+// recovers it in one of three ways:
+//
+// 1. If another server owns the lease, rejoin as its slave.
+// 2. If the epochs were revoked to a successor, wait for the successor's
+//    master to recreate the replica here or retire it.
+// 3. Otherwise retake the lease on the current epoch and run as master.
+
+// demoteReplica fences this server's copy of the replica.
+func demoteReplica(m *ResourceMgr, replica *api.Replica) {
+
+	m.k.log.WithFields(Locate(logrus.Fields{
+		"replica": replica.Name,
+	})).Error("Replica demoted")
+	replica.Demoted = true
+
+	// Drop references to missing epochs and give up any lease
+	if replica.CurrentEpochID != nil {
+		if _, ok := replica.Epochs[replica.CurrentEpochID.String()]; !ok {
+			replica.CurrentEpochID = nil
+		}
+	}
+	if replica.PriorEpochID != nil {
+		if _, ok := replica.Epochs[replica.PriorEpochID.String()]; !ok {
+			replica.PriorEpochID = nil
+		}
+	}
+	for _, epoch := range replica.Epochs {
+		epoch.LeaseOwner = false
+		epoch.LeaseExpireUptime = 0
+		epoch.LeaseConfirmedUptime = 0
+	}
+
+	stopReplicaDB(m, replica)
+	m.saveResource(replica.ID)
+}
+
+// Returns true once a demoted replica is recovered.
+func recoverDemotedReplica(m *ResourceMgr, replica *api.Replica, nextPeriod *time.Duration, outMsgs *msg.MsgList) bool {
+
+	// Database stays down until recovered
+	if !stopReplicaDB(m, replica) {
+		if *nextPeriod > m.k.config.RetransmitInterval {
+			*nextPeriod = m.k.config.RetransmitInterval
+		}
+		return false
+	}
+
+	// Rejoin as slave of the server that took over
+	if replica.MasterServerID != nil {
+		m.k.log.WithFields(Locate(logrus.Fields{
+			"replica": replica.Name,
+			"master":  replica.MasterServerID,
+		})).Info("Demoted replica rejoining as slave")
+		replica.Demoted = false
+		m.saveResource(replica.ID)
+		return true
+	}
+
+	// Wait to be recreated or retired by the master of a successor
+	if replica.CurrentEpochID == nil {
+		return false
+	}
+
+	// Retake lease on the current epoch
+	if !sendLeasePrepareReqs(m, replica, replica.CurrentEpochID, nil, nextPeriod, outMsgs) {
+		return false
+	}
+	m.k.log.WithFields(Locate(logrus.Fields{
+		"replica": replica.Name,
+	})).Info("Demoted replica recovered as master")
+	replica.Demoted = false
+	m.saveResource(replica.ID)
+	return true
+}
@@ -7,15 +7,50 @@ package ketch
 import (
 	"github.com/Sirupsen/logrus"
 
+	"github.com/watercraft/ketch/api"
 	"github.com/watercraft/ketch/msg"
 )
 
+// receiveMsg decodes a message from a transport and queues it for dispatch.
+func (k *Ketch) receiveMsg(buf []byte) {
+
+	// Decode message
+	msg, err := msg.FromBytes(buf)
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"err":  err,
+			"size": len(buf),
+			"buf":  buf,
+		})).Error("Failed to decode incoming message")
+		return
+	}
+
+	k.faultMgr.apply(api.FaultDirectionReceive, msg, k.queueMsg)
+}
+
+// queueMsg queues a received message for dispatch without blocking.
+func (k *Ketch) queueMsg(myMsg msg.Msg) {
+	select {
+	case k.incomingMsgCh <- myMsg:
+	default:
+		k.log.WithFields(Locate(logrus.Fields{
+			"msg": myMsg,
+		})).Error("Incomming message channel full, discarding message")
+	}
+}
+
 // dispatchIncomingMsgs dispatches messages from incoming channel
 func (k *Ketch) dispatchIncomingMsgs() {
 
+	defer k.loopWg.Done()
 	for {
 		// Pull message from channel; blocking
-		myMsg := <-k.incomingMsgCh
+		var myMsg msg.Msg
+		select {
+		case myMsg = <-k.incomingMsgCh:
+		case <-k.shutdownCh:
+			return
+		}
 
 		k.log.WithFields(Locate(logrus.Fields{
 			"msg": myMsg,
@@ -54,10 +89,31 @@ func (k *Ketch) dispatchIncomingMsgs() {
 			k.onReplicaCreateReq(myMsg.(*msg.MsgReplicaCreateReq), &outMsgs)
 		case msg.MsgTypeReplicaCreateResp:
 			k.onReplicaCreateResp(myMsg.(*msg.MsgReplicaCreateResp))
+		case msg.MsgTypeReplicaSetInSyncReq:
+			k.onReplicaSetInSyncReq(myMsg.(*msg.MsgReplicaSetInSyncReq), &outMsgs)
+		case msg.MsgTypeReplicaSetInSyncResp:
+			k.onReplicaSetInSyncResp(myMsg.(*msg.MsgReplicaSetInSyncResp))
+		case msg.MsgTypeReplicaSwitchoverReq:
+			k.onReplicaSwitchoverReq(myMsg.(*msg.MsgReplicaSwitchoverReq), &outMsgs)
+		case msg.MsgTypeReplicaSwitchoverResp:
+			k.onReplicaSwitchoverResp(myMsg.(*msg.MsgReplicaSwitchoverResp))
+		case msg.MsgTypeReplicaDeleteReq:
+			k.onReplicaDeleteReq(myMsg.(*msg.MsgReplicaDeleteReq), &outMsgs)
+		case msg.MsgTypeReplicaDeleteResp:
+			k.onReplicaDeleteResp(myMsg.(*msg.MsgReplicaDeleteResp))
+		case msg.MsgTypeCatalogUpdate:
+			k.onCatalogUpdate(myMsg.(*msg.MsgCatalogUpdate))
+		case msg.MsgTypeNameReserveReq:
+			k.onNameReserveReq(myMsg.(*msg.MsgNameReserveReq), &outMsgs)
+		case msg.MsgTypeNameReserveResp:
+			k.onNameReserveResp(myMsg.(*msg.MsgNameReserveResp), &outMsgs)
 		}
+		// Process the replica on the next pass
+		delete(k.replicaDue, myMsg.GetCommon().ReplicaID)
 		k.Unlock()
 
-		// Send response messages
+		// Save changes, then send response messages
+		k.flushSaves()
 		k.sendMsgs(outMsgs)
 	}
 }
@@ -0,0 +1,139 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/watercraft/ketch/api"
+)
+
+// A server is drained for maintenance through its own API.  A draining
+// server advertises so in node meta and other servers no longer place
+// quorum members on it.  It switches over each replica it masters, and
+// masters elsewhere roll out a new epoch without it, retiring its copy
+// once the epoch is open.  The server reports drained once it hosts no
+// replicas and is then safe to stop.  Undraining makes it schedulable
+// again; the rebalancer moves replicas back over time.  Drain state is
+// persisted in the runtime so a restart does not undo it.
+
+// startServerDrain drains or undrains this server.
+// Returns the runtime, error and http status
+func startServerDrain(k *Ketch, name string, drain bool) (api.Resource, error, int) {
+
+	if name != k.runtime.Name {
+		return nil, fmt.Errorf("Server %s must be drained through its own API, not that of %s", name, k.runtime.Name), http.StatusConflict
+	}
+	switch {
+	case drain && (k.runtime.Drain == ""):
+		k.runtime.Drain = api.DrainStateDraining
+		k.log.WithFields(Locate(logrus.Fields{
+			"server": name,
+		})).Info("Server drain started")
+	case !drain && (k.runtime.Drain != ""):
+		k.runtime.Drain = ""
+		k.log.WithFields(Locate(logrus.Fields{
+			"server": name,
+		})).Info("Server undrained")
+	default:
+		return k.runtime.Clone(), nil, http.StatusOK
+	}
+	k.saveRuntime()
+	return k.runtime.Clone(), nil, http.StatusOK
+}
+
+// saveRuntime persists changes to the runtime.
+// Called locked.
+func (k *Ketch) saveRuntime() {
+	runtimeMgr := k.resourceMgr[api.TypeRuntime]
+	runtimeMgr.resource[k.runtime.ID] = k.runtime
+	runtimeMgr.saveResource(k.runtime.ID)
+}
+
+// drainReplica moves a replica mastered here off draining servers: it
+// switches over the replica if this server is draining, and otherwise
+// closes the epoch if a member is on a draining server and a new epoch
+// can be placed without one.  Returns true if either was started.
+func drainReplica(m *ResourceMgr, replica *api.Replica, nextPeriod *time.Duration) bool {
+
+	k := m.k
+	if (replica.PendingState != "") || (replica.SwitchoverServerID != nil) || (replica.PriorEpochID != nil) {
+		return false
+	}
+	epoch, ok := replica.Epochs[replica.CurrentEpochID.String()]
+	if !ok {
+		return false
+	}
+
+	// Hand over the master role first; the new master moves us out
+	if k.runtime.Drain != "" {
+		if _, err, _ := startReplicaSwitchover(m, replica.Name, ""); err != nil {
+			return false
+		}
+		if *nextPeriod > k.config.RetransmitInterval {
+			*nextPeriod = k.config.RetransmitInterval
+		}
+		return true
+	}
+
+	// Find a member on a draining server
+	serverMgr := k.resourceMgr[api.TypeServer]
+	var draining *api.Server
+	for _, mbr := range epoch.Quorum {
+		if resource, ok := serverMgr.resource[mbr.ID]; ok && (resource.(*api.Server).Drain != "") {
+			draining = resource.(*api.Server)
+			break
+		}
+	}
+	if draining == nil {
+		return false
+	}
+
+	// Move only if the next epoch fits without draining servers
+	trial := *replica
+	trial.PriorEpochID = replica.CurrentEpochID
+	trial.CurrentEpochID = nil
+	if _, _, ok := placeQuorum(m, &trial); !ok {
+		return false
+	}
+	k.log.WithFields(Locate(logrus.Fields{
+		"replica": replica.Name,
+		"server":  draining.Name,
+	})).Info("Replica moving off draining server")
+	replica.PendingState = api.StateClosed
+	m.saveResource(replica.ID)
+	if *nextPeriod > k.config.RetransmitInterval {
+		*nextPeriod = k.config.RetransmitInterval
+	}
+	return true
+}
+
+// updateDrainState reports this server drained once it hosts no
+// replicas.
+// Called locked.
+func (k *Ketch) updateDrainState() {
+
+	if k.runtime.Drain == "" {
+		return
+	}
+	state := api.DrainStateDraining
+	if len(k.resourceMgr[api.TypeReplica].resource) == 0 {
+		state = api.DrainStateDrained
+	}
+	if state == k.runtime.Drain {
+		return
+	}
+	k.runtime.Drain = state
+	k.saveRuntime()
+	if state == api.DrainStateDrained {
+		k.log.WithFields(Locate(logrus.Fields{
+			"server": k.runtime.Name,
+		})).Info("Server drained; safe to stop")
+	}
+}
@@ -6,6 +6,7 @@ package ketch
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/satori/go.uuid"
@@ -44,7 +45,7 @@ func (m *EpochMgr) UpdateAfterLoad(resource api.Resource) bool {
 
 // Send setup requests for the current epoch.
 // Returns true if all epoch members are open.
-func sendEpochSetupReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID, nextPeriod *uint16, outMsgs *msg.MsgList) bool {
+func sendEpochSetupReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID, nextPeriod *time.Duration, outMsgs *msg.MsgList) bool {
 
 	// Validate call
 	epoch, ok := replica.Epochs[epochID.String()]
@@ -52,7 +53,9 @@ func sendEpochSetupReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID
 		m.k.log.WithFields(Locate(logrus.Fields{
 			"epochID": epochID,
 			"replica": replica,
-		})).Fatal("Send epoch setup requests for unknown epoch")
+		})).Error("Send epoch setup requests for unknown epoch")
+		demoteReplica(m, replica)
+		return false
 	}
 
 	var count uint = 0
@@ -69,8 +72,8 @@ func sendEpochSetupReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID
 				},
 			}
 			m.k.sendMsg(msg, outMsgs)
-			if *nextPeriod > retransmitInterval {
-				*nextPeriod = retransmitInterval
+			if *nextPeriod > m.k.config.RetransmitInterval {
+				*nextPeriod = m.k.config.RetransmitInterval
 			}
 		case api.StateNew, api.StateOpen, api.StateClosed:
 			count++
@@ -81,7 +84,7 @@ func sendEpochSetupReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID
 			})).Error("Failed to send epoch setup request; unexpected member state")
 		}
 	}
-	return count == replica.QuorumGroupSize
+	return count == uint(len(epoch.Quorum))
 }
 
 func (k *Ketch) onEpochSetupReq(req *msg.MsgEpochSetupReq, outMsgs *msg.MsgList) {
@@ -137,7 +140,7 @@ func (k *Ketch) onEpochSetupResp(resp *msg.MsgEpochSetupResp) {
 
 // Send open requests for given epoch.
 // Returns true if all epoch members are open.
-func sendEpochOpenReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID, nextPeriod *uint16, outMsgs *msg.MsgList) bool {
+func sendEpochOpenReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID, nextPeriod *time.Duration, outMsgs *msg.MsgList) bool {
 
 	// Validate call
 	epoch, ok := replica.Epochs[epochID.String()]
@@ -145,7 +148,9 @@ func sendEpochOpenReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID,
 		m.k.log.WithFields(Locate(logrus.Fields{
 			"epochID": epochID,
 			"replica": replica,
-		})).Fatal("Send epoch open requests for unknown epoch")
+		})).Error("Send epoch open requests for unknown epoch")
+		demoteReplica(m, replica)
+		return false
 	}
 
 	var count uint = 0
@@ -162,8 +167,8 @@ func sendEpochOpenReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID,
 				},
 			}
 			m.k.sendMsg(msg, outMsgs)
-			if *nextPeriod > retransmitInterval {
-				*nextPeriod = retransmitInterval
+			if *nextPeriod > m.k.config.RetransmitInterval {
+				*nextPeriod = m.k.config.RetransmitInterval
 			}
 		case api.StateOpen:
 			count++
@@ -174,7 +179,7 @@ func sendEpochOpenReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID,
 			})).Error("Failed to send epoch open request; unexpected member state")
 		}
 	}
-	return count == replica.QuorumGroupSize
+	return count == uint(len(epoch.Quorum))
 }
 
 func (k *Ketch) onEpochOpenReq(req *msg.MsgEpochOpenReq, outMsgs *msg.MsgList) {
@@ -254,7 +259,7 @@ func (k *Ketch) onEpochOpenResp(resp *msg.MsgEpochOpenResp) {
 
 // Send close requests for given epoch.
 // Returns true if all epoch members are open.
-func sendEpochCloseReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID, nextPeriod *uint16, outMsgs *msg.MsgList) bool {
+func sendEpochCloseReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID, nextPeriod *time.Duration, outMsgs *msg.MsgList) bool {
 
 	// Validate call
 	epoch, ok := replica.Epochs[epochID.String()]
@@ -262,7 +267,9 @@ func sendEpochCloseReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID
 		m.k.log.WithFields(Locate(logrus.Fields{
 			"epochID": epochID,
 			"replica": replica,
-		})).Fatal("Send epoch close requests for unknown epoch")
+		})).Error("Send epoch close requests for unknown epoch")
+		demoteReplica(m, replica)
+		return false
 	}
 
 	var count uint = 0
@@ -279,8 +286,8 @@ func sendEpochCloseReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID
 				},
 			}
 			m.k.sendMsg(msg, outMsgs)
-			if *nextPeriod > retransmitInterval {
-				*nextPeriod = retransmitInterval
+			if *nextPeriod > m.k.config.RetransmitInterval {
+				*nextPeriod = m.k.config.RetransmitInterval
 			}
 		case api.StateClosed:
 			count++
@@ -291,7 +298,7 @@ func sendEpochCloseReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID
 			})).Error("Failed to send epoch close request; unexpected member state")
 		}
 	}
-	return count >= (replica.QuorumGroupSize / 2)
+	return count >= quorumMajority(uint(len(epoch.Quorum)))
 }
 
 func (k *Ketch) onEpochCloseReq(req *msg.MsgEpochCloseReq, outMsgs *msg.MsgList) {
@@ -366,7 +373,7 @@ func (k *Ketch) onEpochCloseResp(resp *msg.MsgEpochCloseResp) {
 
 // Send revoke requests for given epoch.
 // Returns true if all epoch members are revoked.
-func sendEpochRevokeReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID, successorEpochID *uuid.UUID, nextPeriod *uint16, outMsgs *msg.MsgList) bool {
+func sendEpochRevokeReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID, successorEpochID *uuid.UUID, nextPeriod *time.Duration, outMsgs *msg.MsgList) bool {
 
 	// Validate call
 	epoch, ok := replica.Epochs[epochID.String()]
@@ -375,7 +382,9 @@ func sendEpochRevokeReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUI
 			"epochID":          epochID,
 			"replica":          replica,
 			"successorEpochID": successorEpochID,
-		})).Fatal("Send epoch revoke requests for unknown epoch")
+		})).Error("Send epoch revoke requests for unknown epoch")
+		demoteReplica(m, replica)
+		return false
 	}
 
 	var count uint = 0
@@ -396,8 +405,8 @@ func sendEpochRevokeReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUI
 					SuccessorEpochID: *successorEpochID,
 				}
 				m.k.sendMsg(msg, outMsgs)
-				if *nextPeriod > retransmitInterval {
-					*nextPeriod = retransmitInterval
+				if *nextPeriod > m.k.config.RetransmitInterval {
+					*nextPeriod = m.k.config.RetransmitInterval
 				}
 			}
 		default:
@@ -408,7 +417,7 @@ func sendEpochRevokeReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUI
 		}
 	}
 
-	return count > (replica.QuorumGroupSize / 2)
+	return count >= quorumMajority(uint(len(epoch.Quorum)))
 }
 
 func (k *Ketch) onEpochRevokeReq(req *msg.MsgEpochRevokeReq, outMsgs *msg.MsgList) {
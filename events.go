@@ -0,0 +1,60 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"sync/atomic"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// The service loop processes each replica when it is next due, by the
+// period its own protocol steps ask for.  Messages for a replica make
+// it due on the next pass.  Membership events make every replica due
+// and wake the loop at once, so failover waits on failure detection
+// rather than on the next scheduled pass.  Memberlist raises events
+// while holding its own locks, which the loop takes under ours, so
+// events only set a flag and never take our lock.
+
+// NotifyJoin wakes the service loop when a server joins.
+func (k *Ketch) NotifyJoin(node *memberlist.Node) {
+	k.notifyMembership(node)
+}
+
+// NotifyLeave wakes the service loop when a server leaves.
+func (k *Ketch) NotifyLeave(node *memberlist.Node) {
+	k.notifyMembership(node)
+}
+
+// NotifyUpdate wakes the service loop when a server changes its node
+// meta, such as its replica count or drain state.
+func (k *Ketch) NotifyUpdate(node *memberlist.Node) {
+	k.notifyMembership(node)
+}
+
+// notifyMembership wakes the service loop for a change to a server
+// other than this one.
+func (k *Ketch) notifyMembership(node *memberlist.Node) {
+	if node.Name == k.config.ListConfig.Name {
+		return
+	}
+	k.wakeAllReplicas()
+}
+
+// wakeAllReplicas makes every replica due and wakes the service loop,
+// unless already woken.  Safe to call without our lock.
+func (k *Ketch) wakeAllReplicas() {
+	atomic.StoreInt32(&k.allReplicasDue, 1)
+	k.wakeServiceLoop()
+}
+
+// wakeServiceLoop wakes the service loop, unless already woken.  Never
+// blocks, so it is safe to call with our lock held.
+func (k *Ketch) wakeServiceLoop() {
+	select {
+	case k.wakeServiceLoopCh <- true:
+	default:
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+	"github.com/watercraft/ketch/msg"
+)
+
+const (
+	// Delay to release a reordered message if no other message follows
+	kDefaultReorderDelay time.Duration = time.Second
+)
+
+// FaultMgr manages fault injection rules for protocol messages.
+type FaultMgr struct {
+	ResourceMgr
+	sync.Mutex
+	// rules is a copy of the faults for use without the Ketch lock
+	rules []*faultRule
+	// held is the message held by each reorder fault between a pair
+	// of servers
+	held map[heldKey]*heldMsg
+	rand *rand.Rand
+}
+
+type faultRule struct {
+	fault    *api.Fault
+	msgTypes map[msg.MsgType]bool
+	delay    time.Duration
+}
+
+// heldKey identifies the messages a reorder fault swaps: those of one
+// fault from one server to another.
+type heldKey struct {
+	faultID uuid.UUID
+	srcID   uuid.UUID
+	destID  uuid.UUID
+}
+
+type heldMsg struct {
+	msg     msg.Msg
+	deliver func(msg.Msg)
+	timer   *time.Timer
+}
+
+func (k *Ketch) installFaultMgr() {
+	m := &FaultMgr{
+		ResourceMgr: ResourceMgr{
+			myType:    api.TypeFault,
+			assignIDs: true,
+			named:     true,
+			persist:   false,
+		},
+		held: make(map[heldKey]*heldMsg),
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	k.faultMgr = m
+	m.Init(k, m)
+}
+
+func (m *FaultMgr) InitResource(in api.Resource) (error, int) {
+
+	fault := in.(*api.Fault)
+	_, err := newFaultRule(fault)
+	if err != nil {
+		return err, http.StatusBadRequest
+	}
+
+	// Resolve server names to IDs
+	fault.SrcID = nil
+	fault.DestID = nil
+	serverMgr := m.k.resourceMgr[api.TypeServer]
+	if fault.Src != "" {
+		id, ok := serverMgr.resourceByName[fault.Src]
+		if !ok {
+			return fmt.Errorf("Unknown source server %s", fault.Src), http.StatusBadRequest
+		}
+		fault.SrcID = &id
+	}
+	if fault.Dest != "" {
+		id, ok := serverMgr.resourceByName[fault.Dest]
+		if !ok {
+			return fmt.Errorf("Unknown destination server %s", fault.Dest), http.StatusBadRequest
+		}
+		fault.DestID = &id
+	}
+	return nil, http.StatusOK
+}
+
+func (m *FaultMgr) GetList() api.ResourceList {
+	return nil
+}
+
+func (m *FaultMgr) UpdateAfterLoad(resource api.Resource) bool {
+	return false
+}
+
+// ResourcesChanged copies the faults for use without the Ketch lock.
+// Called locked.
+func (m *FaultMgr) ResourcesChanged() {
+
+	var names []string
+	for name := range m.resourceByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var rules []*faultRule
+	for _, name := range names {
+		fault := m.resource[m.resourceByName[name]].Clone().(*api.Fault)
+		rule, err := newFaultRule(fault)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.rules = rules
+}
+
+// newFaultRule validates a fault and prepares it for matching.
+func newFaultRule(fault *api.Fault) (*faultRule, error) {
+
+	rule := &faultRule{
+		fault:    fault,
+		msgTypes: make(map[msg.MsgType]bool),
+	}
+	switch fault.Action {
+	case api.FaultActionDrop, api.FaultActionDelay, api.FaultActionDuplicate, api.FaultActionReorder:
+	default:
+		return nil, fmt.Errorf("Unknown fault action %s", fault.Action)
+	}
+	switch fault.Direction {
+	case "", api.FaultDirectionSend, api.FaultDirectionReceive:
+	default:
+		return nil, fmt.Errorf("Unknown fault direction %s", fault.Direction)
+	}
+	for _, name := range fault.MsgTypes {
+		myType, err := msg.ParseMsgType(name)
+		if err != nil {
+			return nil, err
+		}
+		rule.msgTypes[myType] = true
+	}
+	if fault.Probability < 0 || fault.Probability > 1 {
+		return nil, fmt.Errorf("Fault probability must be between 0 and 1")
+	}
+	if fault.Delay != "" {
+		var err error
+		rule.delay, err = time.ParseDuration(fault.Delay)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fault.Action == api.FaultActionDelay && rule.delay <= 0 {
+		return nil, fmt.Errorf("Delay fault requires a delay")
+	}
+	if fault.Action == api.FaultActionReorder && rule.delay <= 0 {
+		rule.delay = kDefaultReorderDelay
+	}
+	return rule, nil
+}
+
+// match returns true if the rule applies to the message.
+// Called with fault manager locked.
+func (m *FaultMgr) match(rule *faultRule, dir api.FaultDirection, myMsg msg.Msg) bool {
+
+	fault := rule.fault
+	common := myMsg.GetCommon()
+	if fault.Direction != "" && fault.Direction != dir {
+		return false
+	}
+	if fault.SrcID != nil && *fault.SrcID != common.SrcID {
+		return false
+	}
+	if fault.DestID != nil && *fault.DestID != common.DestID {
+		return false
+	}
+	if len(rule.msgTypes) > 0 && !rule.msgTypes[common.Type] {
+		return false
+	}
+	if fault.Probability > 0 && m.rand.Float64() >= fault.Probability {
+		return false
+	}
+	return true
+}
+
+// apply passes a message through the fault rules.  The message is
+// passed to deliver zero or more times, possibly after a delay.
+func (m *FaultMgr) apply(dir api.FaultDirection, myMsg msg.Msg, deliver func(msg.Msg)) {
+
+	m.Lock()
+	var rule *faultRule
+	for _, candidate := range m.rules {
+		if m.match(candidate, dir, myMsg) {
+			rule = candidate
+			break
+		}
+	}
+	if rule == nil {
+		m.Unlock()
+		deliver(myMsg)
+		return
+	}
+
+	m.k.log.WithFields(Locate(logrus.Fields{
+		"fault": rule.fault.Name,
+		"dir":   dir,
+		"msg":   myMsg,
+	})).Info("Inject fault")
+
+	switch rule.fault.Action {
+	case api.FaultActionDrop:
+		m.Unlock()
+	case api.FaultActionDelay:
+		m.Unlock()
+		time.AfterFunc(rule.delay, func() {
+			deliver(myMsg)
+		})
+	case api.FaultActionDuplicate:
+		m.Unlock()
+		deliver(myMsg)
+		deliver(myMsg)
+	case api.FaultActionReorder:
+		common := myMsg.GetCommon()
+		key := heldKey{
+			faultID: rule.fault.ID,
+			srcID:   common.SrcID,
+			destID:  common.DestID,
+		}
+		held, ok := m.held[key]
+		if ok {
+			// Deliver this message ahead of the held message
+			held.timer.Stop()
+			delete(m.held, key)
+			m.Unlock()
+			deliver(myMsg)
+			held.deliver(held.msg)
+			return
+		}
+		held = &heldMsg{
+			msg:     myMsg,
+			deliver: deliver,
+		}
+		held.timer = time.AfterFunc(rule.delay, func() {
+			m.release(key, held)
+		})
+		m.held[key] = held
+		m.Unlock()
+	default:
+		m.Unlock()
+		deliver(myMsg)
+	}
+}
+
+// release delivers a held message if nothing overtook it.
+func (m *FaultMgr) release(key heldKey, held *heldMsg) {
+	m.Lock()
+	if m.held[key] != held {
+		m.Unlock()
+		return
+	}
+	delete(m.held, key)
+	m.Unlock()
+	held.deliver(held.msg)
+}
@@ -0,0 +1,73 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+	"github.com/watercraft/ketch/msg"
+)
+
+// newTestFaultMgr returns a fault manager applying a single fault.
+func newTestFaultMgr(t *testing.T, fault *api.Fault) *FaultMgr {
+	rule, err := newFaultRule(fault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &FaultMgr{
+		held:  make(map[heldKey]*heldMsg),
+		rand:  rand.New(rand.NewSource(1)),
+		rules: []*faultRule{rule},
+	}
+	m.k = newTestKetch(NewFakeClock(time.Hour))
+	return m
+}
+
+func TestFaultReorderByPeer(t *testing.T) {
+	m := newTestFaultMgr(t, &api.Fault{
+		Common: api.Common{ID: uuid.NewV4()},
+		Action: api.FaultActionReorder,
+		Delay:  "1h",
+	})
+	src := uuid.NewV4()
+	peerB := uuid.NewV4()
+	peerC := uuid.NewV4()
+	newMsg := func(dest uuid.UUID) msg.Msg {
+		return &msg.MsgLeasePrepareReq{
+			Common: msg.Common{Type: msg.MsgTypeLeasePrepareReq, SrcID: src, DestID: dest},
+		}
+	}
+
+	var delivered []msg.Msg
+	deliver := func(myMsg msg.Msg) {
+		delivered = append(delivered, myMsg)
+	}
+
+	// A message to another peer does not release the held message
+	toB1 := newMsg(peerB)
+	toC1 := newMsg(peerC)
+	m.apply(api.FaultDirectionSend, toB1, deliver)
+	m.apply(api.FaultDirectionSend, toC1, deliver)
+	if len(delivered) != 0 {
+		t.Fatalf("Delivered %d messages, expected all held", len(delivered))
+	}
+
+	// The next message to the same peer overtakes the held one
+	toB2 := newMsg(peerB)
+	m.apply(api.FaultDirectionSend, toB2, deliver)
+	if (len(delivered) != 2) || (delivered[0] != toB2) || (delivered[1] != toB1) {
+		t.Fatalf("Delivered %v, expected the second message to B ahead of the first", delivered)
+	}
+	toC2 := newMsg(peerC)
+	m.apply(api.FaultDirectionSend, toC2, deliver)
+	if (len(delivered) != 4) || (delivered[2] != toC2) || (delivered[3] != toC1) {
+		t.Fatalf("Delivered %v, expected the second message to C ahead of the first", delivered[2:])
+	}
+}
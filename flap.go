@@ -0,0 +1,161 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+)
+
+// Memberlist drops a server from its members once it is declared dead,
+// which a brief gossip hiccup can cause.  So a server missing from the
+// membership is only taken as down once it has been gone continuously
+// for MemberDownAfter; until then the epochs it is in stay open.  Each
+// departure is counted as a flap.  With hysteresis, a server that
+// returns after being taken as down is on probation and left out of
+// new epochs until it has stayed for MemberUpAfter, so a flapping
+// server is not placed only to be dropped again.  A server gone for
+// longer than both windows that is in no epoch of ours is forgotten.
+
+// serverHealth is what this server has seen of another's membership.
+type serverHealth struct {
+	name string
+	// goneUptime is when the server left the membership, 0 while it
+	// is a member
+	goneUptime int64
+	// upUptime is when the server last joined the membership
+	upUptime int64
+	// down is set once the server has been gone for MemberDownAfter
+	// and cleared once it has been back for MemberUpAfter
+	down bool
+	// flaps counts departures from the membership
+	flaps uint
+}
+
+// trackServers updates the health of servers from the current
+// membership.
+// Called locked.
+func (k *Ketch) trackServers() {
+
+	serverMgr := k.resourceMgr[api.TypeServer]
+	for id, resource := range serverMgr.resource {
+		h, ok := k.serverHealth[id]
+		if !ok {
+			k.serverHealth[id] = &serverHealth{
+				name:     resource.(*api.Server).Name,
+				upUptime: k.uptime,
+			}
+			continue
+		}
+		h.name = resource.(*api.Server).Name
+		if h.goneUptime != 0 {
+			if !h.down {
+				k.log.WithFields(Locate(logrus.Fields{
+					"server": h.name,
+					"gone":   time.Duration(k.uptime-h.goneUptime) * time.Millisecond,
+					"flaps":  h.flaps,
+				})).Warn("Server flapped")
+			}
+			h.goneUptime = 0
+			h.upUptime = k.uptime
+		}
+		if h.down && (k.uptime >= h.upUptime+durationMs(k.config.MemberUpAfter)) {
+			h.down = false
+			k.log.WithFields(Locate(logrus.Fields{
+				"server": h.name,
+				"flaps":  h.flaps,
+			})).Info("Server off probation")
+		}
+	}
+	for id, h := range k.serverHealth {
+		if _, ok := serverMgr.resource[id]; ok {
+			continue
+		}
+		if h.goneUptime == 0 {
+			h.goneUptime = k.uptime
+			h.flaps++
+		}
+		k.serverGone(id, h)
+		forget := h.goneUptime + durationMs(k.config.MemberDownAfter+k.config.MemberUpAfter)
+		if (k.uptime > forget) && !k.inAnyEpoch(id) {
+			delete(k.serverHealth, id)
+		}
+	}
+}
+
+// inAnyEpoch returns true if a server is a quorum member in an epoch
+// of any replica on this server.
+// Called locked.
+func (k *Ketch) inAnyEpoch(id uuid.UUID) bool {
+	for _, resource := range k.resourceMgr[api.TypeReplica].resource {
+		for _, epoch := range resource.(*api.Replica).Epochs {
+			for _, member := range epoch.Quorum {
+				if uuid.Equal(member.ID, id) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// serverGone marks a server missing from the membership down once it
+// has been gone for MemberDownAfter.  Returns the time until it is, or
+// 0 if it is down.
+func (k *Ketch) serverGone(id uuid.UUID, h *serverHealth) time.Duration {
+
+	if h.down {
+		return 0
+	}
+	remaining := h.goneUptime + durationMs(k.config.MemberDownAfter) - k.uptime
+	if remaining > 0 {
+		return time.Duration(remaining) * time.Millisecond
+	}
+	h.down = true
+	k.log.WithFields(Locate(logrus.Fields{
+		"server": h.name,
+		"id":     id,
+		"flaps":  h.flaps,
+	})).Error("Server down")
+	return 0
+}
+
+// memberDown returns true if a quorum member is missing from the
+// membership and has been for MemberDownAfter.  Otherwise shortens
+// nextPeriod to look again when the member would be taken as down.
+// Called locked.
+func (k *Ketch) memberDown(id uuid.UUID, nextPeriod *time.Duration) bool {
+
+	if _, ok := k.resourceMgr[api.TypeServer].resource[id]; ok {
+		return false
+	}
+
+	// Members not seen since we started are gone from now
+	h, ok := k.serverHealth[id]
+	if !ok {
+		h = &serverHealth{goneUptime: k.uptime}
+		k.serverHealth[id] = h
+	}
+	remaining := k.serverGone(id, h)
+	if remaining == 0 {
+		return true
+	}
+	if *nextPeriod > remaining {
+		*nextPeriod = remaining
+	}
+	return false
+}
+
+// onProbation returns true if a server has returned after being taken
+// as down and is not yet placed in new epochs.
+// Called locked.
+func (k *Ketch) onProbation(id uuid.UUID) bool {
+	h, ok := k.serverHealth[id]
+	return ok && h.down
+}
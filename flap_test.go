@@ -0,0 +1,158 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+)
+
+// removeTestServer removes a server from the server list, as if it left.
+func removeTestServer(k *Ketch, id uuid.UUID) {
+	delete(k.resourceMgr[api.TypeServer].resource, id)
+}
+
+// addTestQuorum makes this server the master of a replica whose
+// current epoch has the given quorum members.
+func addTestQuorum(k *Ketch, members ...uuid.UUID) *api.Replica {
+	replica, epoch, _ := addTestMaster(k, k.config.LeasePeriod)
+	epoch.Quorum = append(epoch.Quorum, api.QuorumMember{
+		Common:     api.Common{ID: k.runtime.ID},
+		MemberType: api.ReplicaQuorumMemberTypeSync,
+		DataState:  api.DataStateInSync,
+	})
+	for _, id := range members {
+		epoch.Quorum = append(epoch.Quorum, api.QuorumMember{
+			Common:     api.Common{ID: id},
+			MemberType: api.ReplicaQuorumMemberTypeSync,
+			DataState:  api.DataStateInSync,
+		})
+	}
+	return replica
+}
+
+// checkEpoch runs a pass of the membership check of a replica and
+// returns the time until the next pass.
+func checkEpoch(t *testing.T, k *Ketch, replica *api.Replica) time.Duration {
+	k.trackServers()
+	nextPeriod := k.config.LeasePeriod
+	if !markReplicaPendingClosed(k.resourceMgr[api.TypeReplica], replica, &nextPeriod) {
+		t.Fatal("Master held back by membership check")
+	}
+	return nextPeriod
+}
+
+func TestFlapKeepsEpoch(t *testing.T) {
+	clock := NewFakeClock(time.Hour)
+	k := newTestKetch(clock)
+	member1, member2 := uuid.NewV4(), uuid.NewV4()
+	addTestServer(k, "server2", member1)
+	addTestServer(k, "server3", member2)
+	replica := addTestQuorum(k, member1, member2)
+	checkEpoch(t, k, replica)
+
+	// A member that leaves is not down until MemberDownAfter
+	advanceTestKetch(k, clock, time.Second)
+	removeTestServer(k, member1)
+	nextPeriod := checkEpoch(t, k, replica)
+	if nextPeriod != k.config.MemberDownAfter {
+		t.Fatalf("Next pass in %v, expected %v to look again when the member would be down", nextPeriod, k.config.MemberDownAfter)
+	}
+	advanceTestKetch(k, clock, k.config.MemberDownAfter-time.Millisecond)
+	checkEpoch(t, k, replica)
+	if replica.PendingState != "" {
+		t.Fatal("Epoch closed before the member was down")
+	}
+
+	// Returning within MemberDownAfter keeps the epoch
+	addTestServer(k, "server2", member1)
+	checkEpoch(t, k, replica)
+	advanceTestKetch(k, clock, k.config.MemberDownAfter)
+	checkEpoch(t, k, replica)
+	if replica.PendingState != "" {
+		t.Fatal("Epoch closed for a member that flapped")
+	}
+	h := k.serverHealth[member1]
+	if (h.flaps != 1) || h.down || k.onProbation(member1) {
+		t.Fatalf("Member health is %d flaps, down %v; expected 1 flap, up", h.flaps, h.down)
+	}
+}
+
+func TestFlapDownClosesEpoch(t *testing.T) {
+	clock := NewFakeClock(time.Hour)
+	k := newTestKetch(clock)
+	member1, member2 := uuid.NewV4(), uuid.NewV4()
+	addTestServer(k, "server2", member1)
+	addTestServer(k, "server3", member2)
+	replica := addTestQuorum(k, member1, member2)
+	checkEpoch(t, k, replica)
+
+	// A member gone for MemberDownAfter is down and closes the epoch
+	removeTestServer(k, member1)
+	checkEpoch(t, k, replica)
+	advanceTestKetch(k, clock, k.config.MemberDownAfter)
+	checkEpoch(t, k, replica)
+	if replica.PendingState != api.StateClosed {
+		t.Fatal("Epoch not closed once the member was down")
+	}
+
+	// A member back after being down is on probation for MemberUpAfter
+	advanceTestKetch(k, clock, time.Second)
+	addTestServer(k, "server2", member1)
+	k.trackServers()
+	if !k.onProbation(member1) {
+		t.Fatal("Member back after being down is not on probation")
+	}
+	advanceTestKetch(k, clock, k.config.MemberUpAfter-time.Millisecond)
+	k.trackServers()
+	if !k.onProbation(member1) {
+		t.Fatal("Member off probation before MemberUpAfter")
+	}
+	advanceTestKetch(k, clock, time.Millisecond)
+	k.trackServers()
+	if k.onProbation(member1) {
+		t.Fatal("Member still on probation after MemberUpAfter")
+	}
+}
+
+func TestFlapForgetsServer(t *testing.T) {
+	clock := NewFakeClock(time.Hour)
+	k := newTestKetch(clock)
+	member1, member2, other := uuid.NewV4(), uuid.NewV4(), uuid.NewV4()
+	addTestServer(k, "server2", member1)
+	addTestServer(k, "server3", member2)
+	addTestServer(k, "server4", other)
+	replica := addTestQuorum(k, member1, member2)
+	checkEpoch(t, k, replica)
+
+	// Servers gone for both windows are forgotten unless in an epoch
+	removeTestServer(k, member1)
+	removeTestServer(k, other)
+	k.trackServers()
+	advanceTestKetch(k, clock, k.config.MemberDownAfter+k.config.MemberUpAfter)
+	k.trackServers()
+	if _, ok := k.serverHealth[other]; !ok {
+		t.Fatal("Server forgotten before both windows passed")
+	}
+	advanceTestKetch(k, clock, time.Millisecond)
+	k.trackServers()
+	if _, ok := k.serverHealth[other]; ok {
+		t.Fatal("Server in no epoch not forgotten")
+	}
+	if h, ok := k.serverHealth[member1]; !ok || !h.down {
+		t.Fatal("Member of an epoch forgotten")
+	}
+
+	// Once out of the epoch the member is forgotten too
+	replica.Epochs = nil
+	k.trackServers()
+	if _, ok := k.serverHealth[member1]; ok {
+		t.Fatal("Server out of every epoch not forgotten")
+	}
+}
@@ -5,24 +5,109 @@
 package ketch
 
 import (
+	"time"
+
+	"github.com/satori/go.uuid"
+
 	"github.com/watercraft/ketch/api"
 )
 
 // GetResources
 // returns list of resources.
 func (k *Ketch) GetResources(myType api.Type) api.ResourceList {
-	k.Lock()
-	defer k.Unlock()
-	return k.resourceMgr[myType].GetResources()
+	k.RLock()
+	defer k.RUnlock()
+	return k.resourceMgr[myType].listResources()
 }
 
 // CreateResources
 // creates resources from a list.
 // Returns the list created, error and http status
+// New replicas are returned once they reserve their names.
 func (k *Ketch) CreateResources(myType api.Type, list api.ResourceList) (api.ResourceList, error, int) {
 	k.Lock()
-	defer k.Unlock()
 	list, err, status := k.resourceMgr[myType].CreateResources(list)
-	k.wakeServiceLoopCh <- true // Wake service loop to service new resource
+	k.wakeServiceLoop() // Wake service loop to service new resource
+	k.Unlock()
+	k.flushSaves()
+	if (err != nil) || (myType != api.TypeReplica) {
+		return list, err, status
+	}
+	if err, status := k.awaitReplicaNames(list); err != nil {
+		return nil, err, status
+	}
 	return list, err, status
 }
+
+// SwitchoverReplica
+// moves the master role of the named replica to the named server,
+// or to an in-sync member if server is empty.
+// Returns the replica, error and http status
+func (k *Ketch) SwitchoverReplica(name string, server string) (api.Resource, error, int) {
+	defer k.flushSaves() // Save changes once unlocked
+	k.Lock()
+	defer k.Unlock()
+	replica, err, status := startReplicaSwitchover(k.resourceMgr[api.TypeReplica], name, server)
+	if err == nil {
+		delete(k.replicaDue, replica.GetCommon().ID)
+		k.wakeServiceLoop() // Wake service loop to start switchover
+	}
+	return replica, err, status
+}
+
+// DrainServer
+// drains the named server for maintenance, or undrains it.  Only this
+// server can be drained through its API.
+// Returns the runtime, error and http status
+func (k *Ketch) DrainServer(name string, drain bool) (api.Resource, error, int) {
+	defer k.flushSaves() // Save changes once unlocked
+	k.Lock()
+	defer k.Unlock()
+	runtime, err, status := startServerDrain(k, name, drain)
+	if err == nil {
+		k.replicaDue = make(map[uuid.UUID]time.Duration)
+		k.wakeServiceLoop() // Wake service loop to advertise drain
+	}
+	return runtime, err, status
+}
+
+// UpdateReplica
+// changes quorum and database settings of the named replica.
+// Returns the replica, error and http status
+func (k *Ketch) UpdateReplica(name string, patch *api.ReplicaPatch) (api.Resource, error, int) {
+	defer k.flushSaves() // Save changes once unlocked
+	k.Lock()
+	defer k.Unlock()
+	replica, err, status := startReplicaUpdate(k.resourceMgr[api.TypeReplica], name, patch)
+	if err == nil {
+		delete(k.replicaDue, replica.GetCommon().ID)
+		k.wakeServiceLoop() // Wake service loop to start rollout
+	}
+	return replica, err, status
+}
+
+// DeleteReplica
+// deletes the named replica from all quorum members, disposing of
+// the data as given.
+// Returns the replica, error and http status
+func (k *Ketch) DeleteReplica(name string, data api.DataDisposition) (api.Resource, error, int) {
+	defer k.flushSaves() // Save changes once unlocked
+	k.Lock()
+	defer k.Unlock()
+	replica, err, status := startReplicaDelete(k.resourceMgr[api.TypeReplica], name, data)
+	if err == nil {
+		delete(k.replicaDue, replica.GetCommon().ID)
+		k.wakeServiceLoop() // Wake service loop to start teardown
+	}
+	return replica, err, status
+}
+
+// DeleteResource
+// deletes the named resource.
+// Returns the resource deleted, error and http status
+func (k *Ketch) DeleteResource(myType api.Type, name string) (api.Resource, error, int) {
+	defer k.flushSaves() // Save changes once unlocked
+	k.Lock()
+	defer k.Unlock()
+	return k.resourceMgr[myType].DeleteResource(name)
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+)
+
+// Resources are saved to the Ketch database in batches.  Changes are
+// marshalled under the Ketch lock as they are made and queued in the
+// journal; flushSaves commits the queue in one Bolt transaction outside
+// the Ketch lock, before anything that depends on the changes leaves
+// this server: protocol messages and API responses.  So a slow disk
+// holds up only the senders waiting on it, not the lock that message
+// handlers and lease renewals of every other replica need, and each
+// pass of the service loop syncs the disk once.
+
+// saveJournal queues saves of resources until they are flushed.
+type saveJournal struct {
+	// Guards pending
+	sync.Mutex
+	pending []journalEntry
+
+	// Orders commits, so a later batch is never overwritten by an
+	// earlier one
+	flushLock sync.Mutex
+}
+
+// journalEntry is a resource to put in the database, or to delete if
+// value is nil.
+type journalEntry struct {
+	myType api.Type
+	id     uuid.UUID
+	value  []byte
+}
+
+// add queues a save.
+func (j *saveJournal) add(myType api.Type, id uuid.UUID, value []byte) {
+	j.Lock()
+	defer j.Unlock()
+	j.pending = append(j.pending, journalEntry{myType: myType, id: id, value: value})
+}
+
+// flushSaves commits queued saves, including those queued by other
+// goroutines and being committed meanwhile.
+// Called unlocked.
+func (k *Ketch) flushSaves() {
+
+	j := &k.journal
+	j.flushLock.Lock()
+	defer j.flushLock.Unlock()
+	j.Lock()
+	batch := j.pending
+	j.pending = nil
+	j.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	err := k.db.Update(func(tx *bolt.Tx) error {
+		for _, entry := range batch {
+			// Create Ketch bucket if it doesn't exist
+			bk, err := tx.CreateBucketIfNotExists([]byte(entry.myType))
+			if err != nil {
+				k.log.WithFields(Locate(logrus.Fields{
+					"type": entry.myType,
+					"err":  err,
+				})).Error("Failed to create bucket")
+				return err
+			}
+			if entry.value == nil {
+				err = bk.Delete(entry.id.Bytes())
+				if err != nil {
+					k.log.WithFields(Locate(logrus.Fields{
+						"type": entry.myType,
+						"key":  entry.id,
+						"err":  err,
+					})).Error("Failed to delete resource")
+					return err
+				}
+				continue
+			}
+			err = bk.Put(entry.id.Bytes(), entry.value)
+			if err != nil {
+				k.log.WithFields(Locate(logrus.Fields{
+					"type": entry.myType,
+					"key":  entry.id,
+					"out":  entry.value,
+					"err":  err,
+				})).Error("Failed to put resource")
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"saves": len(batch),
+			"err":   err,
+		})).Fatal("Failed to update resources")
+	}
+}
@@ -1,17 +1,23 @@
 package ketch
 
 import (
+	"os"
+	"os/signal"
 	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
 	"github.com/hashicorp/memberlist"
+	"github.com/satori/go.uuid"
 
 	"github.com/watercraft/ketch/api"
 	"github.com/watercraft/ketch/msg"
 )
 
+// Version is the version of Ketch.
+const Version = "1.0.0"
+
 // Ketch
 // State of Ketch service.
 type Ketch struct {
@@ -24,12 +30,23 @@ type Ketch struct {
 	// User config
 	config *Config
 
-	// Host server boot time
-	bootTime *time.Time
+	// bootID identifies the current boot of the host and bootSource
+	// where the ID came from
+	bootID     string
+	bootSource string
+
+	// pgVersion is the version of the postgres executables
+	pgVersion string
+
+	// advertised is the node info last advertised in node meta
+	advertised *msg.NodeInfo
 
 	// Private database for Ketch config
 	db *bolt.DB
 
+	// journal queues saves to db until flushed outside the lock
+	journal saveJournal
+
 	// Read/write lock to protect Ketch state
 	sync.RWMutex
 
@@ -43,11 +60,70 @@ type Ketch struct {
 	// without blocking memberlist NotifyMsg() call
 	incomingMsgCh chan msg.Msg
 
+	// faultMgr injects faults into protocol messages
+	faultMgr *FaultMgr
+
+	// transport carries protocol messages to other members
+	transport Transport
+
+	// catalogMgr tracks replicas across the cluster
+	catalogMgr *CatalogMgr
+
+	// broadcasts queues catalog updates for gossip
+	broadcasts *memberlist.TransmitLimitedQueue
+
+	// notifyMsg receives user messages from the memberlist delegate
+	notifyMsg func(buf []byte)
+
 	// wakeCh is the channel used to wake the processing loop
 	wakeServiceLoopCh chan bool
 
-	// uptime is the current host uptime in seconds
+	// allReplicasDue is set to process every replica on the next pass
+	// of the service loop; accessed atomically
+	allReplicasDue int32
+
+	// replicaDue is the loop uptime at which each replica is next
+	// processed, by replica ID; replicas not listed are due
+	replicaDue map[uuid.UUID]time.Duration
+
+	// watchdogs fence master databases whose lease is expiring,
+	// by replica ID
+	watchdogs map[uuid.UUID]*leaseWatchdog
+
+	// workers run the database commands of each replica in order,
+	// outside the Ketch lock, by replica ID
+	workers map[uuid.UUID]*replicaWorker
+
+	// uptime is the current host uptime in milliseconds
 	uptime int64
+
+	// rebooted is set when the host rebooted since Ketch last ran
+	rebooted bool
+
+	// upgraded is set when the saved lease times are from an older
+	// state version
+	upgraded bool
+
+	// rebalancing is the last move of a quorum member started by a
+	// replica mastered here
+	rebalancing *rebalanceMove
+
+	// serverHealth tracks departures of servers from the membership,
+	// by runtime ID
+	serverHealth map[uuid.UUID]*serverHealth
+
+	// leaseQuietUptime is the uptime in milliseconds before which
+	// leases are neither proposed nor accepted after a reboot
+	leaseQuietUptime int64
+
+	// sigCh receives stop signals
+	sigCh chan os.Signal
+
+	// shutdownCh is closed to stop the service loops
+	shutdownCh chan struct{}
+
+	// loopWg tracks running service loops
+	loopWg sync.WaitGroup
 }
 
 // Join
@@ -64,3 +140,36 @@ func (k *Ketch) Join(list []string) (int, error) {
 func (k *Ketch) Members() []*memberlist.Node {
 	return k.list.Members()
 }
+
+// Shutdown
+// Stops the Ketch service and its databases without leaving the
+// member list, as if the process had stopped.
+func (k *Ketch) Shutdown() error {
+
+	// Stop taking signals and wait for service loops to exit
+	signal.Stop(k.sigCh)
+	close(k.sigCh)
+	close(k.shutdownCh)
+	k.loopWg.Wait()
+
+	// Stop databases
+	k.Lock()
+	k.stopDatabases()
+	k.Unlock()
+	k.flushSaves()
+
+	// Stop messaging and close the Ketch database
+	err := k.list.Shutdown()
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"err": err,
+		})).Error("Failed to shutdown memberlist")
+	}
+	err = k.transport.Close()
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"err": err,
+		})).Error("Failed to close transport")
+	}
+	return k.db.Close()
+}
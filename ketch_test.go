@@ -0,0 +1,97 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+	"github.com/watercraft/ketch/msg"
+)
+
+// newTestKetch returns Ketch state for exercising the service loop
+// without memberlist, a database or a service loop of its own.  The
+// server list starts with this server alone.
+func newTestKetch(clock *FakeClock) *Ketch {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	k := &Ketch{
+		log: log,
+		config: &Config{
+			Clock:              clock,
+			RetransmitInterval: defaultRetransmitInterval,
+			LeasePeriod:        defaultLeasePeriod,
+			LeaseRenewBefore:   defaultLeaseRenewBefore,
+			LeaseGrace:         defaultLeaseGrace,
+			LeaseFenceBefore:   defaultLeaseFenceBefore,
+			MemberDownAfter:    defaultMemberDownAfter,
+			MemberUpAfter:      defaultMemberUpAfter,
+		},
+		runtime: &api.Runtime{
+			Common: api.Common{
+				Name: "server1",
+				ID:   uuid.NewV4(),
+			},
+		},
+		resourceMgr:       make(map[api.Type]*ResourceMgr),
+		wakeServiceLoopCh: make(chan bool, 1),
+		replicaDue:        make(map[uuid.UUID]time.Duration),
+		watchdogs:         make(map[uuid.UUID]*leaseWatchdog),
+		workers:           make(map[uuid.UUID]*replicaWorker),
+		serverHealth:      make(map[uuid.UUID]*serverHealth),
+		shutdownCh:        make(chan struct{}),
+	}
+	for _, myType := range []api.Type{api.TypeServer, api.TypeReplica, api.TypeEpoch, api.TypeDBMgr} {
+		k.resourceMgr[myType] = &ResourceMgr{
+			k:              k,
+			myType:         myType,
+			resource:       make(map[uuid.UUID]api.Resource),
+			resourceByName: make(map[string]uuid.UUID),
+		}
+	}
+	addTestServer(k, k.runtime.Name, k.runtime.ID)
+	k.GetUptime()
+	return k
+}
+
+// addTestServer adds a server to the server list, as if it joined.
+func addTestServer(k *Ketch, name string, id uuid.UUID) {
+	k.resourceMgr[api.TypeServer].resource[id] = &api.Server{
+		Common: api.Common{
+			Name: name,
+			ID:   id,
+		},
+		ProtocolVersion: msg.ProtocolVersion,
+	}
+}
+
+// advanceTestKetch advances the clock and the uptime of Ketch with it.
+func advanceTestKetch(k *Ketch, clock *FakeClock, d time.Duration) {
+	clock.Advance(d)
+	k.GetUptime()
+}
+
+// waitForWaiters waits for goroutines to wait on the clock, so that
+// advancing it wakes them.
+func waitForWaiters(t *testing.T, clock *FakeClock, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		clock.Lock()
+		waiters := len(clock.waiters)
+		clock.Unlock()
+		if waiters >= count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %d clock waiters, have %d", count, waiters)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+// Package ketchtest runs a cluster of Ketch instances within one process.
+// Nodes communicate over an in-memory network and run a fake database,
+// so protocol behavior can be tested without sockets or postgres.
+package ketchtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/memberlist"
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch"
+	"github.com/watercraft/ketch/api"
+)
+
+const (
+	// Interval to poll for state changes
+	kPollInterval time.Duration = 50 * time.Millisecond
+)
+
+// Options configures a test cluster.
+type Options struct {
+	// Log receives logs from all nodes; discarded if nil.
+	Log *logrus.Logger
+	// Clock is shared by all nodes; the system clock if nil.
+	Clock ketch.Clock
+	// Witnesses is the number of nodes, taken from the end,
+	// that only host witness quorum members.
+	Witnesses int
+	// Labels are the labels of each node, by index; nodes beyond
+	// the list have none.
+	Labels []map[string]string
+	// Timing for all nodes; Ketch defaults apply to zero values.
+	RetransmitInterval time.Duration
+	LeasePeriod        time.Duration
+	LeaseRenewBefore   time.Duration
+	LeaseGrace         time.Duration
+	LeaseFenceBefore   time.Duration
+	MemberDownAfter    time.Duration
+	MemberUpAfter      time.Duration
+	// RebalanceInterval for all nodes; rebalancing is off if zero.
+	RebalanceInterval time.Duration
+}
+
+// Node is a Ketch instance in a test cluster.
+type Node struct {
+	// Name is the member name of the node
+	Name string
+	// DataDir is the persistent data directory of the node
+	DataDir string
+	// Endpoint is the address of the node on the in-memory network
+	Endpoint api.Endpoint
+	// Runner runs the fake databases of the node
+	Runner *FakeRunner
+	// Witness is true if the node only hosts witness quorum members
+	Witness bool
+	// Labels describe the node, such as its zone
+	Labels map[string]string
+	// BootID identifies the simulated boot of the node's host
+	BootID string
+	// Ketch is the running instance, nil when killed
+	Ketch *ketch.Ketch
+}
+
+// Cluster is a set of Ketch nodes in one process.
+type Cluster struct {
+	sync.Mutex
+	// Nodes are the cluster nodes, in order of creation
+	Nodes   []*Node
+	dir     string
+	options Options
+	net     *network
+}
+
+// NewCluster starts a cluster of size nodes and joins them together.
+func NewCluster(size int, options *Options) (*Cluster, error) {
+
+	dir, err := ioutil.TempDir("", "ketchtest")
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{
+		dir: dir,
+		net: newNetwork(),
+	}
+	if options != nil {
+		c.options = *options
+	}
+	if c.options.Log == nil {
+		c.options.Log = logrus.New()
+		c.options.Log.Out = ioutil.Discard
+	}
+
+	for i := 0; i < size; i++ {
+		name := fmt.Sprintf("server%d", i+1)
+		node := &Node{
+			Name:    name,
+			DataDir: filepath.Join(dir, name),
+			Endpoint: api.Endpoint{
+				Addr: net.IPv4(127, 0, 2, byte(i+1)),
+				Port: uint16(api.MemberPort),
+			},
+			Runner:  NewFakeRunner(),
+			Witness: i >= size-c.options.Witnesses,
+			BootID:  uuid.NewV4().String(),
+		}
+		if i < len(c.options.Labels) {
+			node.Labels = c.options.Labels[i]
+		}
+		c.Nodes = append(c.Nodes, node)
+		err = c.start(node)
+		if err != nil {
+			c.Shutdown()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// start creates the Ketch instance for a node and joins running peers.
+func (c *Cluster) start(node *Node) error {
+
+	listConfig := memberlist.DefaultLocalConfig()
+	listConfig.Name = node.Name
+	listConfig.BindAddr = node.Endpoint.Addr.String()
+	listConfig.BindPort = int(node.Endpoint.Port)
+	listConfig.Transport = c.net.newListTransport(node.Endpoint)
+	listConfig.ProbeInterval = 200 * time.Millisecond
+	listConfig.ProbeTimeout = 100 * time.Millisecond
+	listConfig.GossipInterval = 50 * time.Millisecond
+	listConfig.PushPullInterval = time.Second
+	listConfig.LogOutput = ioutil.Discard
+
+	var err error
+	node.Ketch, err = ketch.Create(&ketch.Config{
+		Log:        c.options.Log,
+		ListConfig: listConfig,
+		DataDir:    node.DataDir,
+		Transport:  c.net.newMsgTransport(node.Endpoint),
+		Clock:      c.options.Clock,
+		DBRunner:   node.Runner,
+		Witness:    node.Witness,
+		Labels:     node.Labels,
+
+		BootIdentity: nodeBoot{node},
+
+		RetransmitInterval: c.options.RetransmitInterval,
+		LeasePeriod:        c.options.LeasePeriod,
+		LeaseRenewBefore:   c.options.LeaseRenewBefore,
+		LeaseGrace:         c.options.LeaseGrace,
+		LeaseFenceBefore:   c.options.LeaseFenceBefore,
+		MemberDownAfter:    c.options.MemberDownAfter,
+		MemberUpAfter:      c.options.MemberUpAfter,
+		RebalanceInterval:  c.options.RebalanceInterval,
+	})
+	if err != nil {
+		return err
+	}
+
+	var peers []string
+	for _, peer := range c.Nodes {
+		if peer != node && peer.Ketch != nil {
+			peers = append(peers, peer.Endpoint.String())
+		}
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+	_, err = node.Ketch.Join(peers)
+	return err
+}
+
+// Node returns the node with index i.
+func (c *Cluster) Node(i int) *Node {
+	return c.Nodes[i]
+}
+
+// Kill stops a node and its databases abruptly, as if the host failed.
+// The node is shut down before databases left running are killed, so
+// its service loops have stopped and none of them acts on, or saves, a
+// database exiting after its Ketch database is closed.
+func (c *Cluster) Kill(i int) error {
+	c.Lock()
+	defer c.Unlock()
+	node := c.Nodes[i]
+	if node.Ketch == nil {
+		return fmt.Errorf("Node %s not running", node.Name)
+	}
+	err := node.Ketch.Shutdown()
+	node.Runner.KillAll()
+	node.Ketch = nil
+	return err
+}
+
+// Restart starts a killed node from its data directory.
+func (c *Cluster) Restart(i int) error {
+	c.Lock()
+	defer c.Unlock()
+	node := c.Nodes[i]
+	if node.Ketch != nil {
+		return fmt.Errorf("Node %s already running", node.Name)
+	}
+	return c.start(node)
+}
+
+// Reboot restarts a killed node as if its host rebooted.
+func (c *Cluster) Reboot(i int) error {
+	c.Lock()
+	defer c.Unlock()
+	node := c.Nodes[i]
+	if node.Ketch != nil {
+		return fmt.Errorf("Node %s already running", node.Name)
+	}
+	node.BootID = uuid.NewV4().String()
+	return c.start(node)
+}
+
+// nodeBoot identifies the simulated boot of a node.
+type nodeBoot struct {
+	node *Node
+}
+
+// BootID returns the node's boot ID.
+func (b nodeBoot) BootID() (string, string, error) {
+	return b.node.BootID, "ketchtest", nil
+}
+
+// Partition splits the network so that nodes only reach nodes listed
+// in the same group.  Nodes not listed form a group of their own.
+func (c *Cluster) Partition(groups ...[]int) {
+	var addrs [][]string
+	for _, group := range groups {
+		var list []string
+		for _, i := range group {
+			list = append(list, c.Nodes[i].Endpoint.String())
+		}
+		addrs = append(addrs, list)
+	}
+	c.net.partition(addrs...)
+}
+
+// Heal removes all partitions.
+func (c *Cluster) Heal() {
+	c.net.partition()
+}
+
+// CreateReplica creates a replica on node i.
+func (c *Cluster) CreateReplica(i int, replica *api.Replica) error {
+	k, err := c.running(i)
+	if err != nil {
+		return err
+	}
+	_, err, _ = k.CreateResources(api.TypeReplica, api.ResourceList{replica})
+	return err
+}
+
+// AddFault installs a fault injection rule on node i.
+func (c *Cluster) AddFault(i int, fault *api.Fault) error {
+	k, err := c.running(i)
+	if err != nil {
+		return err
+	}
+	_, err, _ = k.CreateResources(api.TypeFault, api.ResourceList{fault})
+	return err
+}
+
+// RemoveFault removes the named fault injection rule from node i.
+func (c *Cluster) RemoveFault(i int, name string) error {
+	k, err := c.running(i)
+	if err != nil {
+		return err
+	}
+	_, err, _ = k.DeleteResource(api.TypeFault, name)
+	return err
+}
+
+// Switchover moves the master role of the named replica from node i
+// to the named server, or any in-sync member if server is empty.
+func (c *Cluster) Switchover(i int, name string, server string) error {
+	k, err := c.running(i)
+	if err != nil {
+		return err
+	}
+	_, err, _ = k.SwitchoverReplica(name, server)
+	return err
+}
+
+// Drain drains node i for maintenance, or undrains it.
+func (c *Cluster) Drain(i int, drain bool) error {
+	k, err := c.running(i)
+	if err != nil {
+		return err
+	}
+	_, err, _ = k.DrainServer(c.Nodes[i].Name, drain)
+	return err
+}
+
+// UpdateReplica applies patch to the named replica from its master on node i.
+func (c *Cluster) UpdateReplica(i int, name string, patch *api.ReplicaPatch) error {
+	k, err := c.running(i)
+	if err != nil {
+		return err
+	}
+	_, err, _ = k.UpdateReplica(name, patch)
+	return err
+}
+
+// DeleteReplica deletes the named replica from its master on node i.
+func (c *Cluster) DeleteReplica(i int, name string, data api.DataDisposition) error {
+	k, err := c.running(i)
+	if err != nil {
+		return err
+	}
+	_, err, _ = k.DeleteReplica(name, data)
+	return err
+}
+
+// WaitForServers waits for node i to see count servers.
+func (c *Cluster) WaitForServers(i int, count int, timeout time.Duration) error {
+	return c.waitFor(timeout, func() (bool, error) {
+		k, err := c.running(i)
+		if err != nil {
+			return false, err
+		}
+		return len(k.GetResources(api.TypeServer)) == count, nil
+	}, fmt.Sprintf("%d servers on node %d", count, i))
+}
+
+// WaitForDBState waits for the named replica on node i to run its database in state.
+func (c *Cluster) WaitForDBState(i int, name string, state api.DBState, timeout time.Duration) error {
+	return c.waitFor(timeout, func() (bool, error) {
+		k, err := c.running(i)
+		if err != nil {
+			return false, err
+		}
+		for _, resource := range k.GetResources(api.TypeDBMgr) {
+			dbmgr := resource.(*api.DBMgr)
+			if dbmgr.Name == name {
+				return dbmgr.State == api.StateOpen && dbmgr.DBState == state, nil
+			}
+		}
+		return false, nil
+	}, fmt.Sprintf("replica %s in state %s on node %d", name, state, i))
+}
+
+// WaitForDataState waits for the named replica on node i to reach data state.
+func (c *Cluster) WaitForDataState(i int, name string, state api.TypeDataState, timeout time.Duration) error {
+	return c.waitFor(timeout, func() (bool, error) {
+		k, err := c.running(i)
+		if err != nil {
+			return false, err
+		}
+		for _, resource := range k.GetResources(api.TypeReplica) {
+			replica := resource.(*api.Replica)
+			if replica.Name == name {
+				return replica.DataState == state, nil
+			}
+		}
+		return false, nil
+	}, fmt.Sprintf("replica %s data %s on node %d", name, state, i))
+}
+
+// Shutdown kills all running nodes and removes their data.
+func (c *Cluster) Shutdown() {
+	for i, node := range c.Nodes {
+		if node.Ketch != nil {
+			c.Kill(i)
+		}
+	}
+	os.RemoveAll(c.dir)
+}
+
+// running returns the Ketch instance of node i.
+func (c *Cluster) running(i int) (*ketch.Ketch, error) {
+	c.Lock()
+	defer c.Unlock()
+	node := c.Nodes[i]
+	if node.Ketch == nil {
+		return nil, fmt.Errorf("Node %s not running", node.Name)
+	}
+	return node.Ketch, nil
+}
+
+// waitFor polls cond until it returns true or the timeout expires.
+func (c *Cluster) waitFor(timeout time.Duration, cond func() (bool, error), what string) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := cond()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timeout waiting for %s", what)
+		}
+		time.Sleep(kPollInterval)
+	}
+}
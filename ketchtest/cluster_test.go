@@ -0,0 +1,267 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketchtest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+)
+
+// fastOptions shortens lease timing so failover takes seconds.  A
+// failed member is taken as down well within a lease, so a member
+// taking over has to wait out the lease of the failed master.
+var fastOptions = Options{
+	RetransmitInterval: 100 * time.Millisecond,
+	LeasePeriod:        1500 * time.Millisecond,
+	LeaseRenewBefore:   500 * time.Millisecond,
+	LeaseGrace:         200 * time.Millisecond,
+	MemberDownAfter:    200 * time.Millisecond,
+}
+
+// currentEpoch returns the current epoch of a replica on a node.
+func currentEpoch(c *Cluster, i int, name string) (*api.EpochSpec, error) {
+	node := c.Node(i)
+	if node.Ketch == nil {
+		return nil, fmt.Errorf("Node %s not running", node.Name)
+	}
+	for _, resource := range node.Ketch.GetResources(api.TypeReplica) {
+		replica := resource.(*api.Replica)
+		if replica.Name != name {
+			continue
+		}
+		if replica.CurrentEpochID == nil {
+			return nil, fmt.Errorf("Replica %s has no epoch on %s", name, node.Name)
+		}
+		epoch, ok := replica.Epochs[replica.CurrentEpochID.String()]
+		if !ok {
+			return nil, fmt.Errorf("Replica %s is missing its epoch on %s", name, node.Name)
+		}
+		return epoch, nil
+	}
+	return nil, fmt.Errorf("Replica %s not found on %s", name, node.Name)
+}
+
+// nodeID returns the server ID of a running node.
+func nodeID(c *Cluster, i int) uuid.UUID {
+	for _, resource := range c.Node(i).Ketch.GetResources(api.TypeRuntime) {
+		return resource.GetCommon().ID
+	}
+	return uuid.Nil
+}
+
+// replicaDB returns the database manager of the named replica on a
+// running node, or nil if it has none.
+func replicaDB(c *Cluster, i int, name string) *api.DBMgr {
+	for _, resource := range c.Node(i).Ketch.GetResources(api.TypeDBMgr) {
+		dbmgr := resource.(*api.DBMgr)
+		if dbmgr.Name == name {
+			return dbmgr
+		}
+	}
+	return nil
+}
+
+// TestFailover takes a replica through setup, lease and open, fails its
+// master and waits for the other sync member to take over in a new
+// epoch.
+func TestFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping cluster test in short mode")
+	}
+
+	c, err := NewCluster(4, &fastOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	if err := c.WaitForServers(0, 4, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Setup, lease and open on the home server
+	replica := &api.Replica{
+		Common:          api.Common{Name: "mydb1"},
+		QuorumGroupSize: 3,
+		DBConfig: api.DBSpec{
+			Username:   "myuser",
+			Password:   "mypassword",
+			Port:       5432,
+			ClosedPort: 5433,
+		},
+	}
+	if err := c.CreateReplica(0, replica); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitForDBState(0, "mydb1", api.DBStateMaster, 60*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	epoch, err := currentEpoch(c, 0, "mydb1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !epoch.LeaseOwner {
+		t.Fatal("Master does not own the lease")
+	}
+	oldEpochID := epoch.ID
+
+	// Wait for the other sync member to be in sync, so it can take over
+	member := -1
+	for _, mbr := range epoch.Quorum {
+		if mbr.MemberType != api.ReplicaQuorumMemberTypeSync {
+			continue
+		}
+		for i := 1; i < len(c.Nodes); i++ {
+			if uuid.Equal(mbr.ID, nodeID(c, i)) {
+				member = i
+			}
+		}
+	}
+	if member < 0 {
+		t.Fatal("No sync member other than the master")
+	}
+	if err := c.WaitForDataState(member, "mydb1", api.DataStateInSync, 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the master and wait for the member to take over
+	if err := c.Kill(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitForDBState(member, "mydb1", api.DBStateMaster, 60*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	epoch, err = currentEpoch(c, member, "mydb1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid.Equal(epoch.ID, oldEpochID) {
+		t.Fatal("New master is in the epoch of the failed master")
+	}
+	if !epoch.LeaseOwner {
+		t.Fatal("New master does not own the lease")
+	}
+}
+
+// TestRollingUpdate changes the port and password of a replica and
+// checks that slaves restart one at a time while the master serves on
+// the old port, and that the master hands over once they are done.
+func TestRollingUpdate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping cluster test in short mode")
+	}
+
+	c, err := NewCluster(4, &fastOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	if err := c.WaitForServers(0, 4, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	replica := &api.Replica{
+		Common:          api.Common{Name: "mydb1"},
+		QuorumGroupSize: 3,
+		DBConfig: api.DBSpec{
+			Username:   "myuser",
+			Password:   "mypassword",
+			Port:       5432,
+			ClosedPort: 5433,
+		},
+	}
+	if err := c.CreateReplica(0, replica); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitForDBState(0, "mydb1", api.DBStateMaster, 60*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	epoch, err := currentEpoch(c, 0, "mydb1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slaves []int
+	for _, mbr := range epoch.Quorum {
+		for i := 1; i < len(c.Nodes); i++ {
+			if uuid.Equal(mbr.ID, nodeID(c, i)) {
+				slaves = append(slaves, i)
+			}
+		}
+	}
+	for _, i := range slaves {
+		if err := c.WaitForDataState(i, "mydb1", api.DataStateInSync, 30*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	port := uint16(5434)
+	password := "mynewpassword"
+	patch := &api.ReplicaPatch{
+		DBConfig: &api.DBSpecPatch{
+			Port:     &port,
+			Password: &password,
+		},
+	}
+	if err := c.UpdateReplica(0, "mydb1", patch); err != nil {
+		t.Fatal(err)
+	}
+
+	// Slaves restart one at a time while the master serves
+	deadline := time.Now().Add(60 * time.Second)
+	for {
+		master := replicaDB(c, 0, "mydb1")
+		if (master == nil) || (master.State != api.StateOpen) || (master.DBState != api.DBStateMaster) {
+			break
+		}
+		if master.Port != 5432 {
+			t.Fatalf("Master restarted on port %d before handing over", master.Port)
+		}
+		down := 0
+		for _, i := range slaves {
+			if dbmgr := replicaDB(c, i, "mydb1"); (dbmgr == nil) || (dbmgr.State != api.StateOpen) {
+				down++
+			}
+		}
+		if down > 1 {
+			t.Fatalf("%d slaves restarting at once", down)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the master to hand over")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The master hands over only once every slave has restarted
+	for _, i := range slaves {
+		dbmgr := replicaDB(c, i, "mydb1")
+		if (dbmgr == nil) || (dbmgr.Port != port) {
+			t.Fatalf("Master handed over before node %d restarted on port %d", i, port)
+		}
+	}
+
+	// A restarted slave takes over and the old master rejoins
+	if err := c.WaitForDBState(0, "mydb1", api.DBStateSlave, 60*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if dbmgr := replicaDB(c, 0, "mydb1"); dbmgr.Port != port {
+		t.Fatalf("Old master rejoined on port %d, expected %d", dbmgr.Port, port)
+	}
+	err = c.waitFor(30*time.Second, func() (bool, error) {
+		for _, i := range slaves {
+			dbmgr := replicaDB(c, i, "mydb1")
+			if (dbmgr != nil) && (dbmgr.State == api.StateOpen) &&
+				(dbmgr.DBState == api.DBStateMaster) && (dbmgr.Port == port) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}, "a restarted slave to serve as master")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
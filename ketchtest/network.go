@@ -0,0 +1,208 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketchtest
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/watercraft/ketch"
+	"github.com/watercraft/ketch/api"
+)
+
+const (
+	// Depth of packet queue for each member
+	kPacketQueueDepth int = 1024
+)
+
+// network connects memberlist and protocol transports of cluster
+// nodes in memory, dropping traffic between partitioned nodes.
+type network struct {
+	sync.Mutex
+	// list is the memberlist transports by address
+	list map[string]*listTransport
+	// msgs carries Ketch protocol messages
+	msgs *ketch.ChannelNetwork
+	// group is the partition group for each address, if partitioned
+	group map[string]int
+}
+
+func newNetwork() *network {
+	return &network{
+		list:  make(map[string]*listTransport),
+		msgs:  ketch.NewChannelNetwork(),
+		group: make(map[string]int),
+	}
+}
+
+// connected returns true if traffic can flow between two addresses.
+func (n *network) connected(src, dest string) bool {
+	n.Lock()
+	defer n.Unlock()
+	return n.group[src] == n.group[dest]
+}
+
+// partition places each group of addresses in its own partition.
+// Addresses not listed share a partition.
+func (n *network) partition(groups ...[]string) {
+	n.Lock()
+	defer n.Unlock()
+	n.group = make(map[string]int)
+	for i, addrs := range groups {
+		for _, addr := range addrs {
+			n.group[addr] = i + 1
+		}
+	}
+}
+
+// newListTransport returns a memberlist transport at the endpoint.
+func (n *network) newListTransport(endpoint api.Endpoint) *listTransport {
+	n.Lock()
+	defer n.Unlock()
+	t := &listTransport{
+		net:      n,
+		addr:     endpoint.String(),
+		packetCh: make(chan *memberlist.Packet, kPacketQueueDepth),
+		streamCh: make(chan net.Conn),
+	}
+	n.list[t.addr] = t
+	return t
+}
+
+// peer returns the transport at addr if reachable from src.
+func (n *network) peer(src, addr string) (*listTransport, error) {
+	if !n.connected(src, addr) {
+		return nil, fmt.Errorf("No route to %q", addr)
+	}
+	n.Lock()
+	defer n.Unlock()
+	peer, ok := n.list[addr]
+	if !ok {
+		return nil, fmt.Errorf("No route to %q", addr)
+	}
+	return peer, nil
+}
+
+// listTransport is a memberlist transport on the in-memory network.
+type listTransport struct {
+	net      *network
+	addr     string
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+}
+
+// See memberlist.Transport.
+func (t *listTransport) FinalAdvertiseAddr(string, int) (net.IP, int, error) {
+	host, portStr, err := net.SplitHostPort(t.addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return net.ParseIP(host), port, nil
+}
+
+// See memberlist.Transport.
+// Packets to unreachable peers are dropped like UDP.
+func (t *listTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	now := time.Now()
+	peer, err := t.net.peer(t.addr, addr)
+	if err != nil {
+		return now, nil
+	}
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	select {
+	case peer.packetCh <- &memberlist.Packet{
+		Buf:       buf,
+		From:      &listAddr{t.addr},
+		Timestamp: now,
+	}:
+	default:
+	}
+	return now, nil
+}
+
+// See memberlist.Transport.
+func (t *listTransport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+// See memberlist.Transport.
+func (t *listTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	peer, err := t.net.peer(t.addr, addr)
+	if err != nil {
+		return nil, err
+	}
+	p1, p2 := net.Pipe()
+	select {
+	case peer.streamCh <- p1:
+		return p2, nil
+	case <-time.After(timeout):
+		p1.Close()
+		p2.Close()
+		return nil, fmt.Errorf("Timeout connecting to %q", addr)
+	}
+}
+
+// See memberlist.Transport.
+func (t *listTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// See memberlist.Transport.
+func (t *listTransport) Shutdown() error {
+	t.net.Lock()
+	defer t.net.Unlock()
+	if peer, ok := t.net.list[t.addr]; ok && peer == t {
+		delete(t.net.list, t.addr)
+	}
+	return nil
+}
+
+// listAddr is the net.Addr of a memberlist transport.
+type listAddr struct {
+	addr string
+}
+
+// See net.Addr.
+func (a *listAddr) Network() string {
+	return "ketchtest"
+}
+
+// See net.Addr.
+func (a *listAddr) String() string {
+	return a.addr
+}
+
+// msgTransport is a protocol transport that honors partitions.
+type msgTransport struct {
+	*ketch.ChannelTransport
+	net  *network
+	addr string
+}
+
+func (n *network) newMsgTransport(endpoint api.Endpoint) *msgTransport {
+	return &msgTransport{
+		ChannelTransport: n.msgs.NewTransport(endpoint),
+		net:              n,
+		addr:             endpoint.String(),
+	}
+}
+
+// SendTo drops messages to partitioned peers.
+func (t *msgTransport) SendTo(dest api.Endpoint, buf []byte) error {
+	if !t.net.connected(t.addr, dest.String()) {
+		return nil
+	}
+	return t.ChannelTransport.SendTo(dest, buf)
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketchtest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/watercraft/ketch/api"
+)
+
+const (
+	// Mode to create fake database directories and files
+	kDBDirMode  os.FileMode = 0700
+	kDBFileMode os.FileMode = 0600
+
+	// WAL position reported by psql unless set with SetLSN()
+	kDefaultLSN = "0/3000060"
+)
+
+// FakeRunner stands in for the postgres binaries.  Utilities complete
+// immediately and servers run until signaled.  Queries of the WAL
+// position return the same position for master and slaves, so slaves
+// are in-sync once running, unless changed with SetLSN().
+type FakeRunner struct {
+	sync.Mutex
+	procs map[*fakeProcess]bool
+	lsn   string
+}
+
+// NewFakeRunner returns a runner with no processes.
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{
+		procs: make(map[*fakeProcess]bool),
+		lsn:   kDefaultLSN,
+	}
+}
+
+// Start emulates a database command.
+func (r *FakeRunner) Start(command string, args []string, env []string, stdin io.Reader) (api.Process, error) {
+	proc := &fakeProcess{
+		runner: r,
+		done:   make(chan struct{}),
+	}
+	switch command {
+	case "initdb", "pg_basebackup":
+		proc.exit(createDataDir(flagValue(args, "--pgdata")))
+	case "pg_rewind", "alan.sh":
+		proc.exit(nil)
+	case "postgres":
+		r.Lock()
+		r.procs[proc] = true
+		r.Unlock()
+	default:
+		err := fmt.Errorf("Unknown command %s", command)
+		proc.exit(err)
+		return proc, err
+	}
+	return proc, nil
+}
+
+// Output emulates a database query command.  The control file always
+// reports the current WAL position as the last checkpoint.
+func (r *FakeRunner) Output(command string, args []string, env []string) ([]byte, error) {
+	r.Lock()
+	defer r.Unlock()
+	switch command {
+	case "psql":
+		if len(r.procs) == 0 {
+			return nil, fmt.Errorf("Database not running")
+		}
+		return []byte(r.lsn + "\n"), nil
+	case "pg_controldata":
+		return []byte("Latest checkpoint location:           " + r.lsn + "\n"), nil
+	case "postgres":
+		return []byte("postgres (PostgreSQL) 9.6.24\n"), nil
+	}
+	return nil, fmt.Errorf("Unknown command %s", command)
+}
+
+// SetLSN sets the WAL position reported by databases on this runner,
+// e.g. to hold a slave behind its master.
+func (r *FakeRunner) SetLSN(lsn string) {
+	r.Lock()
+	defer r.Unlock()
+	r.lsn = lsn
+}
+
+// Running returns the number of running servers.
+func (r *FakeRunner) Running() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.procs)
+}
+
+// KillAll stops running servers with an error, as if the host failed.
+func (r *FakeRunner) KillAll() {
+	r.Lock()
+	procs := r.procs
+	r.procs = make(map[*fakeProcess]bool)
+	r.Unlock()
+	for proc := range procs {
+		proc.exit(fmt.Errorf("Killed"))
+	}
+}
+
+// flagValue returns the argument following name, if any.
+func flagValue(args []string, name string) string {
+	for i, arg := range args {
+		if arg == name && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// createDataDir creates a database directory with a version file.
+func createDataDir(dir string) error {
+	if dir == "" {
+		return fmt.Errorf("Missing data directory")
+	}
+	err := os.MkdirAll(dir, kDBDirMode)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, "PG_VERSION"), []byte("9.6\n"), kDBFileMode)
+}
+
+// fakeProcess is a process started by FakeRunner.
+type fakeProcess struct {
+	runner *FakeRunner
+	once   sync.Once
+	done   chan struct{}
+	err    error
+}
+
+func (p *fakeProcess) exit(err error) {
+	p.once.Do(func() {
+		p.err = err
+		close(p.done)
+	})
+}
+
+// Signal stops the process.
+func (p *fakeProcess) Signal(sig os.Signal) error {
+	p.runner.Lock()
+	delete(p.runner.procs, p)
+	p.runner.Unlock()
+	p.exit(nil)
+	return nil
+}
+
+// Wait waits for the process to stop.
+func (p *fakeProcess) Wait() error {
+	<-p.done
+	return p.err
+}
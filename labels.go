@@ -0,0 +1,46 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// ParseLabels parses labels given as key=value strings.
+func ParseLabels(list []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range list {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Label %q must be key=value", pair)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, validateLabels(labels)
+}
+
+// validateLabels checks labels can be carried in node meta.  Keys and
+// values are kept free of the separators used to give them on the
+// command line.
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if key == "" {
+			return fmt.Errorf("Label key must be set")
+		}
+		if strings.ContainsAny(key, ",=") {
+			return fmt.Errorf("Label key %q must not contain ',' or '='", key)
+		}
+		if strings.Contains(value, ",") {
+			return fmt.Errorf("Label value %q must not contain ','", value)
+		}
+	}
+	if size := nodeInfoMaxSize(labels); size > memberlist.MetaMaxSize-kNodeMetaInfoOffset {
+		return fmt.Errorf("Labels make node info take %d bytes, more than the limit of %d", size, memberlist.MetaMaxSize-kNodeMetaInfoOffset)
+	}
+	return nil
+}
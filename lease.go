@@ -5,6 +5,8 @@
 package ketch
 
 import (
+	"time"
+
 	"github.com/Sirupsen/logrus"
 	"github.com/satori/go.uuid"
 
@@ -13,7 +15,7 @@ import (
 )
 
 // Returns true when we have the lease.
-func sendLeasePrepareReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID, successorEpochID *uuid.UUID, nextPeriod *uint16, outMsgs *msg.MsgList) bool {
+func sendLeasePrepareReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID, successorEpochID *uuid.UUID, nextPeriod *time.Duration, outMsgs *msg.MsgList) bool {
 
 	// Validate call
 	epoch, ok := replica.Epochs[epochID.String()]
@@ -21,16 +23,19 @@ func sendLeasePrepareReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UU
 		m.k.log.WithFields(Locate(logrus.Fields{
 			"epochID": epochID,
 			"replica": replica,
-		})).Fatal("Send lease prepare requests for unknown epoch")
+		})).Error("Send lease prepare requests for unknown epoch")
+		demoteReplica(m, replica)
+		return false
 	}
 
-	// If not time to renew, set nextPeriod and return
-	// Note, LeaseExpireUptime starts with zero but is signed, so this test still works
-	timeToRenew := epoch.LeaseExpireUptime - int64(leaseRenewBefore)
+	// If not time to renew, set nextPeriod and return.  Renewal goes
+	// by the confirmed lease, so a lost proposal is retried in time.
+	// Note, LeaseConfirmedUptime starts with zero but is signed, so this test still works
+	timeToRenew := epoch.LeaseConfirmedUptime - durationMs(m.k.config.LeaseRenewBefore)
 	if (timeToRenew > 0) && (m.k.uptime <= timeToRenew) {
 		// Successfully renewed lease, set nextPeriod to renew a lease
 		// Add extra to pass test for sending renewal above
-		timeLeft := uint16(timeToRenew-m.k.uptime) + retransmitInterval
+		timeLeft := time.Duration(timeToRenew-m.k.uptime)*time.Millisecond + m.k.config.RetransmitInterval
 		if *nextPeriod > timeLeft {
 			*nextPeriod = timeLeft
 		}
@@ -38,6 +43,11 @@ func sendLeasePrepareReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UU
 		return epoch.LeaseOwner
 	}
 
+	// Hold off after a reboot; see reconcileLeases()
+	if leaseQuiet(m.k, nextPeriod) {
+		return false
+	}
+
 	// Allocate ballot sequence number
 	epoch.BallotSequence++
 	epoch.BallotNumber = api.BallotNumber{
@@ -75,8 +85,8 @@ func sendLeasePrepareReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UU
 	m.k.resourceMgr[api.TypeReplica].saveResource(replica.ID)
 
 	// Update period for next service cycle
-	if *nextPeriod > retransmitInterval {
-		*nextPeriod = retransmitInterval
+	if *nextPeriod > m.k.config.RetransmitInterval {
+		*nextPeriod = m.k.config.RetransmitInterval
 	}
 
 	return false
@@ -84,6 +94,11 @@ func sendLeasePrepareReqs(m *ResourceMgr, replica *api.Replica, epochID *uuid.UU
 
 func (k *Ketch) onLeasePrepareReq(req *msg.MsgLeasePrepareReq, outMsgs *msg.MsgList) {
 
+	// Stay silent after a reboot; see reconcileLeases()
+	if leaseQuiet(k, nil) {
+		return
+	}
+
 	// Prepare response response
 	var resp msg.MsgLeasePrepareResp
 	resp.Common = req.Common
@@ -175,15 +190,47 @@ func (k *Ketch) onLeasePrepareResp(resp *msg.MsgLeasePrepareResp, outMsgs *msg.M
 	}
 
 	// If there is another accepted proposal or epoch is revoked
-	// to a different successor, remove replica.
+	// to a different successor, demote replica.
 	defer mgr.saveResource(resp.ReplicaID)
+	if (resp.ProposalOwnerID != nil) && (*resp.ProposalOwnerID != k.runtime.ID) && !resp.SuccessorMismatch {
+		// A master that failed still owns the proposal it was last
+		// granted until it expires.  Retry until then rather than
+		// demoting, or no member could ever take over from it.
+		if _, ok := k.resourceMgr[api.TypeServer].resource[*resp.ProposalOwnerID]; !ok {
+			k.log.WithFields(Locate(logrus.Fields{
+				"resp":    resp,
+				"replica": replica,
+			})).Info("Lease prepare response with proposal from failed owner")
+			return
+		}
+		// Likewise if the owner handed the replica over to us
+		if (replica.PriorMasterServerID != nil) && (*replica.PriorMasterServerID == *resp.ProposalOwnerID) {
+			k.log.WithFields(Locate(logrus.Fields{
+				"resp":    resp,
+				"replica": replica,
+			})).Info("Lease prepare response with proposal from prior master")
+			return
+		}
+	}
 	if ((resp.ProposalOwnerID != nil) && (*resp.ProposalOwnerID != k.runtime.ID)) ||
 		resp.SuccessorMismatch {
 		k.log.WithFields(Locate(logrus.Fields{
 			"resp":    resp,
 			"replica": replica,
 		})).Error("Lease prepare response with conflicting proposal or successor")
-		delete(mgr.resource, replica.ID)
+		if resp.SuccessorMismatch {
+			// Our epochs lost to another; wait for its master to
+			// recreate or retire the replica
+			replica.CurrentEpochID = nil
+			replica.PriorEpochID = nil
+			replica.Epochs = make(map[string]*api.EpochSpec)
+		} else {
+			// Rejoin as slave of the lease owner
+			ownerID := *resp.ProposalOwnerID
+			replica.MasterServerID = &ownerID
+			replica.DataState = api.DataStateCatchUp
+		}
+		demoteReplica(mgr, replica)
 		return
 	}
 
@@ -226,19 +273,21 @@ func (k *Ketch) onLeasePrepareResp(resp *msg.MsgLeasePrepareResp, outMsgs *msg.M
 			}
 		}
 	}
-	if count <= (replica.QuorumGroupSize / 2) {
+	if count < quorumMajority(uint(len(epoch.Quorum))) {
 		return
 	}
 
-	// If acceptors report lease expired while we believe it is still in force, exit.
-	// TODO: Cleanup this replica without affecting all
-	if (!leaseOwned) && epoch.LeaseOwner && (k.uptime < epoch.LeaseExpireUptime) {
+	// If acceptors report lease expired while we believe it is still
+	// in force, another server may have written; fence the replica.
+	if (!leaseOwned) && epoch.LeaseOwner && (k.uptime < epoch.LeaseConfirmedUptime) {
 		k.log.WithFields(Locate(logrus.Fields{
 			"replica": replica,
 			"resp":    resp,
 			"uptime":  k.uptime,
-			"expire":  epoch.LeaseExpireUptime,
-		})).Fatal("Lease expired unexpectedly")
+			"expire":  epoch.LeaseConfirmedUptime,
+		})).Error("Lease expired unexpectedly")
+		demoteReplica(mgr, replica)
+		return
 	}
 
 	// Send lease propose request
@@ -254,17 +303,22 @@ func (k *Ketch) onLeasePrepareResp(resp *msg.MsgLeasePrepareResp, outMsgs *msg.M
 				EpochID:   epoch.ID,
 			},
 			BallotNumber:    epoch.BallotNumber,
-			ProposedTimeout: leasePeriod,
+			ProposedTimeout: uint32(durationMs(k.config.LeasePeriod)),
 		}
 		k.sendMsg(msg, outMsgs)
 	}
 
 	// Update lease expire time
-	epoch.LeaseExpireUptime = k.uptime + int64(leasePeriod)
+	epoch.LeaseExpireUptime = k.uptime + durationMs(k.config.LeasePeriod)
 }
 
 func (k *Ketch) onLeaseProposeReq(req *msg.MsgLeaseProposeReq, outMsgs *msg.MsgList) {
 
+	// Stay silent after a reboot; see reconcileLeases()
+	if leaseQuiet(k, nil) {
+		return
+	}
+
 	mgr := k.resourceMgr[api.TypeEpoch]
 	epoch, ok := mgr.resource[req.EpochID].(*api.Epoch)
 	if !ok || epoch.ID != req.EpochID {
@@ -283,9 +337,18 @@ func (k *Ketch) onLeaseProposeReq(req *msg.MsgLeaseProposeReq, outMsgs *msg.MsgL
 		return
 	}
 
+	// Refuse a lease period other than ours; see NotifyAlive()
+	if int64(req.ProposedTimeout) != durationMs(k.config.LeasePeriod) {
+		k.log.WithFields(Locate(logrus.Fields{
+			"req":         req,
+			"leasePeriod": k.config.LeasePeriod,
+		})).Error("Lease propose request with incompatible lease period")
+		return
+	}
+
 	// If the req ballot >= highest promised, accept proposal
 	if !req.BallotNumber.LessThan(&epoch.Acceptor.HighestPromised) {
-		epoch.Acceptor.ProposalExpireUptime = k.uptime + int64(req.ProposedTimeout) + int64(leaseGrace)
+		epoch.Acceptor.ProposalExpireUptime = k.uptime + int64(req.ProposedTimeout) + durationMs(k.config.LeaseGrace)
 		epoch.Acceptor.ProposalOwnerID = req.SrcID
 		mgr.saveResource(req.EpochID)
 	}
@@ -360,25 +423,26 @@ func (k *Ketch) onLeaseProposeResp(resp *msg.MsgLeaseProposeResp) {
 			})).Error("Lease propose response with epoch member in unexpected state")
 			continue
 		}
-		if !mbr.Accepted {
-			count++
-			continue
-		}
 		if mbr.ID == resp.SrcID && resp.ProposalOwnerID == k.runtime.ID {
-			// If epoch not open, close replica
-			if (resp.EpochState != api.StateOpen) && (replica.State != api.StateClosed) {
+			// If epoch closed by another server, close replica
+			if (resp.EpochState == api.StateClosed) && (replica.State != api.StateClosed) {
 				replica.PendingState = api.StateClosed
 				k.resourceMgr[api.TypeReplica].saveResource(replica.ID)
 			}
-			// Count response
-			epoch.Quorum[i].Accepted = false
+			// Record response
+			epoch.Quorum[i].Accepted = true
+		}
+		if epoch.Quorum[i].Accepted {
 			count++
 		}
 	}
-	if count <= (replica.QuorumGroupSize / 2) {
+	if count < quorumMajority(uint(len(epoch.Quorum))) {
 		return
 	}
 
-	// We have the lease until expire uptime set in prepare response
+	// We have the lease until expire uptime set in prepare response,
+	// now that a majority accepted it
 	epoch.LeaseOwner = true
+	epoch.LeaseConfirmedUptime = epoch.LeaseExpireUptime
+	k.updateLeaseWatchdog(replica)
 }
@@ -5,59 +5,74 @@
 package ketch
 
 import (
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/satori/go.uuid"
 
 	"github.com/watercraft/ketch/api"
 	"github.com/watercraft/ketch/msg"
 )
 
 const (
-	// All intervals expressed in multiples of one second.
-	// TODO: Consider moving these to Config.
-	retransmitInterval uint16 = 1
-	leaseRenewBefore   uint16 = 3 // Renew this many seconds before lease expires
-	leasePeriod        uint16 = 9
-	leaseGrace         uint16 = 1 // Added to period on acceptor for safty
+	// Default timing; see Config
+	defaultRetransmitInterval time.Duration = time.Second
+	defaultLeaseRenewBefore   time.Duration = 3 * time.Second // Renew this long before lease expires
+	defaultLeasePeriod        time.Duration = 9 * time.Second
+	defaultLeaseGrace         time.Duration = time.Second // Added to period on acceptor for safty
+	defaultLeaseFenceBefore   time.Duration = time.Second // Fence database this long before lease expires
+	defaultMemberDownAfter    time.Duration = 2 * time.Second
+	defaultMemberUpAfter      time.Duration = 5 * time.Second
 )
 
 func (k *Ketch) serviceLoop() {
 
-	nextIteration := time.Now()
+	defer k.loopWg.Done()
+	nextIteration := k.clockUptime()
 	for {
 		// Block until next iteration
 		select {
-		case <-time.After(nextIteration.Sub(time.Now())):
+		case <-k.config.Clock.After(nextIteration - k.clockUptime()):
 		case <-k.wakeServiceLoopCh:
+		case <-k.shutdownCh:
+			return
 		}
 
 		// Assure that processing after this statement doesn't delay next iteration
-		nextIteration = time.Now()
+		nextIteration = k.clockUptime()
 
 		// Do everything
-		nextPeriod, outMsgs := k.process()
+		nextPeriod, outMsgs := k.process(nextIteration)
 
 		k.log.WithFields(Locate(logrus.Fields{
 			"nextPeriod": nextPeriod,
 			"outMsgs":    len(outMsgs),
 		})).Info("Service")
 
+		// Save changes before messages that depend on them go out
+		k.flushSaves()
+
 		// Send messages (second arg returned from process())
 		k.sendMsgs(outMsgs)
 
-		// Next iteration is nextPeriod seconds after we started processing
-		nextIteration = nextIteration.Add(time.Second * time.Duration(nextPeriod))
+		// Advertise changes to this server's node info
+		k.refreshNodeMeta()
+
+		// Next iteration is nextPeriod after we started processing
+		nextIteration += nextPeriod
 	}
 }
 
-func (k *Ketch) process() (uint16, msg.MsgList) {
+// process runs a pass of the service loop started at the given loop
+// uptime.  Returns the time until the next pass and messages to send.
+func (k *Ketch) process(start time.Duration) (time.Duration, msg.MsgList) {
 
 	k.Lock()
 	defer k.Unlock()
 
 	// Initialize return values
-	nextPeriod := leasePeriod
+	nextPeriod := k.config.LeasePeriod
 	var outMsgs msg.MsgList
 
 	// Update server list
@@ -65,119 +80,238 @@ func (k *Ketch) process() (uint16, msg.MsgList) {
 
 	// Review resident replicas
 	k.GetUptime()
+	k.trackServers()
+	k.resetReplicaDue()
 	replicaMgr := k.resourceMgr[api.TypeReplica]
-	for _, resource := range replicaMgr.resource {
-		replica := resource.(*api.Replica)
+	for id, resource := range replicaMgr.resource {
 
-		// If membership changed mark replica for closing
-		if !markReplicaPendingClosed(replicaMgr, replica) {
+		// Leave replicas that are not yet due
+		if k.replicaWaiting(id, start, &nextPeriod) {
 			continue
 		}
+		replicaPeriod := k.config.LeasePeriod
+		k.processReplica(replicaMgr, resource.(*api.Replica), &replicaPeriod, &outMsgs)
+		k.replicaDue[id] = start + replicaPeriod
+		if nextPeriod > replicaPeriod {
+			nextPeriod = replicaPeriod
+		}
+	}
+	for id := range k.replicaDue {
+		if _, ok := replicaMgr.resource[id]; !ok {
+			delete(k.replicaDue, id)
+		}
+	}
 
-		// If replica has a master and it is up, run as slave.
-		// We clear this when the replica is closed.
-		if replica.MasterServerID != nil {
-			// Open replica as slave on closed port (restart database)
-			// TODO: Toggle between open/closed
-			if !runReplicaOnPort(replicaMgr, replica, api.DBStateSlave, replica.DBConfig.Port) {
-				// Database not running yet
-				continue
-			}
-			continue
+	// Report a draining server drained once it is empty
+	k.updateDrainState()
+
+	// Arm lease watchdogs for databases open as master
+	k.updateLeaseWatchdogs()
+
+	// Forget workers of removed replicas once idle
+	k.removeReplicaWorkers()
+
+	// Publish catalog entries of replicas mastered here
+	k.publishCatalog()
+
+	return nextPeriod, outMsgs
+}
+
+// resetReplicaDue makes every replica due if they were all woken since
+// the last pass of the service loop.
+// Called locked.
+func (k *Ketch) resetReplicaDue() {
+	if atomic.SwapInt32(&k.allReplicasDue, 0) != 0 {
+		k.replicaDue = make(map[uuid.UUID]time.Duration)
+	}
+}
+
+// replicaWaiting returns true if a replica is not yet due in the pass
+// of the service loop started at the given loop uptime, lowering
+// nextPeriod to when it is.
+// Called locked.
+func (k *Ketch) replicaWaiting(id uuid.UUID, start time.Duration, nextPeriod *time.Duration) bool {
+	due, ok := k.replicaDue[id]
+	if !ok || (due <= start) {
+		return false
+	}
+	if *nextPeriod > due-start {
+		*nextPeriod = due - start
+	}
+	return true
+}
+
+// processReplica runs the protocol for a resident replica, shortening
+// nextPeriod to when the replica is next due.
+// Called locked.
+func (k *Ketch) processReplica(replicaMgr *ResourceMgr, replica *api.Replica, nextPeriod *time.Duration, outMsgs *msg.MsgList) {
+
+	// Tear down replica if marked for deletion
+	if replica.PendingState == api.StateDelete {
+		deleteReplica(replicaMgr, replica, nextPeriod, outMsgs)
+		return
+	}
+
+	// Demote replica if its lease watchdog fenced the database
+	checkLeaseWatchdog(replicaMgr, replica)
+
+	// Keep a demoted replica fenced until it recovers
+	if replica.Demoted {
+		if !recoverDemotedReplica(replicaMgr, replica, nextPeriod, outMsgs) {
+			return
 		}
+	}
 
-		// If epoch is marked for closing, close and replicate it
-		if (replica.CurrentEpochID != nil) && (replica.PendingState == api.StateClosed) {
-			// Setup epoch on quorum members
-			if !sendEpochSetupReqs(replicaMgr, replica, replica.CurrentEpochID, &nextPeriod, &outMsgs) {
-				// Continue to next replica if epoch isn't open
-				continue
-			}
-			// Take lease
-			if !sendLeasePrepareReqs(replicaMgr, replica, replica.CurrentEpochID, nil, &nextPeriod, &outMsgs) {
-				// Continue if we do not yet have the lease
-				continue
-			}
-			// Close epoch
-			if !sendEpochCloseReqs(replicaMgr, replica, replica.CurrentEpochID, &nextPeriod, &outMsgs) {
-				// Continue to next replica if epoch isn't open
-				continue
-			}
-			// Open replica as master closed (restart database)
-			if !runReplicaOnPort(replicaMgr, replica, api.DBStateMasterClosed, replica.DBConfig.ClosedPort) {
-				// Database not running yet
-				continue
-			}
-			// Close replica
-			replica.State = api.StateClosed
-			replica.PendingState = ""
-			// Move current epoch to prior
-			if replica.PriorEpochID == nil {
-				// Save current epoch as prior
-				replica.PriorEpochID = replica.CurrentEpochID
-			} else {
-				// Discard current epoch
-				delete(replica.Epochs, replica.CurrentEpochID.String())
+	// If membership changed mark replica for closing
+	if !markReplicaPendingClosed(replicaMgr, replica, nextPeriod) {
+		return
+	}
+
+	// If replica has a master and it is up, run as slave.
+	// We clear this when the replica is closed.
+	if replica.MasterServerID != nil {
+		// Open replica as slave on closed port (restart database)
+		// TODO: Toggle between open/closed
+		if !runReplicaOnPort(replicaMgr, replica, api.DBStateSlave, replica.DBConfig.Port) {
+			// Database not running yet; check again soon
+			if *nextPeriod > k.config.RetransmitInterval {
+				*nextPeriod = k.config.RetransmitInterval
 			}
-			replica.CurrentEpochID = nil
-			k.resourceMgr[api.TypeReplica].saveResource(replica.ID)
+			return
 		}
+		return
+	}
 
-		// Create a new epoch if members have failed
-		if !createReplicaEpoch(replicaMgr, replica) {
-			continue
-		}
+	// Hand over master role in a planned switchover
+	if !runReplicaSwitchover(replicaMgr, replica, nextPeriod, outMsgs) {
+		return
+	}
 
+	// If epoch is marked for closing, close and replicate it
+	if (replica.CurrentEpochID != nil) && (replica.PendingState == api.StateClosed) {
 		// Setup epoch on quorum members
-		if !sendEpochSetupReqs(replicaMgr, replica, replica.CurrentEpochID, &nextPeriod, &outMsgs) {
-			// Continue to next replica if epoch isn't open
-			continue
+		if !sendEpochSetupReqs(replicaMgr, replica, replica.CurrentEpochID, nextPeriod, outMsgs) {
+			// Return if epoch isn't open
+			return
 		}
-
-		// Create peer replicas
-		if !sendReplicaCreateReqs(replicaMgr, replica, &nextPeriod, &outMsgs) {
-			// Continue if peer replicas are not yet in-sync
-			continue
+		// Take lease
+		if !sendLeasePrepareReqs(replicaMgr, replica, replica.CurrentEpochID, nil, nextPeriod, outMsgs) {
+			// Return if we do not yet have the lease
+			return
 		}
-
-		// If prior epoch exists, dispose of it
-		if replica.PriorEpochID != nil {
-			// Take lease for prior epoch
-			if !sendLeasePrepareReqs(replicaMgr, replica, replica.PriorEpochID, replica.CurrentEpochID, &nextPeriod, &outMsgs) {
-				// Continue if we do not yet have the lease
-				continue
-			}
-			// Revoke prior epoch
-			if !sendEpochRevokeReqs(replicaMgr, replica, replica.PriorEpochID, replica.CurrentEpochID, &nextPeriod, &outMsgs) {
-				// Continue if prior epoch is not yet revoked
-				continue
-			}
-			// Discard prior epoch
-			delete(replica.Epochs, replica.PriorEpochID.String())
-			replica.PriorEpochID = nil
-			k.resourceMgr[api.TypeReplica].saveResource(replica.ID)
+		// Close epoch
+		if !sendEpochCloseReqs(replicaMgr, replica, replica.CurrentEpochID, nextPeriod, outMsgs) {
+			// Return if epoch isn't open
+			return
 		}
-
-		// Take lease for current epoch; important for new epochs
-		if !sendLeasePrepareReqs(replicaMgr, replica, replica.CurrentEpochID, nil, &nextPeriod, &outMsgs) {
-			// Continue if we do not yet have the lease
-			continue
+		// Open replica as master closed (restart database)
+		if !runReplicaOnPort(replicaMgr, replica, api.DBStateMasterClosed, replica.DBConfig.ClosedPort) {
+			// Database not running yet
+			return
+		}
+		// Close replica.  The database reopens on the configured port
+		// and the new epoch recreates members with the current
+		// settings, which ends any rollout of changed settings.
+		replica.State = api.StateClosed
+		replica.PendingState = ""
+		replica.PriorMasterServerID = nil
+		replica.RestartServerIDs = nil
+		replica.MasterPort = 0
+		// Move current epoch to prior
+		if replica.PriorEpochID == nil {
+			// Save current epoch as prior
+			replica.PriorEpochID = replica.CurrentEpochID
+		} else {
+			// Discard current epoch
+			delete(replica.Epochs, replica.CurrentEpochID.String())
 		}
+		replica.CurrentEpochID = nil
+		k.resourceMgr[api.TypeReplica].saveResource(replica.ID)
+	}
 
-		// TODO: Discover and mark replica epoch members in-sync
+	// Reserve the name of a new replica across the cluster
+	if !reserveReplicaName(replicaMgr, replica, nextPeriod, outMsgs) {
+		return
+	}
 
-		// Open current epoch
-		if !sendEpochOpenReqs(replicaMgr, replica, replica.CurrentEpochID, &nextPeriod, &outMsgs) {
-			// Continue to next replica if epoch isn't open
-			continue
+	// Create a new epoch if members have failed
+	if !createReplicaEpoch(replicaMgr, replica) {
+		return
+	}
+
+	// Setup epoch on quorum members
+	if !sendEpochSetupReqs(replicaMgr, replica, replica.CurrentEpochID, nextPeriod, outMsgs) {
+		// Return if epoch isn't open
+		return
+	}
+
+	// Create peer replicas
+	if !sendReplicaCreateReqs(replicaMgr, replica, nextPeriod, outMsgs) {
+		// Return if peer replicas are not yet in-sync
+		return
+	}
+
+	// If prior epoch exists, dispose of it
+	if replica.PriorEpochID != nil {
+		// Take lease for prior epoch
+		if !sendLeasePrepareReqs(replicaMgr, replica, replica.PriorEpochID, replica.CurrentEpochID, nextPeriod, outMsgs) {
+			// Return if we do not yet have the lease
+			return
+		}
+		// Revoke prior epoch
+		if !sendEpochRevokeReqs(replicaMgr, replica, replica.PriorEpochID, replica.CurrentEpochID, nextPeriod, outMsgs) {
+			// Return if prior epoch is not yet revoked
+			return
 		}
+		// Discard prior epoch, retiring servers dropped from the quorum
+		retireDroppedMembers(replicaMgr, replica, replica.PriorEpochID)
+		delete(replica.Epochs, replica.PriorEpochID.String())
+		replica.PriorEpochID = nil
+		k.resourceMgr[api.TypeReplica].saveResource(replica.ID)
+	}
 
-		// Open replica as master (start database)
-		if !runReplicaOnPort(replicaMgr, replica, api.DBStateMaster, replica.DBConfig.Port) {
-			// Database not running yet
-			continue
+	// Take lease for current epoch; important for new epochs
+	if !sendLeasePrepareReqs(replicaMgr, replica, replica.CurrentEpochID, nil, nextPeriod, outMsgs) {
+		// Recover a restarted database closed meanwhile
+		startRestartedReplicaDB(replicaMgr, replica, nextPeriod)
+		// Return if we do not yet have the lease
+		return
+	}
+
+	// Open current epoch
+	if !sendEpochOpenReqs(replicaMgr, replica, replica.CurrentEpochID, nextPeriod, outMsgs) {
+		// Return if epoch isn't open
+		return
+	}
+
+	// Open replica as master (start database)
+	if !runReplicaOnPort(replicaMgr, replica, api.DBStateMaster, masterPort(replica)) {
+		// Database not running yet; check again soon
+		if *nextPeriod > k.config.RetransmitInterval {
+			*nextPeriod = k.config.RetransmitInterval
 		}
+		return
 	}
 
-	return nextPeriod, outMsgs
+	// Tear down replicas on servers dropped from the quorum
+	sendReplicaRetireReqs(replicaMgr, replica, nextPeriod, outMsgs)
+
+	// Discover and mark replica epoch members in-sync
+	if !sendReplicaSetInSyncReqs(replicaMgr, replica, nextPeriod, outMsgs) {
+		// Return if members are still catching up
+		return
+	}
+
+	// Restart members with changed database settings one at a time
+	if restartReplicaMembers(replicaMgr, replica, nextPeriod) {
+		return
+	}
+
+	// Move the replica off draining servers
+	if drainReplica(replicaMgr, replica, nextPeriod) {
+		return
+	}
+
+	// Move a member off an overloaded server
+	rebalanceReplica(replicaMgr, replica, nextPeriod)
 }
@@ -0,0 +1,74 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// testReplicaWaiting checks if a replica is due in a pass of the
+// service loop started now, returning the time until the next pass.
+func testReplicaWaiting(k *Ketch, id uuid.UUID) (bool, time.Duration) {
+	nextPeriod := k.config.LeasePeriod
+	k.resetReplicaDue()
+	return k.replicaWaiting(id, k.clockUptime(), &nextPeriod), nextPeriod
+}
+
+func TestReplicaDue(t *testing.T) {
+	clock := NewFakeClock(time.Hour)
+	k := newTestKetch(clock)
+	id := uuid.NewV4()
+
+	// A replica not yet processed is due
+	if waiting, _ := testReplicaWaiting(k, id); waiting {
+		t.Fatal("New replica not due")
+	}
+
+	// A processed replica waits for the period it asked for
+	k.replicaDue[id] = k.clockUptime() + 3*time.Second
+	clock.Advance(time.Second)
+	waiting, nextPeriod := testReplicaWaiting(k, id)
+	if !waiting {
+		t.Fatal("Replica due before its period")
+	}
+	if nextPeriod != 2*time.Second {
+		t.Fatalf("Next pass in %v, expected %v when the replica is due", nextPeriod, 2*time.Second)
+	}
+	clock.Advance(2*time.Second - time.Millisecond)
+	if waiting, _ := testReplicaWaiting(k, id); !waiting {
+		t.Fatal("Replica due before its period")
+	}
+	clock.Advance(time.Millisecond)
+	if waiting, _ := testReplicaWaiting(k, id); waiting {
+		t.Fatal("Replica not due after its period")
+	}
+}
+
+func TestReplicaDueOnWake(t *testing.T) {
+	clock := NewFakeClock(time.Hour)
+	k := newTestKetch(clock)
+	id := uuid.NewV4()
+	k.replicaDue[id] = k.clockUptime() + 3*time.Second
+	clock.Advance(time.Second)
+
+	// Waking all replicas makes a waiting replica due on the next
+	// pass, and only that pass
+	k.wakeAllReplicas()
+	select {
+	case <-k.wakeServiceLoopCh:
+	default:
+		t.Fatal("Service loop not woken")
+	}
+	if waiting, _ := testReplicaWaiting(k, id); waiting {
+		t.Fatal("Replica not due after waking all replicas")
+	}
+	k.replicaDue[id] = k.clockUptime() + 3*time.Second
+	if waiting, _ := testReplicaWaiting(k, id); !waiting {
+		t.Fatal("Replica due again on the pass after waking")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package msg
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+)
+
+// DigestVersion is the encoding version of Digest, sent first.
+const DigestVersion byte = 1
+
+// Digest summarizes the replicas on a server.  Servers exchange digests
+// in memberlist push/pull to find where their states diverge.
+type Digest struct {
+	// ServerID is the runtime ID of the server
+	ServerID uuid.UUID
+	// Replicas are the replicas on the server
+	Replicas []ReplicaDigest
+	// Catalog is the replica catalog of the server, including
+	// withdrawn entries, to repair updates lost in gossip
+	Catalog []CatalogDigest
+}
+
+// CatalogDigest is a catalog entry, or only the ID and version of one
+// that was withdrawn.
+type CatalogDigest struct {
+	Entry   api.CatalogEntry
+	Deleted bool
+}
+
+// ReplicaDigest summarizes one replica on a server.
+type ReplicaDigest struct {
+	ID   uuid.UUID
+	Name string
+	// CurrentEpochID is the current epoch, nil if none
+	CurrentEpochID *uuid.UUID
+	// MasterServerID is the master, nil if the server is master
+	MasterServerID *uuid.UUID
+	// EpochIDs are the epochs the replica still holds
+	EpochIDs []uuid.UUID
+	// Busy is set while the replica is changing state: closing,
+	// switching over or being deleted
+	Busy bool
+	// Demoted is set while the replica is fenced on the server
+	Demoted bool
+	// LeaseOwner is set while the server holds an unexpired lease
+	// on the current epoch
+	LeaseOwner bool
+}
+
+// ClaimsMaster returns true if the server runs the replica as master.
+func (r *ReplicaDigest) ClaimsMaster() bool {
+	return (r.MasterServerID == nil) && (r.CurrentEpochID != nil) && !r.Busy && !r.Demoted
+}
+
+// DigestToBytes returns a byte slice that encodes the digest.
+func DigestToBytes(digest *Digest) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(DigestVersion)
+	enc := codec.NewEncoder(buf, &codec.MsgpackHandle{})
+	err := enc.Encode(digest)
+	return buf.Bytes(), err
+}
+
+// DigestFromBytes returns the digest decoded from a byte slice.
+func DigestFromBytes(in []byte) (*Digest, error) {
+	if len(in) == 0 {
+		return nil, fmt.Errorf("Empty digest")
+	}
+	if in[0] != DigestVersion {
+		return nil, fmt.Errorf("Unknown digest version %d", in[0])
+	}
+	var digest Digest
+	dec := codec.NewDecoder(bytes.NewReader(in[1:]), &codec.MsgpackHandle{})
+	return &digest, dec.Decode(&digest)
+}
@@ -5,36 +5,102 @@
 package msg
 
 import (
+	"fmt"
+
 	"github.com/satori/go.uuid"
 
 	"github.com/watercraft/ketch/api"
 )
 
+// ProtocolVersion is the version of the messages exchanged between
+// members.  It is raised when messages change incompatibly.
+const ProtocolVersion uint8 = 2
+
+// NameProtocolVersion is the first protocol version with name
+// reservation messages.
+const NameProtocolVersion uint8 = 2
+
+// MinProtocolVersion is the oldest protocol version spoken, so the
+// oldest version of peers accepted as members.
+const MinProtocolVersion uint8 = 1
+
 // MsgType is an integer ID of a type of message that can be received
 // on network channels from other members.
 type MsgType byte
 
 // The list of available message types.
 const (
-	MsgTypeNoOp                 = iota
-	MsgTypeEpochSetupReq        // 1
-	MsgTypeEpochSetupResp       // 2
-	MsgTypeEpochOpenReq         // 3
-	MsgTypeEpochOpenResp        // 4
-	MsgTypeEpochCloseReq        // 5
-	MsgTypeEpochCloseResp       // 6
-	MsgTypeEpochRevokeReq       // 7
-	MsgTypeEpochRevokeResp      // 8
-	MsgTypeLeasePrepareReq      // 9
-	MsgTypeLeasePrepareResp     // 10
-	MsgTypeLeaseProposeReq      // 11
-	MsgTypeLeaseProposeResp     // 12
-	MsgTypeReplicaCreateReq     // 13
-	MsgTypeReplicaCreateResp    // 14
-	MsgTypeReplicaSetInSyncReq  // 15
-	MsgTypeReplicaSetInSyncResp // 16
+	MsgTypeNoOp                  = iota
+	MsgTypeEpochSetupReq         // 1
+	MsgTypeEpochSetupResp        // 2
+	MsgTypeEpochOpenReq          // 3
+	MsgTypeEpochOpenResp         // 4
+	MsgTypeEpochCloseReq         // 5
+	MsgTypeEpochCloseResp        // 6
+	MsgTypeEpochRevokeReq        // 7
+	MsgTypeEpochRevokeResp       // 8
+	MsgTypeLeasePrepareReq       // 9
+	MsgTypeLeasePrepareResp      // 10
+	MsgTypeLeaseProposeReq       // 11
+	MsgTypeLeaseProposeResp      // 12
+	MsgTypeReplicaCreateReq      // 13
+	MsgTypeReplicaCreateResp     // 14
+	MsgTypeReplicaSetInSyncReq   // 15
+	MsgTypeReplicaSetInSyncResp  // 16
+	MsgTypeReplicaSwitchoverReq  // 17
+	MsgTypeReplicaSwitchoverResp // 18
+	MsgTypeReplicaDeleteReq      // 19
+	MsgTypeReplicaDeleteResp     // 20
+	MsgTypeCatalogUpdate         // 21
+	MsgTypeNameReserveReq        // 22
+	MsgTypeNameReserveResp       // 23
 )
 
+var msgTypeNames = map[MsgType]string{
+	MsgTypeNoOp:                  "NoOp",
+	MsgTypeEpochSetupReq:         "EpochSetupReq",
+	MsgTypeEpochSetupResp:        "EpochSetupResp",
+	MsgTypeEpochOpenReq:          "EpochOpenReq",
+	MsgTypeEpochOpenResp:         "EpochOpenResp",
+	MsgTypeEpochCloseReq:         "EpochCloseReq",
+	MsgTypeEpochCloseResp:        "EpochCloseResp",
+	MsgTypeEpochRevokeReq:        "EpochRevokeReq",
+	MsgTypeEpochRevokeResp:       "EpochRevokeResp",
+	MsgTypeLeasePrepareReq:       "LeasePrepareReq",
+	MsgTypeLeasePrepareResp:      "LeasePrepareResp",
+	MsgTypeLeaseProposeReq:       "LeaseProposeReq",
+	MsgTypeLeaseProposeResp:      "LeaseProposeResp",
+	MsgTypeReplicaCreateReq:      "ReplicaCreateReq",
+	MsgTypeReplicaCreateResp:     "ReplicaCreateResp",
+	MsgTypeReplicaSetInSyncReq:   "ReplicaSetInSyncReq",
+	MsgTypeReplicaSetInSyncResp:  "ReplicaSetInSyncResp",
+	MsgTypeReplicaSwitchoverReq:  "ReplicaSwitchoverReq",
+	MsgTypeReplicaSwitchoverResp: "ReplicaSwitchoverResp",
+	MsgTypeReplicaDeleteReq:      "ReplicaDeleteReq",
+	MsgTypeReplicaDeleteResp:     "ReplicaDeleteResp",
+	MsgTypeCatalogUpdate:         "CatalogUpdate",
+	MsgTypeNameReserveReq:        "NameReserveReq",
+	MsgTypeNameReserveResp:       "NameReserveResp",
+}
+
+// String returns the name of the message type.
+func (t MsgType) String() string {
+	if name, ok := msgTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MsgType(%d)", byte(t))
+}
+
+// ParseMsgType returns the message type with the given name.
+func ParseMsgType(name string) (MsgType, error) {
+	for myType, myName := range msgTypeNames {
+		if myName == name {
+			return myType, nil
+		}
+	}
+	return MsgTypeNoOp, fmt.Errorf("Unknown message type %s", name)
+}
+
 func NewMsgByType(myType MsgType) Msg {
 	switch myType {
 	case MsgTypeEpochSetupReq:
@@ -65,6 +131,24 @@ func NewMsgByType(myType MsgType) Msg {
 		return new(MsgReplicaCreateReq)
 	case MsgTypeReplicaCreateResp:
 		return new(MsgReplicaCreateResp)
+	case MsgTypeReplicaSetInSyncReq:
+		return new(MsgReplicaSetInSyncReq)
+	case MsgTypeReplicaSetInSyncResp:
+		return new(MsgReplicaSetInSyncResp)
+	case MsgTypeReplicaSwitchoverReq:
+		return new(MsgReplicaSwitchoverReq)
+	case MsgTypeReplicaSwitchoverResp:
+		return new(MsgReplicaSwitchoverResp)
+	case MsgTypeReplicaDeleteReq:
+		return new(MsgReplicaDeleteReq)
+	case MsgTypeReplicaDeleteResp:
+		return new(MsgReplicaDeleteResp)
+	case MsgTypeCatalogUpdate:
+		return new(MsgCatalogUpdate)
+	case MsgTypeNameReserveReq:
+		return new(MsgNameReserveReq)
+	case MsgTypeNameReserveResp:
+		return new(MsgNameReserveResp)
 	}
 	return nil
 }
@@ -0,0 +1,58 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package msg
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// NodeInfoVersion is the encoding version of NodeInfo, sent first.
+const NodeInfoVersion byte = 1
+
+// NodeInfo describes a server to other members.  It is carried in
+// memberlist node meta, so it must stay small.
+type NodeInfo struct {
+	// KetchVersion is the version of Ketch the server runs
+	KetchVersion string
+	// ProtocolVersion is the version of messages the server speaks
+	ProtocolVersion uint8
+	// Labels describe the server, such as its zone and rack
+	Labels map[string]string
+	// PGVersion is the version of the postgres executables
+	PGVersion string
+	// FreeDisk is the space available in the data directory, in bytes
+	FreeDisk uint64
+	// Replicas is the number of replicas hosted by the server
+	Replicas uint32
+	// Weight is the relative capacity of the server for placement
+	Weight uint32
+	// Draining is set while the server is drained for maintenance
+	Draining bool
+}
+
+// NodeInfoToBytes returns a byte slice that encodes the node info.
+func NodeInfoToBytes(info *NodeInfo) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(NodeInfoVersion)
+	enc := codec.NewEncoder(buf, &codec.MsgpackHandle{})
+	err := enc.Encode(info)
+	return buf.Bytes(), err
+}
+
+// NodeInfoFromBytes returns the node info decoded from a byte slice.
+func NodeInfoFromBytes(in []byte) (*NodeInfo, error) {
+	if len(in) == 0 {
+		return nil, fmt.Errorf("Empty node info")
+	}
+	if in[0] != NodeInfoVersion {
+		return nil, fmt.Errorf("Unknown node info version %d", in[0])
+	}
+	var info NodeInfo
+	dec := codec.NewDecoder(bytes.NewReader(in[1:]), &codec.MsgpackHandle{})
+	return &info, dec.Decode(&info)
+}
@@ -99,8 +99,9 @@ func (m *MsgLeasePrepareResp) GetCommon() *Common {
 
 type MsgLeaseProposeReq struct {
 	Common
-	BallotNumber    api.BallotNumber
-	ProposedTimeout uint16
+	BallotNumber api.BallotNumber
+	// ProposedTimeout is the lease period in milliseconds
+	ProposedTimeout uint32
 }
 
 func (m *MsgLeaseProposeReq) GetCommon() *Common {
@@ -135,3 +136,103 @@ type MsgReplicaCreateResp struct {
 func (m *MsgReplicaCreateResp) GetCommon() *Common {
 	return &m.Common
 }
+
+type MsgReplicaSetInSyncReq struct {
+	Common
+	MasterLSN uint64
+}
+
+func (m *MsgReplicaSetInSyncReq) GetCommon() *Common {
+	return &m.Common
+}
+
+type MsgReplicaSetInSyncResp struct {
+	Common
+	LSN    uint64
+	InSync bool
+}
+
+func (m *MsgReplicaSetInSyncResp) GetCommon() *Common {
+	return &m.Common
+}
+
+type MsgReplicaSwitchoverReq struct {
+	Common
+	MasterLSN uint64
+}
+
+func (m *MsgReplicaSwitchoverReq) GetCommon() *Common {
+	return &m.Common
+}
+
+type MsgReplicaSwitchoverResp struct {
+	Common
+	LSN      uint64
+	Accepted bool
+}
+
+func (m *MsgReplicaSwitchoverResp) GetCommon() *Common {
+	return &m.Common
+}
+
+type MsgReplicaDeleteReq struct {
+	Common
+	DataDisposition api.DataDisposition
+	// Retire is set when asking a server dropped from the quorum to
+	// give up its copy; EpochID is then the current epoch.
+	Retire bool
+}
+
+func (m *MsgReplicaDeleteReq) GetCommon() *Common {
+	return &m.Common
+}
+
+type MsgReplicaDeleteResp struct {
+	Common
+	Deleted bool
+}
+
+func (m *MsgReplicaDeleteResp) GetCommon() *Common {
+	return &m.Common
+}
+
+// MsgCatalogUpdate is gossiped by the master of a replica to publish
+// its catalog entry, or to withdraw it once the replica is deleted.
+type MsgCatalogUpdate struct {
+	Common
+	Entry   api.CatalogEntry
+	Deleted bool
+}
+
+func (m *MsgCatalogUpdate) GetCommon() *Common {
+	return &m.Common
+}
+
+// MsgNameReserveReq asks a server to grant the name of a new replica,
+// to confirm the grant once a majority granted it, or to release it
+// once the create is aborted.
+type MsgNameReserveReq struct {
+	Common
+	Name    string
+	Confirm bool
+	Release bool
+}
+
+func (m *MsgNameReserveReq) GetCommon() *Common {
+	return &m.Common
+}
+
+// MsgNameReserveResp reports whether the name was granted.  If not,
+// HolderID is the replica holding it and Held is set if that replica
+// reserved the name.
+type MsgNameReserveResp struct {
+	Common
+	Confirm  bool
+	Granted  bool
+	Held     bool
+	HolderID uuid.UUID
+}
+
+func (m *MsgNameReserveResp) GetCommon() *Common {
+	return &m.Common
+}
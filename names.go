@@ -0,0 +1,395 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+	"github.com/watercraft/ketch/msg"
+)
+
+// Replica names are unique across the cluster.  A server refuses to
+// create a replica whose name is in the catalog.  A new replica then
+// reserves its name by vote of the servers before its first epoch.
+// Its master asks every server to grant the name and, once a majority
+// has, to confirm the grant; the name is reserved once a majority has
+// confirmed it.  A server grants a name to one replica at a time and
+// refuses it while another replica holds it in the catalog.  Grants
+// lapse after a lease period unless renewed by retransmits, confirmed
+// grants after the catalog expire time, by when the catalog entry of
+// the replica, no longer marked reserving, holds the name.  As two
+// majorities share a server, two replicas cannot both reserve a name.
+// A master gives way, aborting the create with a conflict, when told
+// the name is reserved or, while it has yet to reach a majority, that
+// a replica with a lower ID holds a grant, so a split vote resolves.
+//
+// A server forgets its grants when it restarts and stays silent for a
+// lease period, as for leases; a confirmed grant it forgets is covered
+// once the catalog is exchanged on rejoin.  Servers of older protocol
+// versions do not vote.  Replicas that share a name all the same, for
+// example across a long network partition, are reported as a
+// divergence on every server.
+
+const (
+	// Retransmit intervals a create waits for names to be reserved
+	kNameReserveWaitPeriods int64 = 5
+	// Interval to poll for the outcome of a reservation
+	kNameReservePoll time.Duration = 50 * time.Millisecond
+)
+
+// nameReservation is the progress of a new replica mastered here in
+// reserving its name; votes are by server ID.
+type nameReservation struct {
+	confirm   bool
+	granted   map[uuid.UUID]bool
+	confirmed map[uuid.UUID]bool
+}
+
+// nameGrant is a name granted by this server to a replica.
+type nameGrant struct {
+	replicaID    uuid.UUID
+	confirmed    bool
+	expireUptime int64
+}
+
+// newReplica returns true if the replica has never had an epoch.
+func newReplica(replica *api.Replica) bool {
+	return (replica.State == api.StateNew) && (replica.CurrentEpochID == nil) && (replica.PriorEpochID == nil)
+}
+
+// nameWins returns true if entry a keeps the name it shares with b.
+func nameWins(a, b *api.CatalogEntry) bool {
+	if a.Reserving != b.Reserving {
+		return !a.Reserving
+	}
+	return bytes.Compare(a.ID.Bytes(), b.ID.Bytes()) < 0
+}
+
+// nameVoters returns the servers that vote on replica names.
+// Called locked.
+func (k *Ketch) nameVoters() []*api.Server {
+	var voters []*api.Server
+	for _, resource := range k.resourceMgr[api.TypeServer].resource {
+		server := resource.(*api.Server)
+		if server.ProtocolVersion >= msg.NameProtocolVersion {
+			voters = append(voters, server)
+		}
+	}
+	return voters
+}
+
+// countNameVotes returns the number of voters among the given votes.
+func countNameVotes(voters []*api.Server, votes map[uuid.UUID]bool) uint {
+	var count uint = 0
+	for _, server := range voters {
+		if votes[server.ID] {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns true when the replica holds its name.
+func reserveReplicaName(m *ResourceMgr, replica *api.Replica, nextPeriod *time.Duration, outMsgs *msg.MsgList) bool {
+
+	if !newReplica(replica) {
+		return true
+	}
+	catalogMgr := m.k.catalogMgr
+	if catalogMgr.reserved[replica.ID] {
+		return true
+	}
+
+	// Give way to a replica that holds the name
+	for _, resource := range catalogMgr.resource {
+		other := resource.(*api.CatalogEntry)
+		if (other.Name == replica.Name) && !uuid.Equal(other.ID, replica.ID) && !other.Reserving {
+			abortReplicaCreate(m, replica, other.ID, outMsgs)
+			return false
+		}
+	}
+
+	// Count votes, moving on to confirm once a majority granted
+	reservation, ok := catalogMgr.reserving[replica.ID]
+	if !ok {
+		reservation = &nameReservation{
+			granted:   make(map[uuid.UUID]bool),
+			confirmed: make(map[uuid.UUID]bool),
+		}
+		catalogMgr.reserving[replica.ID] = reservation
+	}
+	voters := m.k.nameVoters()
+	majority := quorumMajority(uint(len(voters)))
+	if !reservation.confirm && (countNameVotes(voters, reservation.granted) >= majority) {
+		reservation.confirm = true
+	}
+	if reservation.confirm && (countNameVotes(voters, reservation.confirmed) >= majority) {
+		delete(catalogMgr.reserving, replica.ID)
+		catalogMgr.reserved[replica.ID] = true
+		m.k.log.WithFields(Locate(logrus.Fields{
+			"replica": replica.Name,
+		})).Info("Replica name reserved")
+		return true
+	}
+
+	// Ask voters again, renewing grants
+	for _, server := range voters {
+		if reservation.confirm && reservation.confirmed[server.ID] {
+			continue
+		}
+		req := &msg.MsgNameReserveReq{
+			Common: msg.Common{
+				Type:      msg.MsgTypeNameReserveReq,
+				DestID:    server.ID,
+				SrcID:     m.k.runtime.ID,
+				ReplicaID: replica.ID,
+			},
+			Name:    replica.Name,
+			Confirm: reservation.confirm,
+		}
+		m.k.sendMsg(req, outMsgs)
+	}
+	if *nextPeriod > m.k.config.RetransmitInterval {
+		*nextPeriod = m.k.config.RetransmitInterval
+	}
+	return false
+}
+
+// onNameReserveReq grants, confirms or releases a replica name.
+// Called locked.
+func (k *Ketch) onNameReserveReq(req *msg.MsgNameReserveReq, outMsgs *msg.MsgList) {
+
+	// Stay silent after a reboot; grants made before it are forgotten
+	if leaseQuiet(k, nil) {
+		return
+	}
+
+	m := k.catalogMgr
+	grant, ok := m.grants[req.Name]
+	if ok && (k.uptime >= grant.expireUptime) {
+		delete(m.grants, req.Name)
+		ok = false
+	}
+	if req.Release {
+		if ok && uuid.Equal(grant.replicaID, req.ReplicaID) {
+			delete(m.grants, req.Name)
+		}
+		return
+	}
+
+	// Prepare response
+	var resp msg.MsgNameReserveResp
+	resp.Common = req.Common
+	resp.SrcID = req.DestID
+	resp.DestID = req.SrcID
+	resp.Type = msg.MsgTypeNameReserveResp
+	resp.Confirm = req.Confirm
+	defer k.sendMsg(&resp, outMsgs)
+
+	// Refuse a name held in the catalog or granted to another replica
+	for _, resource := range m.resource {
+		entry := resource.(*api.CatalogEntry)
+		if (entry.Name == req.Name) && !uuid.Equal(entry.ID, req.ReplicaID) && !entry.Reserving {
+			resp.Held = true
+			resp.HolderID = entry.ID
+			return
+		}
+	}
+	if ok && !uuid.Equal(grant.replicaID, req.ReplicaID) {
+		resp.Held = grant.confirmed
+		resp.HolderID = grant.replicaID
+		return
+	}
+
+	// Grant the name or renew the grant
+	if !ok {
+		grant = &nameGrant{
+			replicaID: req.ReplicaID,
+		}
+		m.grants[req.Name] = grant
+	}
+	period := k.config.LeasePeriod
+	if req.Confirm || grant.confirmed {
+		grant.confirmed = true
+		period = time.Duration(kCatalogExpirePeriods) * k.config.LeasePeriod
+	}
+	grant.expireUptime = k.uptime + durationMs(period)
+	resp.Granted = true
+}
+
+// onNameReserveResp records a vote on the name of a new replica.
+// Called locked.
+func (k *Ketch) onNameReserveResp(resp *msg.MsgNameReserveResp, outMsgs *msg.MsgList) {
+
+	// Ignore late responses
+	mgr := k.resourceMgr[api.TypeReplica]
+	replica, ok := mgr.resource[resp.ReplicaID].(*api.Replica)
+	if !ok {
+		return
+	}
+	reservation, ok := k.catalogMgr.reserving[replica.ID]
+	if !ok {
+		return
+	}
+
+	if resp.Granted {
+		if resp.Confirm {
+			reservation.confirmed[resp.SrcID] = true
+		} else {
+			reservation.granted[resp.SrcID] = true
+		}
+		return
+	}
+
+	// Give way to a replica that reserved the name or, before a
+	// majority granted it, to one with a lower ID
+	if reservation.confirm {
+		return
+	}
+	delete(reservation.granted, resp.SrcID)
+	if resp.Held || (bytes.Compare(resp.HolderID.Bytes(), replica.ID.Bytes()) < 0) {
+		abortReplicaCreate(mgr, replica, resp.HolderID, outMsgs)
+	}
+}
+
+// abortReplicaCreate removes a new replica that lost its name and
+// releases the grants it has.
+func abortReplicaCreate(m *ResourceMgr, replica *api.Replica, holderID uuid.UUID, outMsgs *msg.MsgList) {
+
+	m.k.log.WithFields(Locate(logrus.Fields{
+		"replica": replica.Name,
+		"id":      replica.ID,
+		"winner":  holderID,
+	})).Error("Replica name in use; create aborted")
+	for _, server := range m.k.nameVoters() {
+		req := &msg.MsgNameReserveReq{
+			Common: msg.Common{
+				Type:      msg.MsgTypeNameReserveReq,
+				DestID:    server.ID,
+				SrcID:     m.k.runtime.ID,
+				ReplicaID: replica.ID,
+			},
+			Name:    replica.Name,
+			Release: true,
+		}
+		m.k.sendMsg(req, outMsgs)
+	}
+	delete(m.k.catalogMgr.reserving, replica.ID)
+	delete(m.k.resourceMgr[api.TypeDBMgr].resource, replica.ID)
+	delete(m.resource, replica.ID)
+	if uuid.Equal(m.resourceByName[replica.Name], replica.ID) {
+		delete(m.resourceByName, replica.Name)
+	}
+	m.saveResource(replica.ID)
+}
+
+// checkReplicaName returns an error if the name of a replica to be
+// created is in the catalog.
+// Called locked.
+func (k *Ketch) checkReplicaName(replica *api.Replica) (error, int) {
+	for _, resource := range k.catalogMgr.resource {
+		entry := resource.(*api.CatalogEntry)
+		if entry.Name == replica.Name {
+			return fmt.Errorf("Replica name %s already in use with master %s", entry.Name, entry.Master), http.StatusConflict
+		}
+	}
+	return nil, http.StatusOK
+}
+
+// awaitReplicaNames waits for new replicas to reserve their names.
+// Returns a conflict if any create was aborted.  Reservations still
+// pending after a few loop periods carry on in the background.
+func (k *Ketch) awaitReplicaNames(list api.ResourceList) (error, int) {
+
+	period := time.Duration(kNameReserveWaitPeriods) * k.config.RetransmitInterval
+	deadline := k.clockUptime() + period
+	for {
+		k.RLock()
+		done := true
+		for _, resource := range list {
+			replica := resource.(*api.Replica)
+			if _, ok := k.resourceMgr[api.TypeReplica].resource[replica.ID]; !ok {
+				k.RUnlock()
+				return fmt.Errorf("Replica name %s already in use", replica.Name), http.StatusConflict
+			}
+			if !k.catalogMgr.reserved[replica.ID] {
+				done = false
+			}
+		}
+		k.RUnlock()
+		if done || (k.clockUptime() >= deadline) {
+			return nil, http.StatusCreated
+		}
+		<-k.config.Clock.After(kNameReservePoll)
+	}
+}
+
+// reportNameConflicts records a divergence for each replica in the
+// catalog that shares its name with one that wins it.  Replicas yet
+// to have an epoch are left to abort.
+// Called locked.
+func (k *Ketch) reportNameConflicts() {
+
+	byName := make(map[string][]*api.CatalogEntry)
+	for _, resource := range k.catalogMgr.resource {
+		entry := resource.(*api.CatalogEntry)
+		byName[entry.Name] = append(byName[entry.Name], entry)
+	}
+	found := make(map[string]*api.Divergence)
+	for _, entries := range byName {
+		for _, entry := range entries {
+			if entry.Reserving {
+				continue
+			}
+			for _, other := range entries {
+				if (other == entry) || !nameWins(other, entry) {
+					continue
+				}
+				divergence := &api.Divergence{
+					Common: api.Common{
+						Name: fmt.Sprintf("%s/%s/%s", api.DivergenceNameConflict, entry.Name, entry.ID),
+					},
+					Kind:      api.DivergenceNameConflict,
+					Replica:   entry.Name,
+					ReplicaID: entry.ID,
+					Peer:      entry.Master,
+					PeerID:    entry.MasterServerID,
+					EpochID:   entry.EpochID,
+				}
+				found[divergence.Name] = divergence
+				break
+			}
+		}
+	}
+
+	// Replace name conflicts reported before, logging new ones
+	divergenceMgr := k.resourceMgr[api.TypeDivergence]
+	for _, resource := range divergenceMgr.GetResources() {
+		divergence := resource.(*api.Divergence)
+		if divergence.Kind != api.DivergenceNameConflict {
+			continue
+		}
+		if _, ok := found[divergence.Name]; ok {
+			delete(found, divergence.Name)
+			continue
+		}
+		divergenceMgr.DeleteResource(divergence.Name)
+	}
+	for _, divergence := range found {
+		k.log.WithFields(Locate(logrus.Fields{
+			"replica": divergence.Replica,
+			"id":      divergence.ReplicaID,
+			"master":  divergence.Peer,
+		})).Error("Replica name conflict")
+		divergenceMgr.CreateResources(api.ResourceList{divergence})
+	}
+}
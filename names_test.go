@@ -0,0 +1,192 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+	"github.com/watercraft/ketch/msg"
+)
+
+// addTestCatalog gives Ketch an empty catalog.
+func addTestCatalog(k *Ketch) {
+	k.catalogMgr = &CatalogMgr{
+		ResourceMgr: ResourceMgr{
+			k:              k,
+			myType:         api.TypeCatalog,
+			resource:       make(map[uuid.UUID]api.Resource),
+			resourceByName: make(map[string]uuid.UUID),
+		},
+		received:        make(map[uuid.UUID]int64),
+		withdrawn:       make(map[uuid.UUID]uint64),
+		published:       make(map[uuid.UUID]*api.CatalogEntry),
+		publishedUptime: make(map[uuid.UUID]int64),
+		reserving:       make(map[uuid.UUID]*nameReservation),
+		reserved:        make(map[uuid.UUID]bool),
+		grants:          make(map[string]*nameGrant),
+	}
+}
+
+// addTestNewReplica adds a replica to be created here.
+func addTestNewReplica(k *Ketch, name string) *api.Replica {
+	replica := &api.Replica{
+		Common: api.Common{
+			Name:  name,
+			ID:    uuid.NewV4(),
+			State: api.StateNew,
+		},
+	}
+	k.resourceMgr[api.TypeReplica].resource[replica.ID] = replica
+	k.resourceMgr[api.TypeReplica].resourceByName[name] = replica.ID
+	return replica
+}
+
+// dispatchTestNameMsg delivers a name reservation message to Ketch.
+func dispatchTestNameMsg(k *Ketch, myMsg msg.Msg, outMsgs *msg.MsgList) {
+	switch myMsg.GetCommon().Type {
+	case msg.MsgTypeNameReserveReq:
+		k.onNameReserveReq(myMsg.(*msg.MsgNameReserveReq), outMsgs)
+	case msg.MsgTypeNameReserveResp:
+		k.onNameReserveResp(myMsg.(*msg.MsgNameReserveResp), outMsgs)
+	}
+}
+
+// TestNameReserveRace creates replicas of the same name on two of
+// three servers at once.  Catalog gossip never arrives, and the
+// reservation messages are delivered in random order, some a round
+// late.  Exactly one create must reserve the name and the other must
+// abort.
+func TestNameReserveRace(t *testing.T) {
+
+	for seed := int64(0); seed < 100; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		clock := NewFakeClock(time.Hour)
+		var servers []*Ketch
+		byID := make(map[uuid.UUID]*Ketch)
+		for i := 0; i < 3; i++ {
+			k := newTestKetch(clock)
+			addTestCatalog(k)
+			servers = append(servers, k)
+			byID[k.runtime.ID] = k
+		}
+		for _, k := range servers {
+			for _, peer := range servers {
+				addTestServer(k, peer.runtime.Name, peer.runtime.ID)
+			}
+		}
+		replicas := []*api.Replica{
+			addTestNewReplica(servers[0], "db"),
+			addTestNewReplica(servers[1], "db"),
+		}
+
+		var delayed msg.MsgList
+		done := false
+		for round := 0; !done; round++ {
+			if round == 50 {
+				t.Fatalf("Seed %d: names not resolved after %d rounds", seed, round)
+			}
+
+			// Run the service loop step of each create still pending
+			inFlight := delayed
+			delayed = nil
+			done = true
+			reserved := 0
+			for i, replica := range replicas {
+				k := servers[i]
+				if _, ok := k.resourceMgr[api.TypeReplica].resource[replica.ID]; !ok {
+					continue
+				}
+				nextPeriod := k.config.RetransmitInterval
+				if reserveReplicaName(k.resourceMgr[api.TypeReplica], replica, &nextPeriod, &inFlight) {
+					reserved++
+				} else {
+					done = false
+				}
+			}
+			if reserved > 1 {
+				t.Fatalf("Seed %d: both creates reserved the name", seed)
+			}
+
+			// Deliver in random order, holding some back a round
+			for len(inFlight) > 0 {
+				i := rnd.Intn(len(inFlight))
+				myMsg := inFlight[i]
+				inFlight = append(inFlight[:i], inFlight[i+1:]...)
+				if rnd.Intn(4) == 0 {
+					delayed = append(delayed, myMsg)
+					continue
+				}
+				dispatchTestNameMsg(byID[myMsg.GetCommon().DestID], myMsg, &inFlight)
+			}
+			clock.Advance(defaultRetransmitInterval)
+			for _, k := range servers {
+				k.GetUptime()
+			}
+		}
+
+		// One create holds the name and the other is gone
+		var kept []*api.Replica
+		for i, replica := range replicas {
+			if _, ok := servers[i].resourceMgr[api.TypeReplica].resource[replica.ID]; ok {
+				if !servers[i].catalogMgr.reserved[replica.ID] {
+					t.Fatalf("Seed %d: create of replica %d neither reserved nor aborted", seed, i)
+				}
+				kept = append(kept, replica)
+			}
+		}
+		if len(kept) != 1 {
+			t.Fatalf("Seed %d: %d creates kept the name; expected 1", seed, len(kept))
+		}
+	}
+}
+
+// TestNameReserveHeld checks that a create gives way to a replica
+// granted the name by a majority, even one with a higher ID.
+func TestNameReserveHeld(t *testing.T) {
+
+	clock := NewFakeClock(time.Hour)
+	k := newTestKetch(clock)
+	addTestCatalog(k)
+	peer := uuid.NewV4()
+	addTestServer(k, "server2", peer)
+	replica := addTestNewReplica(k, "db")
+	var outMsgs msg.MsgList
+	nextPeriod := k.config.RetransmitInterval
+	if reserveReplicaName(k.resourceMgr[api.TypeReplica], replica, &nextPeriod, &outMsgs) {
+		t.Fatalf("Name reserved without votes")
+	}
+	if len(outMsgs) != 2 {
+		t.Fatalf("Sent %d name reserve requests; expected 2", len(outMsgs))
+	}
+	holder := uuid.FromBytesOrNil(append([]byte{0xff}, replica.ID.Bytes()[1:]...))
+	resp := &msg.MsgNameReserveResp{
+		Common: msg.Common{
+			Type:      msg.MsgTypeNameReserveResp,
+			SrcID:     peer,
+			DestID:    k.runtime.ID,
+			ReplicaID: replica.ID,
+		},
+		Held:     true,
+		HolderID: holder,
+	}
+	outMsgs = nil
+	k.onNameReserveResp(resp, &outMsgs)
+	if _, ok := k.resourceMgr[api.TypeReplica].resource[replica.ID]; ok {
+		t.Fatalf("Create not aborted for a name held elsewhere")
+	}
+	for _, myMsg := range outMsgs {
+		if req, ok := myMsg.(*msg.MsgNameReserveReq); !ok || !req.Release {
+			t.Fatalf("Unexpected message on abort: %v", myMsg)
+		}
+	}
+	if len(outMsgs) != 2 {
+		t.Fatalf("Sent %d name releases; expected 2", len(outMsgs))
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"math"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/watercraft/ketch/api"
+	"github.com/watercraft/ketch/msg"
+)
+
+// Servers describe themselves in node meta, following the lease
+// timing: the Ketch and protocol versions, labels, the postgres
+// version, free disk in the data directory, the number of replicas
+// hosted, the weight for placement and whether it is draining.
+// Memberlist only gossips node meta when it changes, so the service
+// loop advertises a new record when the replica count or drain changes
+// or free disk moves by more than 1/kNodeInfoDiskSlack.
+
+const (
+	// Most bytes of a version string in node info
+	kNodeInfoStringMax int = 32
+	// Free disk moves by more than this fraction before it is
+	// advertised again
+	kNodeInfoDiskSlack uint64 = 16
+)
+
+// readPGVersion returns the version of the postgres executables, or
+// an empty string if it cannot be read.
+func (k *Ketch) readPGVersion() string {
+	out, err := k.config.DBRunner.Output("postgres", []string{"--version"}, nil)
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"err": err,
+		})).Warn("Failed to read postgres version")
+		return ""
+	}
+	// Output is of the form "postgres (PostgreSQL) 9.5.4"
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return ""
+	}
+	return truncateString(fields[len(fields)-1], kNodeInfoStringMax)
+}
+
+// nodeInfo returns the current node info of this server.
+// Called locked.
+func (k *Ketch) nodeInfo() *msg.NodeInfo {
+
+	info := &msg.NodeInfo{
+		KetchVersion:    truncateString(Version, kNodeInfoStringMax),
+		ProtocolVersion: msg.ProtocolVersion,
+		Labels:          k.config.Labels,
+		PGVersion:       k.pgVersion,
+		Weight:          uint32(k.config.Weight),
+		Draining:        k.runtime.Drain != "",
+	}
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(k.config.DataDir, &stat)
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"datadir": k.config.DataDir,
+			"err":     err,
+		})).Warn("Failed to read free disk")
+	} else {
+		info.FreeDisk = stat.Bavail * uint64(stat.Bsize)
+	}
+	if replicaMgr, ok := k.resourceMgr[api.TypeReplica]; ok {
+		info.Replicas = uint32(len(replicaMgr.resource))
+	}
+	return info
+}
+
+// refreshNodeMeta advertises the node info of this server if it has
+// changed enough to matter.
+func (k *Ketch) refreshNodeMeta() {
+
+	k.Lock()
+	info := k.nodeInfo()
+	last := k.advertised
+	slack := last.FreeDisk / kNodeInfoDiskSlack
+	changed := (info.Replicas != last.Replicas) || (info.Draining != last.Draining) ||
+		(info.FreeDisk > last.FreeDisk+slack) || (info.FreeDisk+slack < last.FreeDisk)
+	if changed {
+		k.advertised = info
+	}
+	k.Unlock()
+	if !changed {
+		return
+	}
+
+	// Memberlist calls NodeMeta for the new record and waits for it to
+	// be gossiped.  It stays queued for gossip if the wait times out.
+	err := k.list.UpdateNode(k.config.RetransmitInterval)
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"err": err,
+		})).Debug("Node meta update not yet gossiped")
+	}
+}
+
+// nodeMetaInfo returns the node info from node meta, if present.
+func nodeMetaInfo(meta []byte) *msg.NodeInfo {
+	if !nodeMetaSupported(meta) || (len(meta) <= kNodeMetaInfoOffset) {
+		return nil
+	}
+	info, err := msg.NodeInfoFromBytes(meta[kNodeMetaInfoOffset:])
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// nodeInfoMaxSize returns the most bytes node info takes with the
+// given labels.
+func nodeInfoMaxSize(labels map[string]string) int {
+	buf, _ := msg.NodeInfoToBytes(&msg.NodeInfo{
+		KetchVersion:    strings.Repeat("x", kNodeInfoStringMax),
+		ProtocolVersion: math.MaxUint8,
+		Labels:          labels,
+		PGVersion:       strings.Repeat("x", kNodeInfoStringMax),
+		FreeDisk:        math.MaxUint64,
+		Replicas:        math.MaxUint32,
+		Weight:          math.MaxUint32,
+	})
+	return len(buf)
+}
+
+// truncateString returns s cut to at most max bytes.
+func truncateString(s string, max int) string {
+	if len(s) > max {
+		return s[:max]
+	}
+	return s
+}
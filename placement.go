@@ -0,0 +1,168 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"sort"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+)
+
+// placeQuorum chooses the servers for a new epoch of a replica.  Data
+// members are taken in order of preference: this server, the home
+// server if available, members of the prior epoch, then the others
+// from least to most loaded.  Witness members prefer witness servers
+// and then spare data servers.  Servers that would break a spread
+// constraint of the replica are passed over, as are draining servers,
+// servers on probation after being down and a server the replica is
+// moving off.  It works from the server list as last refreshed by the
+// service loop.  Returns false if there are not enough servers.
+// Called locked.
+func placeQuorum(m *ResourceMgr, replica *api.Replica) (data []*api.Server, witnesses []*api.Server, ok bool) {
+
+	serverMgr := m.k.resourceMgr[api.TypeServer]
+	var candidates []uuid.UUID
+	candidates = append(candidates, replica.HomeServerID)
+	if replica.PriorEpochID != nil {
+		if prior, ok := replica.Epochs[replica.PriorEpochID.String()]; ok {
+			for _, mbr := range prior.Quorum {
+				candidates = append(candidates, mbr.ID)
+			}
+		}
+	}
+	var list api.ResourceList
+	for _, resource := range serverMgr.resource {
+		list = append(list, resource)
+	}
+	sort.Sort(list)
+	var others []*api.Server
+	for _, resource := range list {
+		others = append(others, resource.(*api.Server))
+	}
+	sort.SliceStable(others, func(i, j int) bool {
+		return placeBefore(others[i], others[j], m.k.config.MinFreeDisk)
+	})
+	for _, server := range others {
+		candidates = append(candidates, server.ID)
+	}
+	var dataServers, witnessServers []*api.Server
+	dataServers = append(dataServers, &api.Server{
+		Common: api.Common{
+			Name: m.k.runtime.Name,
+			ID:   m.k.runtime.ID,
+		},
+		Labels: m.k.config.Labels,
+	})
+	chosen := map[uuid.UUID]bool{m.k.runtime.ID: true}
+	for _, id := range candidates {
+		resource, ok := serverMgr.resource[id]
+		if !ok || chosen[id] {
+			continue
+		}
+		if (replica.RebalanceServerID != nil) && uuid.Equal(id, *replica.RebalanceServerID) {
+			continue
+		}
+		chosen[id] = true
+		server := resource.(*api.Server)
+		if (server.Drain != "") || m.k.onProbation(id) {
+			continue
+		}
+		if server.Witness {
+			witnessServers = append(witnessServers, server)
+		} else {
+			dataServers = append(dataServers, server)
+		}
+	}
+
+	// This server is first and always fits, being the master
+	spread := newSpreadCount(replica.Spread)
+	dataCount := replica.QuorumGroupSize - replica.WitnessCount
+	var spare []*api.Server
+	for _, server := range dataServers {
+		if (uint(len(data)) < dataCount) && spread.allows(server) {
+			spread.add(server)
+			data = append(data, server)
+		} else {
+			spare = append(spare, server)
+		}
+	}
+	if uint(len(data)) < dataCount {
+		return nil, nil, false
+	}
+	for _, server := range append(witnessServers, spare...) {
+		if uint(len(witnesses)) == replica.WitnessCount {
+			break
+		}
+		if spread.allows(server) {
+			spread.add(server)
+			witnesses = append(witnesses, server)
+		}
+	}
+	if uint(len(witnesses)) < replica.WitnessCount {
+		return nil, nil, false
+	}
+	return data, witnesses, true
+}
+
+// serverLoad returns the replicas hosted by a server per unit of weight.
+func serverLoad(server *api.Server, replicas uint) float64 {
+	weight := server.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	return float64(replicas) / float64(weight)
+}
+
+// placeBefore returns true if server a is preferred to b for new
+// quorum members: servers short of disk come last, then the less
+// loaded come first, then those with more free disk.
+func placeBefore(a, b *api.Server, minFreeDisk uint64) bool {
+	if lowA, lowB := a.FreeDisk < minFreeDisk, b.FreeDisk < minFreeDisk; lowA != lowB {
+		return lowB
+	}
+	loadA, loadB := serverLoad(a, a.ReplicaCount), serverLoad(b, b.ReplicaCount)
+	if loadA != loadB {
+		return loadA < loadB
+	}
+	return a.FreeDisk > b.FreeDisk
+}
+
+// spreadCount counts the members placed on each value of the labels
+// in the spread constraints of a replica.
+type spreadCount struct {
+	constraints []api.SpreadConstraint
+	counts      []map[string]uint
+}
+
+func newSpreadCount(constraints []api.SpreadConstraint) *spreadCount {
+	s := &spreadCount{constraints: constraints}
+	for range constraints {
+		s.counts = append(s.counts, make(map[string]uint))
+	}
+	return s
+}
+
+// allows returns true if a member can be placed on the server.
+func (s *spreadCount) allows(server *api.Server) bool {
+	for i, constraint := range s.constraints {
+		max := constraint.MaxPerValue
+		if max == 0 {
+			max = 1
+		}
+		if s.counts[i][server.Labels[constraint.Label]] >= max {
+			return false
+		}
+	}
+	return true
+}
+
+// add counts a member placed on the server.
+func (s *spreadCount) add(server *api.Server) {
+	for i, constraint := range s.constraints {
+		s.counts[i][server.Labels[constraint.Label]]++
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+)
+
+// Masters move data members of their replicas off overloaded servers,
+// starting at most one move every RebalanceInterval.  A member is moved
+// when the server that would take its place carries less load after the
+// move than the member's server does before it, so moves never undo
+// each other.  Load is the replica count a server advertises over its
+// weight.  The move is rolled out like a patch: the master closes the
+// epoch, places the next one without the overloaded server and retires
+// the member there once the new epoch is open.  Only replicas whose
+// members are all in-sync are rebalanced.  Replica counts reach the
+// master by gossip, so it starts no other move until the counts both
+// servers advertise reflect the last one, or kRebalanceSettlePeriods
+// lease periods pass.
+
+const (
+	// Lease periods to wait for a move to show in replica counts
+	kRebalanceSettlePeriods int64 = 10
+)
+
+// rebalanceMove is a move started here, with the replica counts the
+// servers advertised when it started.
+type rebalanceMove struct {
+	fromID    uuid.UUID
+	toID      uuid.UUID
+	fromCount uint
+	toCount   uint
+	uptime    int64
+}
+
+// rebalanceReplica starts moving a data member of a replica mastered
+// here off an overloaded server.  Returns true if a move was started.
+func rebalanceReplica(m *ResourceMgr, replica *api.Replica, nextPeriod *time.Duration) bool {
+
+	k := m.k
+	if k.config.RebalanceInterval == 0 {
+		return false
+	}
+	if !k.rebalanceSettled() {
+		return false
+	}
+	if (k.rebalancing != nil) && (k.uptime < k.rebalancing.uptime+durationMs(k.config.RebalanceInterval)) {
+		return false
+	}
+	if (replica.PendingState != "") || (replica.SwitchoverServerID != nil) ||
+		(replica.PriorEpochID != nil) || (len(replica.RetiringServerIDs) != 0) {
+		return false
+	}
+	epoch, ok := replica.Epochs[replica.CurrentEpochID.String()]
+	if !ok {
+		return false
+	}
+
+	// Find the most loaded server with a data member, other than this one
+	serverMgr := k.resourceMgr[api.TypeServer]
+	var from *api.Server
+	for _, mbr := range epoch.Quorum {
+		if (mbr.MemberType == api.ReplicaQuorumMemberTypeWitness) || (mbr.ID == k.runtime.ID) {
+			continue
+		}
+		resource, ok := serverMgr.resource[mbr.ID]
+		if !ok {
+			continue
+		}
+		server := resource.(*api.Server)
+		if (from == nil) || (serverLoad(server, server.ReplicaCount) > serverLoad(from, from.ReplicaCount)) {
+			from = server
+		}
+	}
+	if from == nil {
+		return false
+	}
+
+	// Place the next epoch without it and find the server taking its place
+	trial := *replica
+	trial.PriorEpochID = replica.CurrentEpochID
+	trial.CurrentEpochID = nil
+	trial.RebalanceServerID = &from.ID
+	data, _, ok := placeQuorum(m, &trial)
+	if !ok {
+		return false
+	}
+	var to *api.Server
+	for _, server := range data {
+		if !epochHasMember(epoch, server.ID) {
+			to = server
+		}
+	}
+	if (to == nil) || (to.FreeDisk < k.config.MinFreeDisk) ||
+		(serverLoad(to, to.ReplicaCount+1) >= serverLoad(from, from.ReplicaCount)) {
+		return false
+	}
+
+	k.log.WithFields(Locate(logrus.Fields{
+		"replica": replica.Name,
+		"from":    from.Name,
+		"to":      to.Name,
+	})).Info("Replica rebalance started")
+	k.rebalancing = &rebalanceMove{
+		fromID:    from.ID,
+		toID:      to.ID,
+		fromCount: from.ReplicaCount,
+		toCount:   to.ReplicaCount,
+		uptime:    k.uptime,
+	}
+	id := from.ID
+	replica.RebalanceServerID = &id
+	replica.PendingState = api.StateClosed
+	m.saveResource(replica.ID)
+	if *nextPeriod > k.config.RetransmitInterval {
+		*nextPeriod = k.config.RetransmitInterval
+	}
+	return true
+}
+
+// rebalanceSettled returns true once the last move started here shows
+// in the replica counts servers advertise, or is given up on.
+// Called locked.
+func (k *Ketch) rebalanceSettled() bool {
+
+	move := k.rebalancing
+	if (move == nil) || (k.uptime >= move.uptime+kRebalanceSettlePeriods*durationMs(k.config.LeasePeriod)) {
+		return true
+	}
+	serverMgr := k.resourceMgr[api.TypeServer]
+	if resource, ok := serverMgr.resource[move.fromID]; ok && (resource.(*api.Server).ReplicaCount >= move.fromCount) {
+		return false
+	}
+	if resource, ok := serverMgr.resource[move.toID]; ok && (resource.(*api.Server).ReplicaCount <= move.toCount) {
+		return false
+	}
+	return true
+}
@@ -7,6 +7,9 @@ package ketch
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/satori/go.uuid"
@@ -16,9 +19,16 @@ import (
 )
 
 const (
-	maxQuorumGroupSize uint = 3
+	defaultQuorumGroupSize uint = 3
+	maxQuorumGroupSize     uint = 7
 )
 
+// quorumMajority returns the number of members that form a majority
+// of a quorum group of the given size.
+func quorumMajority(size uint) uint {
+	return size/2 + 1
+}
+
 type ReplicaMgr struct {
 	ResourceMgr
 }
@@ -38,11 +48,50 @@ func (k *Ketch) installReplicaMgr() {
 func (m *ReplicaMgr) InitResource(in api.Resource) (error, int) {
 
 	replica := in.(*api.Replica)
+	if m.k.config.Witness {
+		err := fmt.Errorf("Witness server cannot host replicas")
+		m.k.log.WithFields(Locate(logrus.Fields{
+			"err":     err,
+			"replica": replica,
+		})).Error(err.Error())
+		return err, http.StatusBadRequest
+	}
+	if m.k.runtime.Drain != "" {
+		err := fmt.Errorf("Server is drained for maintenance")
+		m.k.log.WithFields(Locate(logrus.Fields{
+			"err":     err,
+			"replica": replica,
+		})).Error(err.Error())
+		return err, http.StatusConflict
+	}
+	if err, status := m.k.checkReplicaName(replica); err != nil {
+		m.k.log.WithFields(Locate(logrus.Fields{
+			"err":     err,
+			"replica": replica,
+		})).Error(err.Error())
+		return err, status
+	}
 	if replica.QuorumGroupSize == 0 {
-		replica.QuorumGroupSize = maxQuorumGroupSize
+		replica.QuorumGroupSize = defaultQuorumGroupSize
 	}
-	if replica.QuorumGroupSize > maxQuorumGroupSize {
-		err := fmt.Errorf("Quorum group size must be less than or equal to %d", maxQuorumGroupSize)
+	if replica.SyncMemberCount == 0 {
+		replica.SyncMemberCount = quorumMajority(replica.QuorumGroupSize)
+	}
+	if err := validateReplicaQuorum(replica); err != nil {
+		m.k.log.WithFields(Locate(logrus.Fields{
+			"err":     err,
+			"replica": replica,
+		})).Error(err.Error())
+		return err, http.StatusBadRequest
+	}
+	if err := validateReplicaSpread(replica); err != nil {
+		m.k.log.WithFields(Locate(logrus.Fields{
+			"err":     err,
+			"replica": replica,
+		})).Error(err.Error())
+		return err, http.StatusBadRequest
+	}
+	if err := validateReplicaPGVersion(m.k, replica); err != nil {
 		m.k.log.WithFields(Locate(logrus.Fields{
 			"err":     err,
 			"replica": replica,
@@ -59,16 +108,73 @@ func (m *ReplicaMgr) InitResource(in api.Resource) (error, int) {
 	return nil, http.StatusOK
 }
 
+// validateReplicaQuorum checks the quorum group settings of a replica.
+func validateReplicaQuorum(replica *api.Replica) error {
+
+	if replica.QuorumGroupSize > maxQuorumGroupSize {
+		return fmt.Errorf("Quorum group size must be less than or equal to %d", maxQuorumGroupSize)
+	}
+	if replica.QuorumGroupSize%2 == 0 {
+		return fmt.Errorf("Quorum group size must be odd")
+	}
+
+	// Sync members must be a majority so that every majority
+	// of the quorum group includes an in-sync copy
+	majority := quorumMajority(replica.QuorumGroupSize)
+	if replica.SyncMemberCount < majority || replica.SyncMemberCount > replica.QuorumGroupSize {
+		return fmt.Errorf("Sync member count must be between %d and %d", majority, replica.QuorumGroupSize)
+	}
+	if replica.SyncMemberCount+replica.WitnessCount > replica.QuorumGroupSize {
+		return fmt.Errorf("Witness count must be less than or equal to %d", replica.QuorumGroupSize-replica.SyncMemberCount)
+	}
+	return nil
+}
+
+// validateReplicaPGVersion checks that the postgres of this server
+// supports the sync members of a replica.  Before 9.6 postgres has a
+// single synchronous standby, so the master and one other member.
+func validateReplicaPGVersion(k *Ketch, replica *api.Replica) error {
+
+	if (replica.SyncMemberCount > 2) && (k.pgVersion != "") && !pgVersionAtLeast(k.pgVersion, 9, 6) {
+		return fmt.Errorf("Postgres %s supports one synchronous standby; sync member count must be at most 2", k.pgVersion)
+	}
+	return nil
+}
+
+// validateReplicaSpread checks the spread constraints of a replica.
+func validateReplicaSpread(replica *api.Replica) error {
+	seen := make(map[string]bool)
+	for _, constraint := range replica.Spread {
+		if constraint.Label == "" {
+			return fmt.Errorf("Spread constraint label must be set")
+		}
+		if seen[constraint.Label] {
+			return fmt.Errorf("Spread constraint label %s given more than once", constraint.Label)
+		}
+		seen[constraint.Label] = true
+	}
+	return nil
+}
+
 func (m *ReplicaMgr) GetList() api.ResourceList {
 	return nil
 }
 
 func (m *ReplicaMgr) UpdateAfterLoad(resource api.Resource) bool {
+
+	// Replicas saved before sync member count was configurable
+	replica := resource.(*api.Replica)
+	if replica.SyncMemberCount == 0 {
+		replica.SyncMemberCount = quorumMajority(replica.QuorumGroupSize)
+		return true
+	}
 	return false
 }
 
-// Returns true if the replica's membership has not changed
-func markReplicaPendingClosed(m *ResourceMgr, replica *api.Replica) bool {
+// Returns true if the replica's membership has not changed.  A member
+// missing from the membership counts as changed once it is taken as
+// down.
+func markReplicaPendingClosed(m *ResourceMgr, replica *api.Replica, nextPeriod *time.Duration) bool {
 
 	// If we don't have an epoch, return
 	if replica.CurrentEpochID == nil {
@@ -78,8 +184,7 @@ func markReplicaPendingClosed(m *ResourceMgr, replica *api.Replica) bool {
 	// Review current membership and return true if all are up
 	mbrDown := false
 	for _, mbr := range replica.Epochs[replica.CurrentEpochID.String()].Quorum {
-		_, ok := m.k.resourceMgr[api.TypeServer].resource[mbr.ID]
-		if !ok {
+		if m.k.memberDown(mbr.ID, nextPeriod) {
 			mbrDown = true
 			m.k.log.WithFields(Locate(logrus.Fields{
 				"replica": replica,
@@ -93,6 +198,15 @@ func markReplicaPendingClosed(m *ResourceMgr, replica *api.Replica) bool {
 		return true
 	}
 
+	// Only sync members that the master found in-sync hold a complete
+	// copy of the data, so other slaves wait for a new master to
+	// recreate them.
+	if (replica.MasterServerID != nil) &&
+		((replica.MemberType != api.ReplicaQuorumMemberTypeSync) ||
+			(replica.DataState != api.DataStateInSync)) {
+		return false
+	}
+
 	// Mark replica for closing
 	replica.PendingState = api.StateClosed
 	replica.MasterServerID = nil
@@ -103,18 +217,14 @@ func markReplicaPendingClosed(m *ResourceMgr, replica *api.Replica) bool {
 // Returns true if the epoch is created
 func createReplicaEpoch(m *ResourceMgr, replica *api.Replica) bool {
 
-	// TODO: This assigns exactly 2 data member types; will need more for 5/7 group size
-
 	// Already have epoch, return
 	if replica.CurrentEpochID != nil {
 		return true
 	}
 
 	// Only poplulate epoch if we have enough servers
-	serverMgr := m.k.resourceMgr[api.TypeServer]
-	list := serverMgr.GetResources()
-	needed := replica.QuorumGroupSize
-	if uint(len(list)) < needed {
+	data, witnesses, ok := placeQuorum(m, replica)
+	if !ok {
 		return false
 	}
 
@@ -128,86 +238,131 @@ func createReplicaEpoch(m *ResourceMgr, replica *api.Replica) bool {
 		LeaseExpireUptime: 0,
 	}
 
-	// Install epoch and save replica
-	replica.CurrentEpochID = &epoch.ID
-	replica.Epochs[epoch.ID.String()] = epoch
-	defer m.saveResource(replica.ID)
-
-	// Add this server
-	dataType := api.ReplicaQuorumMemberTypeSync
-	mbr := api.QuorumMember{
-		Common: api.Common{
-			Name:  m.k.runtime.Name,
-			ID:    m.k.runtime.ID,
-			State: api.StateUninitialized,
-		},
-		MemberType: dataType,
-		DataState:  api.DataStateInSync,
-	}
-	epoch.Quorum = append(epoch.Quorum, mbr)
-	if needed--; needed == 0 {
-		return true
-	}
-
-	// Add home server if available
-	resource, ok := serverMgr.resource[replica.HomeServerID]
-	if ok && (replica.HomeServerID != m.k.runtime.ID) {
-		server := resource.(*api.Server)
-		mbr = api.QuorumMember{
+	// The first SyncMemberCount data members are sync and the rest async.
+	// This server is the master and already in-sync; the others have yet
+	// to create the replica.
+	for i, server := range data {
+		mbr := api.QuorumMember{
 			Common: api.Common{
 				Name:  server.Name,
 				ID:    server.ID,
 				State: api.StateUninitialized,
 			},
-			MemberType: dataType,
-			DataState:  api.DataStateCatchUp,
+			MemberType: api.ReplicaQuorumMemberTypeSync,
+			DataState:  api.DataStateUninitialized,
 		}
-		epoch.Quorum = append(epoch.Quorum, mbr)
-		if needed--; needed == 0 {
-			return true
+		if uint(i) >= replica.SyncMemberCount {
+			mbr.MemberType = api.ReplicaQuorumMemberTypeAsync
 		}
-		dataType = api.ReplicaQuorumMemberTypeAsync
-	}
-
-	// Add other servers
-	for _, resource := range list {
-		server := resource.(*api.Server)
-		if server.ID == m.k.runtime.ID || server.ID == replica.HomeServerID {
-			continue
+		if server.ID == m.k.runtime.ID {
+			mbr.DataState = api.DataStateInSync
 		}
-		mbr = api.QuorumMember{
+		epoch.Quorum = append(epoch.Quorum, mbr)
+	}
+	for _, server := range witnesses {
+		epoch.Quorum = append(epoch.Quorum, api.QuorumMember{
 			Common: api.Common{
 				Name:  server.Name,
 				ID:    server.ID,
 				State: api.StateUninitialized,
 			},
-			MemberType: dataType,
-			DataState:  api.DataStateCatchUp,
+			MemberType: api.ReplicaQuorumMemberTypeWitness,
+		})
+	}
+
+	// Servers back in the quorum are no longer retiring
+	var retiring []uuid.UUID
+	for _, id := range replica.RetiringServerIDs {
+		if !epochHasMember(epoch, id) {
+			retiring = append(retiring, id)
 		}
-		epoch.Quorum = append(epoch.Quorum, mbr)
-		if needed--; needed == 0 {
+	}
+	replica.RetiringServerIDs = retiring
+
+	// Install epoch and save replica
+	replica.RebalanceServerID = nil
+	replica.CurrentEpochID = &epoch.ID
+	replica.Epochs[epoch.ID.String()] = epoch
+	m.saveResource(replica.ID)
+	return true
+}
+
+// epochHasMember returns true if the server is a quorum member of the epoch.
+func epochHasMember(epoch *api.EpochSpec, id uuid.UUID) bool {
+	for _, mbr := range epoch.Quorum {
+		if mbr.ID == id {
 			return true
 		}
-		dataType = api.ReplicaQuorumMemberTypeAsync
 	}
-
-	m.k.log.WithFields(Locate(logrus.Fields{
-		"replica": replica,
-		"servers": list,
-	})).Fatal("Ran out of servers to create epoch")
 	return false
 }
 
-// Returns true if all sync members are in-sync.
-func sendReplicaCreateReqs(m *ResourceMgr, replica *api.Replica, nextPeriod *uint16, outMsgs *msg.MsgList) bool {
+// syncStandbyNames returns the postgres synchronous_standby_names
+// setting for the sync members of the current epoch, other than this server.
+// Standbys connect with their server ID as the application name.
+// Postgres before 9.6 supports a single synchronous standby, taking the
+// first connected standby in the list.
+func syncStandbyNames(m *ResourceMgr, replica *api.Replica, pgVersion string) string {
+
+	if replica.CurrentEpochID == nil {
+		return "''"
+	}
+	epoch, ok := replica.Epochs[replica.CurrentEpochID.String()]
+	if !ok {
+		return "''"
+	}
+	var names []string
+	for _, mbr := range epoch.Quorum {
+		if mbr.ID == m.k.runtime.ID || mbr.MemberType != api.ReplicaQuorumMemberTypeSync {
+			continue
+		}
+		names = append(names, fmt.Sprintf("\"%s\"", mbr.ID))
+	}
+	if len(names) == 0 {
+		return "''"
+	}
+	if !pgVersionAtLeast(pgVersion, 9, 6) {
+		if len(names) > 1 {
+			m.k.log.WithFields(Locate(logrus.Fields{
+				"replica":         replica.Name,
+				"pgVersion":       pgVersion,
+				"syncMemberCount": replica.SyncMemberCount,
+			})).Error("Postgres before 9.6 keeps only one standby in sync")
+		}
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%d (%s)", len(names), strings.Join(names, ", "))
+}
+
+// pgVersionAtLeast returns true if the postgres version from a
+// PG_VERSION file or postgres --version (e.g. "9.5", "9.5.4" or "10") is
+// at least major.minor.
+func pgVersionAtLeast(version string, major int, minor int) bool {
+	var vMinor int
+	fields := strings.Split(strings.TrimSpace(version), ".")
+	vMajor, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return false
+	}
+	if len(fields) > 1 {
+		vMinor, _ = strconv.Atoi(fields[1])
+	}
+	if vMajor != major {
+		return vMajor > major
+	}
+	return vMinor >= minor
+}
+
+// Returns true if all data members have created the replica.
+func sendReplicaCreateReqs(m *ResourceMgr, replica *api.Replica, nextPeriod *time.Duration, outMsgs *msg.MsgList) bool {
 
 	reqSent := false
 	for _, mbr := range replica.Epochs[replica.CurrentEpochID.String()].Quorum {
 
-		// If member is myself, witness or data already in-sync, continue
+		// If member is myself, witness or already has the replica, continue
 		if (mbr.ID == m.k.runtime.ID) ||
 			(mbr.MemberType == api.ReplicaQuorumMemberTypeWitness) ||
-			(mbr.DataState == api.DataStateInSync) {
+			(mbr.DataState != api.DataStateUninitialized) {
 			continue
 		}
 
@@ -231,8 +386,8 @@ func sendReplicaCreateReqs(m *ResourceMgr, replica *api.Replica, nextPeriod *uin
 	}
 
 	// Update period for next service cycle
-	if *nextPeriod > retransmitInterval {
-		*nextPeriod = retransmitInterval
+	if *nextPeriod > m.k.config.RetransmitInterval {
+		*nextPeriod = m.k.config.RetransmitInterval
 	}
 	return false
 }
@@ -245,13 +400,35 @@ func (k *Ketch) onReplicaCreateReq(req *msg.MsgReplicaCreateReq, outMsgs *msg.Ms
 	replica.MasterServerID = &req.SrcID
 	replica.DataState = api.DataStateCatchUp
 
+	// A new epoch from the same master doesn't interrupt replication
+	mgr := k.resourceMgr[api.TypeReplica]
+	if old, ok := mgr.resource[replica.ID].(*api.Replica); ok {
+		if (old.MasterServerID != nil) && (*old.MasterServerID == req.SrcID) {
+			replica.DataState = old.DataState
+		}
+	}
+
+	// The master disposes of its prior epoch; a slave taking over
+	// later closes only the current one.
+	if replica.PriorEpochID != nil {
+		delete(replica.Epochs, replica.PriorEpochID.String())
+		replica.PriorEpochID = nil
+	}
+
+	// Only the master retires servers dropped from the quorum and
+	// restarts members
+	replica.RetiringServerIDs = nil
+	replica.RestartServerIDs = nil
+
 	// Slave replica doesn't have a lease
 	for _, epoch := range replica.Epochs {
 		epoch.LeaseOwner = false
 		epoch.LeaseExpireUptime = 0
+		epoch.LeaseConfirmedUptime = 0
 	}
 
 	found := false
+	witness := false
 	for _, mbr := range replica.Epochs[replica.CurrentEpochID.String()].Quorum {
 
 		// Set slave replica member type and data state
@@ -261,12 +438,27 @@ func (k *Ketch) onReplicaCreateReq(req *msg.MsgReplicaCreateReq, outMsgs *msg.Ms
 		found = true
 		// Set member type and data state
 		replica.MemberType = mbr.MemberType
+		witness = (mbr.MemberType == api.ReplicaQuorumMemberTypeWitness)
 	}
-	if found {
-		// Install replica, possibly replacing existing one
-		mgr := k.resourceMgr[api.TypeReplica]
+	if witness {
+		// Witnesses only hold epochs; never install a replica
+		k.log.WithFields(Locate(logrus.Fields{
+			"req": req,
+		})).Error("Replica create request for witness member")
+	} else if found {
+		// Install replica, possibly replacing existing one.  A
+		// replica of the same name keeps the name; the catalog
+		// reports the conflict.
 		mgr.resource[replica.ID] = &replica
-		mgr.resourceByName[replica.Name] = replica.ID
+		if id, ok := mgr.resourceByName[replica.Name]; ok && !uuid.Equal(id, replica.ID) {
+			k.log.WithFields(Locate(logrus.Fields{
+				"replica": replica.Name,
+				"id":      replica.ID,
+				"holder":  id,
+			})).Error("Replica name held by another replica")
+		} else {
+			mgr.resourceByName[replica.Name] = replica.ID
+		}
 	} else {
 		k.log.WithFields(Locate(logrus.Fields{
 			"req": req,
@@ -302,6 +494,157 @@ func (k *Ketch) onReplicaCreateResp(resp *msg.MsgReplicaCreateResp) {
 		return
 	}
 
+	// Quorum member now catches up; see sendReplicaSetInSyncReqs()
+	found := false
+	for i, mbr := range epoch.Quorum {
+		if mbr.ID == resp.SrcID {
+			if mbr.DataState == api.DataStateUninitialized {
+				epoch.Quorum[i].DataState = api.DataStateCatchUp
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		k.log.WithFields(Locate(logrus.Fields{
+			"resp":    resp,
+			"replica": replica,
+		})).Error("Replica create response from unknown quorum member")
+		return
+	}
+
+	mgr.saveResource(resp.ReplicaID)
+}
+
+// Returns true if all data members are in-sync.  The master sends its
+// WAL position to members catching up and each reports in-sync once it
+// has replayed that far.
+func sendReplicaSetInSyncReqs(m *ResourceMgr, replica *api.Replica, nextPeriod *time.Duration, outMsgs *msg.MsgList) bool {
+
+	reqSent := false
+	for _, mbr := range replica.Epochs[replica.CurrentEpochID.String()].Quorum {
+
+		// If member is myself, witness or data already in-sync, continue
+		if (mbr.ID == m.k.runtime.ID) ||
+			(mbr.MemberType == api.ReplicaQuorumMemberTypeWitness) ||
+			(mbr.DataState == api.DataStateInSync) {
+			continue
+		}
+		reqSent = true
+
+		// Refresh our WAL position and wait until we have one
+		resource, ok := m.k.resourceMgr[api.TypeDBMgr].resource[replica.ID]
+		if !ok {
+			break
+		}
+		dbmgr := resource.(*api.DBMgr)
+		queryLSN(m, replica, dbmgr)
+		if dbmgr.LSN == 0 {
+			break
+		}
+
+		msg := &msg.MsgReplicaSetInSyncReq{
+			Common: msg.Common{
+				Type:      msg.MsgTypeReplicaSetInSyncReq,
+				DestID:    mbr.ID,
+				SrcID:     m.k.runtime.ID,
+				ReplicaID: replica.ID,
+				EpochID:   *replica.CurrentEpochID,
+			},
+			MasterLSN: dbmgr.LSN,
+		}
+		m.k.sendMsg(msg, outMsgs)
+	}
+
+	// If no requests sent, we are done
+	if !reqSent {
+		return true
+	}
+
+	// Update period for next service cycle
+	if *nextPeriod > m.k.config.RetransmitInterval {
+		*nextPeriod = m.k.config.RetransmitInterval
+	}
+	return false
+}
+
+func (k *Ketch) onReplicaSetInSyncReq(req *msg.MsgReplicaSetInSyncReq, outMsgs *msg.MsgList) {
+
+	// Validate request
+	mgr := k.resourceMgr[api.TypeReplica]
+	replica, ok := mgr.resource[req.ReplicaID].(*api.Replica)
+	if !ok {
+		k.log.WithFields(Locate(logrus.Fields{
+			"req": req,
+		})).Error("Replica set in-sync request for unknown replica")
+		return
+	}
+	if (replica.MasterServerID == nil) || (*replica.MasterServerID != req.SrcID) ||
+		(replica.CurrentEpochID == nil) || (*replica.CurrentEpochID != req.EpochID) {
+		k.log.WithFields(Locate(logrus.Fields{
+			"req":     req,
+			"replica": replica,
+		})).Error("Replica set in-sync request from other than current master")
+		return
+	}
+
+	// Compare our replay position to the master's WAL position.
+	// The query started here is reported on retransmit.
+	var resp msg.MsgReplicaSetInSyncResp
+	resource, ok := k.resourceMgr[api.TypeDBMgr].resource[replica.ID]
+	if ok {
+		dbmgr := resource.(*api.DBMgr)
+		// A slave yet to restart with changed settings is not in-sync
+		if (dbmgr.State == api.StateOpen) && (dbmgr.DBState == api.DBStateSlave) &&
+			(dbmgr.Port == replica.DBConfig.Port) && (dbmgr.Password == replica.DBConfig.Password) {
+			queryLSN(mgr, replica, dbmgr)
+			resp.LSN = dbmgr.LSN
+			resp.InSync = (dbmgr.LSN != 0) && (dbmgr.LSN >= req.MasterLSN)
+		}
+	}
+	if resp.InSync && (replica.DataState != api.DataStateInSync) {
+		k.log.WithFields(Locate(logrus.Fields{
+			"replica":   replica.Name,
+			"lsn":       resp.LSN,
+			"masterLSN": req.MasterLSN,
+		})).Info("Replica in-sync")
+		replica.DataState = api.DataStateInSync
+		mgr.saveResource(replica.ID)
+	}
+
+	// Send response
+	resp.Common = req.Common
+	resp.SrcID = req.DestID
+	resp.DestID = req.SrcID
+	resp.Type = msg.MsgTypeReplicaSetInSyncResp
+	k.sendMsg(&resp, outMsgs)
+}
+
+func (k *Ketch) onReplicaSetInSyncResp(resp *msg.MsgReplicaSetInSyncResp) {
+
+	// Validate set in-sync response
+	mgr := k.resourceMgr[api.TypeReplica]
+	replica, ok := mgr.resource[resp.ReplicaID].(*api.Replica)
+	if !ok {
+		k.log.WithFields(Locate(logrus.Fields{
+			"resp": resp,
+		})).Error("Replica set in-sync response for unknown replica")
+		return
+	}
+	epoch, ok := replica.Epochs[resp.EpochID.String()]
+	if !ok {
+		k.log.WithFields(Locate(logrus.Fields{
+			"resp":    resp,
+			"replica": replica,
+		})).Error("Replica set in-sync response for unknown epoch")
+		return
+	}
+
+	// Member is still catching up
+	if !resp.InSync {
+		return
+	}
+
 	// Set quorum member in-sync
 	found := false
 	for i, mbr := range epoch.Quorum {
@@ -315,7 +658,7 @@ func (k *Ketch) onReplicaCreateResp(resp *msg.MsgReplicaCreateResp) {
 		k.log.WithFields(Locate(logrus.Fields{
 			"resp":    resp,
 			"replica": replica,
-		})).Error("Replica create response from unknown quorum member")
+		})).Error("Replica set in-sync response from unknown quorum member")
 		return
 	}
 
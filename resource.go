@@ -32,6 +32,12 @@ type ResourceMgrInstance interface {
 	UpdateAfterLoad(api.Resource) bool
 }
 
+// ResourceMgrNotifier is implemented by instances that track
+// resources created or deleted through the API.
+type ResourceMgrNotifier interface {
+	ResourcesChanged()
+}
+
 type ResourceMgr struct {
 	instance       ResourceMgrInstance
 	k              *Ketch
@@ -77,6 +83,21 @@ func (m *ResourceMgr) GetResources() api.ResourceList {
 	return list
 }
 
+// listResources
+// returns copies of resources without storing a refreshed list, for
+// callers holding the lock shared.
+func (m *ResourceMgr) listResources() api.ResourceList {
+	list := m.instance.GetList()
+	if list == nil {
+		for _, obj := range m.resource {
+			// Copy object so the original is not modified
+			list = append(list, obj.Clone())
+		}
+	}
+	sort.Sort(list)
+	return list
+}
+
 // ClearResources
 // clears all resources of the specified type.
 func (m *ResourceMgr) ClearResources() {
@@ -143,56 +164,68 @@ func (m *ResourceMgr) CreateResources(list api.ResourceList) (api.ResourceList,
 		m.resource[common.ID] = resource.Clone()
 		m.resourceByName[common.Name] = common.ID
 	}
+	m.notifyChanged()
 
 	// Persist resources
 	if !m.persist {
 		return list, nil, http.StatusCreated
 	}
-	err := m.k.db.Update(func(tx *bolt.Tx) error {
-		// Create Ketch bucket
-		b, err := tx.CreateBucketIfNotExists([]byte(m.myType))
+	// Marshal all before queueing any
+	var outs [][]byte
+	for _, resource := range list {
+		common := resource.GetCommon()
+		out, err := json.Marshal(resource)
 		if err != nil {
 			m.k.log.WithFields(Locate(logrus.Fields{
 				"type": m.myType,
+				"name": common.Name,
+				"id":   common.ID,
 				"err":  err,
-			})).Error("Failed to create bucket")
-			return err
-		}
-
-		// Put resources in bucket
-		for _, resource := range list {
-			common := resource.GetCommon()
-			out, err := json.Marshal(resource)
-			if err != nil {
-				m.k.log.WithFields(Locate(logrus.Fields{
-					"type": m.myType,
-					"name": common.Name,
-					"id":   common.ID,
-					"err":  err,
-				})).Error("Failed to marshal resource")
-				return err
-			}
-			err = b.Put(common.ID.Bytes(), out)
-			if err != nil {
-				m.k.log.WithFields(Locate(logrus.Fields{
-					"type": m.myType,
-					"name": common.Name,
-					"key":  common.ID,
-					"out":  out,
-					"err":  err,
-				})).Error("Failed to put resource")
-				return err
-			}
+			})).Error("Failed to marshal resource")
+			return nil, err, http.StatusInternalServerError
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, err, http.StatusInternalServerError
+		outs = append(outs, out)
+	}
+	for i, resource := range list {
+		m.k.journal.add(m.myType, resource.GetCommon().ID, outs[i])
 	}
 
 	return list, nil, http.StatusCreated
 }
 
+// DeleteResource
+// deletes the named resource.
+// Returns the resource deleted, error and http status
+func (m *ResourceMgr) DeleteResource(name string) (api.Resource, error, int) {
+
+	id, ok := m.resourceByName[name]
+	if !ok {
+		err := fmt.Errorf("Resource not found")
+		m.k.log.WithFields(Locate(logrus.Fields{
+			"type": m.myType,
+			"err":  err,
+			"name": name,
+		})).Error(err.Error())
+		return nil, err, http.StatusNotFound
+	}
+	resource := m.resource[id]
+	delete(m.resource, id)
+	delete(m.resourceByName, name)
+	if m.persist {
+		m.saveResource(id)
+	}
+	m.notifyChanged()
+	return resource, nil, http.StatusOK
+}
+
+// notifyChanged
+// tells the instance that its resources changed.
+func (m *ResourceMgr) notifyChanged() {
+	if notifier, ok := m.instance.(ResourceMgrNotifier); ok {
+		notifier.ResourcesChanged()
+	}
+}
+
 // LoadResources
 // loads existing resources from database into Ketch.
 // Called locked.
@@ -268,63 +301,27 @@ func (m *ResourceMgr) LoadResources() {
 }
 
 // saveResource
-// update an existing resource in database from memory.
+// queues an update of an existing resource in database from memory,
+// committed by flushSaves.
 // Called locked.
 // TODO: Return error for API PATCH; fatal for now.
 func (m *ResourceMgr) saveResource(id uuid.UUID) {
 
-	err := m.k.db.Update(func(tx *bolt.Tx) error {
-		// Create Ketch bucket if it doesn't exist
-		bk, err := tx.CreateBucketIfNotExists([]byte(m.myType))
-		if err != nil {
-			m.k.log.WithFields(Locate(logrus.Fields{
-				"type": m.myType,
-				"err":  err,
-			})).Error("Failed to create bucket")
-			return err
-		}
-		// Marshal resource
-		resource, ok := m.resource[id]
-		if !ok {
-			err = bk.Delete(id.Bytes())
-			if err != nil {
-				m.k.log.WithFields(Locate(logrus.Fields{
-					"type": m.myType,
-					"key":  id,
-					"err":  err,
-				})).Error("Failed to delete resource")
-				return err
-			}
-			return nil
-		}
-		common := resource.GetCommon()
-		out, err := json.Marshal(resource)
-		if err != nil {
-			m.k.log.WithFields(Locate(logrus.Fields{
-				"type": m.myType,
-				"name": common.Name,
-				"id":   common.ID,
-				"err":  err,
-			})).Error("Failed to marshal resource")
-			return err
-		}
-		err = bk.Put(common.ID.Bytes(), out)
-		if err != nil {
-			m.k.log.WithFields(Locate(logrus.Fields{
-				"type": m.myType,
-				"name": common.Name,
-				"key":  common.ID,
-				"out":  out,
-				"err":  err,
-			})).Error("Failed to put resource")
-			return err
-		}
-		return nil
-	})
+	// Deleted resources are removed from the database
+	resource, ok := m.resource[id]
+	if !ok {
+		m.k.journal.add(m.myType, id, nil)
+		return
+	}
+	common := resource.GetCommon()
+	out, err := json.Marshal(resource)
 	if err != nil {
 		m.k.log.WithFields(Locate(logrus.Fields{
 			"type": m.myType,
+			"name": common.Name,
+			"id":   common.ID,
 			"err":  err,
-		})).Fatal("Failed to update resources")
+		})).Fatal("Failed to marshal resource")
 	}
+	m.k.journal.add(m.myType, common.ID, out)
 }
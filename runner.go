@@ -0,0 +1,99 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/watercraft/ketch/api"
+)
+
+// DBRunner starts the database commands run by database managers.
+type DBRunner interface {
+	// Start starts command with the given arguments and environment.
+	// The returned process is valid even if start fails, in which case
+	// Wait() returns the start error.
+	Start(command string, args []string, env []string, stdin io.Reader) (api.Process, error)
+	// Output runs command to completion and returns its standard output.
+	Output(command string, args []string, env []string) ([]byte, error)
+}
+
+// ExecRunner runs database commands as child processes.
+type ExecRunner struct {
+	// Log receives command output
+	Log *logrus.Logger
+	// BinDir is the directory for database executables
+	BinDir string
+}
+
+type execProcess struct {
+	cmd *exec.Cmd
+}
+
+// Start runs the command from BinDir, logging its output.
+func (r *ExecRunner) Start(command string, args []string, env []string, stdin io.Reader) (api.Process, error) {
+	cmd := exec.Command(path.Join(r.BinDir, command), args...)
+	cmd.Env = env
+	cmdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		r.Log.WithFields(Locate(logrus.Fields{
+			"err":  err,
+			"cmd":  command,
+			"args": args,
+		})).Error("Failed to initialize output pipe")
+	}
+	scanOut := bufio.NewScanner(cmdOut)
+	go func() {
+		for scanOut.Scan() {
+			r.Log.WithFields(Locate(logrus.Fields{
+				"cmd": command,
+			})).Info(scanOut.Text())
+		}
+	}()
+	cmdErr, err := cmd.StderrPipe()
+	if err != nil {
+		r.Log.WithFields(Locate(logrus.Fields{
+			"err":  err,
+			"cmd":  command,
+			"args": args,
+		})).Error("Failed to initialize error pipe")
+	}
+	scanErr := bufio.NewScanner(cmdErr)
+	go func() {
+		for scanErr.Scan() {
+			// All postgres output goes to stderr; don't flag
+			r.Log.WithFields(Locate(logrus.Fields{
+				"cmd": command,
+			})).Error(scanErr.Text())
+		}
+	}()
+	cmd.Stdin = stdin
+	return &execProcess{cmd: cmd}, cmd.Start()
+}
+
+// Output runs the command from BinDir and returns its output.
+func (r *ExecRunner) Output(command string, args []string, env []string) ([]byte, error) {
+	cmd := exec.Command(path.Join(r.BinDir, command), args...)
+	cmd.Env = env
+	return cmd.Output()
+}
+
+func (p *execProcess) Signal(sig os.Signal) error {
+	if p.cmd.Process == nil {
+		return fmt.Errorf("Process not started")
+	}
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p *execProcess) Wait() error {
+	return p.cmd.Wait()
+}
@@ -6,6 +6,11 @@ package ketch
 
 import (
 	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Sirupsen/logrus"
 
 	"github.com/watercraft/ketch/api"
 )
@@ -36,15 +41,123 @@ func (m *RuntimeMgr) GetList() api.ResourceList {
 
 func (m *RuntimeMgr) UpdateAfterLoad(in api.Resource) bool {
 
-	// If boottime or name changed, update boottime record
+	// If boot or name changed, update boot record.  A boot ID from a
+	// different source can't be compared, so counts as a reboot.
 	m.k.runtime = in.(*api.Runtime)
+
+	// Lease times saved before they were in milliseconds can't be
+	// converted, as the uptime they were saved at is unknown.  They
+	// are dropped as after a reboot.
+	if m.k.runtime.StateVersion < kStateVersion {
+		m.k.upgraded = true
+		m.k.runtime.StateVersion = kStateVersion
+	}
 	if m.k.runtime.Name != m.k.config.ListConfig.Name ||
-		m.k.runtime.BootTime != *m.k.bootTime {
+		m.k.runtime.BootID != m.k.bootID ||
+		m.k.runtime.BootSource != m.k.bootSource {
 
-		// TODO: Renew leases here
+		// Leases are reconciled once epochs and replicas are loaded
+		m.k.rebooted = (m.k.runtime.BootID != m.k.bootID) ||
+			(m.k.runtime.BootSource != m.k.bootSource)
 		m.k.runtime.Name = m.k.config.ListConfig.Name
-		m.k.runtime.BootTime = *m.k.bootTime
+		m.k.runtime.BootID = m.k.bootID
+		m.k.runtime.BootSource = m.k.bootSource
 		return true
 	}
-	return false
+	return m.k.upgraded
+}
+
+// reconcileLeases drops lease state that did not survive a restart.
+// Called after loading epochs and replicas, before the service loop runs.
+//
+// Lease ownership is renewed after any restart, so a master waits for a
+// fresh lease before reopening its database.  After a reboot, uptime
+// restarts from zero and persisted expiry times mean nothing, so
+// accepted proposals are dropped too.  Instead, this server stays quiet,
+// neither proposing nor accepting leases, for a full lease period plus
+// grace: any lease it took part in before the reboot has expired by then.
+// Lease times saved by an older state version are handled the same way.
+func (k *Ketch) reconcileLeases() {
+
+	for _, resource := range k.resourceMgr[api.TypeReplica].resource {
+		replica := resource.(*api.Replica)
+		changed := false
+		for _, epoch := range replica.Epochs {
+			if epoch.LeaseOwner || (epoch.LeaseExpireUptime != 0) || (epoch.LeaseConfirmedUptime != 0) {
+				epoch.LeaseOwner = false
+				epoch.LeaseExpireUptime = 0
+				epoch.LeaseConfirmedUptime = 0
+				changed = true
+			}
+		}
+		if changed {
+			k.resourceMgr[api.TypeReplica].saveResource(replica.ID)
+		}
+	}
+	if !k.rebooted && !k.upgraded {
+		return
+	}
+
+	for _, resource := range k.resourceMgr[api.TypeEpoch].resource {
+		epoch := resource.(*api.Epoch)
+		if epoch.Acceptor.ProposalExpireUptime != 0 {
+			epoch.Acceptor.ProposalExpireUptime = 0
+			k.resourceMgr[api.TypeEpoch].saveResource(epoch.ID)
+		}
+	}
+	k.GetUptime()
+	k.leaseQuietUptime = k.uptime + durationMs(k.config.LeasePeriod+k.config.LeaseGrace)
+	reason := "Host rebooted; holding off leases"
+	if !k.rebooted {
+		reason = "Lease times saved by an older version; holding off leases"
+	}
+	k.log.WithFields(Locate(logrus.Fields{
+		"bootID":       k.bootID,
+		"bootSource":   k.bootSource,
+		"stateVersion": kStateVersion,
+		"quietPeriod":  k.config.LeasePeriod + k.config.LeaseGrace,
+	})).Info(reason)
+}
+
+// Returns true while leases are held off after a reboot, lowering
+// nextPeriod to wake when they resume.
+func leaseQuiet(k *Ketch, nextPeriod *time.Duration) bool {
+	if k.uptime >= k.leaseQuietUptime {
+		return false
+	}
+	timeLeft := time.Duration(k.leaseQuietUptime-k.uptime) * time.Millisecond
+	if (nextPeriod != nil) && (*nextPeriod > timeLeft) {
+		*nextPeriod = timeLeft
+	}
+	return true
+}
+
+// startRestartedReplicaDB brings up a master database found on disk
+// after a restart on the closed port, so it recovers while we wait for
+// a fresh lease.  It moves to the service port once the lease is ours.
+func startRestartedReplicaDB(m *ResourceMgr, replica *api.Replica, nextPeriod *time.Duration) {
+
+	// Nothing to do while renewing a lease we hold
+	epoch, ok := replica.Epochs[replica.CurrentEpochID.String()]
+	if !ok || epoch.LeaseOwner {
+		return
+	}
+
+	resource, ok := m.k.resourceMgr[api.TypeDBMgr].resource[replica.ID]
+	if ok {
+		// Keep driving a closed start to completion
+		if resource.(*api.DBMgr).DBState != api.DBStateMasterClosed {
+			return
+		}
+	} else {
+		dbDir := path.Join(m.k.config.DataDir, replica.ID.String())
+		if _, err := os.Stat(path.Join(dbDir, "PG_VERSION")); err != nil {
+			return
+		}
+	}
+	if !runReplicaOnPort(m, replica, api.DBStateMasterClosed, replica.DBConfig.ClosedPort) {
+		if *nextPeriod > m.k.config.RetransmitInterval {
+			*nextPeriod = m.k.config.RetransmitInterval
+		}
+	}
 }
@@ -6,7 +6,6 @@ package ketch
 
 import (
 	"github.com/Sirupsen/logrus"
-	"github.com/hashicorp/memberlist"
 
 	"github.com/watercraft/ketch/api"
 	"github.com/watercraft/ketch/msg"
@@ -14,19 +13,26 @@ import (
 
 func (k *Ketch) sendMsgs(msgs msg.MsgList) {
 	for _, myMsg := range msgs {
-		buf, err := msg.ToBytes(myMsg)
-		if err != nil {
-			k.log.WithFields(Locate(logrus.Fields{
-				"err": err,
-				"msg": myMsg,
-			})).Info("Failed to encode message")
-		}
-		dest := myMsg.GetCommon().Dest
-		node := &memberlist.Node{
-			Addr: dest.Addr,
-			Port: dest.Port,
-		}
-		k.list.SendToUDP(node, buf)
+		k.faultMgr.apply(api.FaultDirectionSend, myMsg, k.transmitMsg)
+	}
+}
+
+// transmitMsg encodes a message and passes it to the transport.
+func (k *Ketch) transmitMsg(myMsg msg.Msg) {
+	buf, err := msg.ToBytes(myMsg)
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"err": err,
+			"msg": myMsg,
+		})).Info("Failed to encode message")
+		return
+	}
+	err = k.transport.SendTo(myMsg.GetCommon().Dest, buf)
+	if err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"err": err,
+			"msg": myMsg,
+		})).Info("Failed to send message")
 	}
 }
 
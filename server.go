@@ -36,15 +36,42 @@ func (m *ServerMgr) GetList() api.ResourceList {
 	nodes := m.k.list.Members()
 	var list api.ResourceList
 	for _, node := range nodes {
+		// Meta is the runtime ID followed by optional versioned
+		// flags, lease timing and node info
+		var id uuid.UUID
+		if len(node.Meta) >= kNodeMetaIDSize {
+			id = uuid.FromBytesOrNil(node.Meta[:kNodeMetaIDSize])
+		}
+		flags := nodeMetaFlags(node.Meta)
 		server := &api.Server{
 			Common: api.Common{
 				Name: node.Name,
-				ID:   uuid.FromBytesOrNil(node.Meta),
+				ID:   id,
 			},
 			Endpoint: api.Endpoint{
 				Addr: node.Addr,
 				Port: node.Port,
 			},
+			Witness: flags&kNodeMetaWitness != 0,
+		}
+		if info := nodeMetaInfo(node.Meta); info != nil {
+			server.KetchVersion = info.KetchVersion
+			server.ProtocolVersion = info.ProtocolVersion
+			server.Labels = info.Labels
+			server.PGVersion = info.PGVersion
+			server.FreeDisk = info.FreeDisk
+			server.ReplicaCount = uint(info.Replicas)
+			server.Weight = uint(info.Weight)
+			if info.Draining {
+				server.Drain = api.DrainStateDraining
+				if info.Replicas == 0 {
+					server.Drain = api.DrainStateDrained
+				}
+			}
+		}
+		if h, ok := m.k.serverHealth[id]; ok {
+			server.Flaps = h.flaps
+			server.Probation = h.down
 		}
 		list = append(list, server)
 	}
@@ -0,0 +1,265 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/watercraft/ketch/api"
+	"github.com/watercraft/ketch/msg"
+)
+
+// A planned switchover moves the master role of a replica to an in-sync
+// sync member without loss of committed data:
+//
+// 1. The old master keeps its lease and stops its database.  A "fast"
+//    shutdown sends all WAL, ending with the shutdown checkpoint, to
+//    connected slaves.
+// 2. The old master closes the current epoch and asks the new master to
+//    take over once it has replayed up to the shutdown checkpoint.
+// 3. The new master marks its replica for closing and takes the normal
+//    path to a new epoch, waiting out the lease of the old master.
+// 4. The old master drops its lease and waits to be recreated as a
+//    slave of the new master, rewinding its data.
+
+// startReplicaSwitchover
+// starts a switchover of the named replica to the named server.
+// Returns the replica, error and http status
+func startReplicaSwitchover(m *ResourceMgr, name string, serverName string) (api.Resource, error, int) {
+
+	id, ok := m.resourceByName[name]
+	if !ok {
+		return nil, fmt.Errorf("Replica not found"), http.StatusNotFound
+	}
+	replica := m.resource[id].(*api.Replica)
+	if (replica.MasterServerID != nil) || (replica.CurrentEpochID == nil) {
+		return nil, fmt.Errorf("Replica is not master on this server"), http.StatusConflict
+	}
+	if replica.Demoted {
+		return nil, fmt.Errorf("Replica is demoted on this server"), http.StatusConflict
+	}
+	if (replica.PendingState != "") || (replica.SwitchoverServerID != nil) {
+		return nil, fmt.Errorf("Replica is busy"), http.StatusConflict
+	}
+
+	// Choose an in-sync sync member other than this server
+	var target *api.QuorumMember
+	for i, mbr := range replica.Epochs[replica.CurrentEpochID.String()].Quorum {
+		if (serverName != "") && (mbr.Name != serverName) {
+			continue
+		}
+		if (mbr.ID == m.k.runtime.ID) ||
+			(mbr.MemberType != api.ReplicaQuorumMemberTypeSync) ||
+			(mbr.DataState != api.DataStateInSync) {
+			if serverName != "" {
+				return nil, fmt.Errorf("Server %s is not an in-sync member of the replica", serverName), http.StatusBadRequest
+			}
+			continue
+		}
+		target = &replica.Epochs[replica.CurrentEpochID.String()].Quorum[i]
+		break
+	}
+	if target == nil {
+		if serverName != "" {
+			return nil, fmt.Errorf("Server %s is not a member of the replica", serverName), http.StatusBadRequest
+		}
+		return nil, fmt.Errorf("No in-sync member to take over"), http.StatusConflict
+	}
+
+	m.k.log.WithFields(Locate(logrus.Fields{
+		"replica": replica.Name,
+		"server":  target.Name,
+	})).Info("Switchover started")
+	targetID := target.ID
+	replica.SwitchoverServerID = &targetID
+	m.saveResource(replica.ID)
+	return replica.Clone(), nil, http.StatusOK
+}
+
+// Returns true if no switchover is in progress.
+func runReplicaSwitchover(m *ResourceMgr, replica *api.Replica, nextPeriod *time.Duration, outMsgs *msg.MsgList) bool {
+
+	if (replica.SwitchoverServerID == nil) || (replica.MasterServerID != nil) {
+		return true
+	}
+
+	// A failed member aborts the switchover; recover as usual
+	if replica.PendingState == api.StateClosed {
+		m.k.log.WithFields(Locate(logrus.Fields{
+			"replica": replica.Name,
+		})).Error("Switchover aborted by membership change")
+		replica.SwitchoverServerID = nil
+		m.saveResource(replica.ID)
+		return true
+	}
+
+	// Hold the lease while the database stops
+	if !sendLeasePrepareReqs(m, replica, replica.CurrentEpochID, nil, nextPeriod, outMsgs) {
+		return false
+	}
+
+	// Stop the database, so that no more changes are made
+	if !stopReplicaDB(m, replica) {
+		if *nextPeriod > m.k.config.RetransmitInterval {
+			*nextPeriod = m.k.config.RetransmitInterval
+		}
+		return false
+	}
+
+	// Read the final WAL position from the stopped database
+	resource, ok := m.k.resourceMgr[api.TypeDBMgr].resource[replica.ID]
+	if !ok {
+		m.k.log.WithFields(Locate(logrus.Fields{
+			"replica": replica,
+		})).Error("Switchover of replica without database manager")
+		replica.SwitchoverServerID = nil
+		m.saveResource(replica.ID)
+		return true
+	}
+	dbmgr := resource.(*api.DBMgr)
+	queryLSN(m, replica, dbmgr)
+	if dbmgr.LSN == 0 {
+		if *nextPeriod > m.k.config.RetransmitInterval {
+			*nextPeriod = m.k.config.RetransmitInterval
+		}
+		return false
+	}
+
+	// Close current epoch.  The replica is closed, so renewing the
+	// lease on the closed epoch does not mark it for closing.
+	replica.State = api.StateClosed
+	if !sendEpochCloseReqs(m, replica, replica.CurrentEpochID, nextPeriod, outMsgs) {
+		return false
+	}
+
+	// Ask the new master to take over
+	msg := &msg.MsgReplicaSwitchoverReq{
+		Common: msg.Common{
+			Type:      msg.MsgTypeReplicaSwitchoverReq,
+			DestID:    *replica.SwitchoverServerID,
+			SrcID:     m.k.runtime.ID,
+			ReplicaID: replica.ID,
+			EpochID:   *replica.CurrentEpochID,
+		},
+		MasterLSN: dbmgr.LSN,
+	}
+	m.k.sendMsg(msg, outMsgs)
+	if *nextPeriod > m.k.config.RetransmitInterval {
+		*nextPeriod = m.k.config.RetransmitInterval
+	}
+	return false
+}
+
+func (k *Ketch) onReplicaSwitchoverReq(req *msg.MsgReplicaSwitchoverReq, outMsgs *msg.MsgList) {
+
+	// Validate request
+	mgr := k.resourceMgr[api.TypeReplica]
+	replica, ok := mgr.resource[req.ReplicaID].(*api.Replica)
+	if !ok {
+		k.log.WithFields(Locate(logrus.Fields{
+			"req": req,
+		})).Error("Replica switchover request for unknown replica")
+		return
+	}
+
+	var resp msg.MsgReplicaSwitchoverResp
+	switch {
+	case (replica.MasterServerID == nil) && (replica.PriorMasterServerID != nil) &&
+		(*replica.PriorMasterServerID == req.SrcID):
+		// Already taking over; response was lost
+		resp.Accepted = true
+	case (replica.MasterServerID == nil) || (*replica.MasterServerID != req.SrcID) ||
+		(replica.MemberType != api.ReplicaQuorumMemberTypeSync):
+		k.log.WithFields(Locate(logrus.Fields{
+			"req":     req,
+			"replica": replica,
+		})).Error("Replica switchover request from other than current master")
+		return
+	default:
+		// Take over once we have replayed the master's final WAL.
+		// The query started here is reported on retransmit.
+		resource, ok := k.resourceMgr[api.TypeDBMgr].resource[replica.ID]
+		if ok {
+			dbmgr := resource.(*api.DBMgr)
+			if (dbmgr.State == api.StateOpen) && (dbmgr.DBState == api.DBStateSlave) {
+				queryLSN(mgr, replica, dbmgr)
+				resp.LSN = dbmgr.LSN
+			}
+		}
+		if (resp.LSN == 0) || (resp.LSN < req.MasterLSN) {
+			break
+		}
+		k.log.WithFields(Locate(logrus.Fields{
+			"replica":   replica.Name,
+			"lsn":       resp.LSN,
+			"masterLSN": req.MasterLSN,
+		})).Info("Switchover taking over as master")
+		oldMasterID := req.SrcID
+		replica.PriorMasterServerID = &oldMasterID
+		replica.MasterServerID = nil
+		replica.DataState = api.DataStateInSync
+		replica.PendingState = api.StateClosed
+		mgr.saveResource(replica.ID)
+		resp.Accepted = true
+	}
+
+	// Send response
+	resp.Common = req.Common
+	resp.SrcID = req.DestID
+	resp.DestID = req.SrcID
+	resp.Type = msg.MsgTypeReplicaSwitchoverResp
+	k.sendMsg(&resp, outMsgs)
+}
+
+func (k *Ketch) onReplicaSwitchoverResp(resp *msg.MsgReplicaSwitchoverResp) {
+
+	// Validate switchover response
+	mgr := k.resourceMgr[api.TypeReplica]
+	replica, ok := mgr.resource[resp.ReplicaID].(*api.Replica)
+	if !ok {
+		k.log.WithFields(Locate(logrus.Fields{
+			"resp": resp,
+		})).Error("Replica switchover response for unknown replica")
+		return
+	}
+	if (replica.SwitchoverServerID == nil) || (*replica.SwitchoverServerID != resp.SrcID) ||
+		(replica.MasterServerID != nil) {
+		// Extra responses after handing over are normal
+		return
+	}
+	epoch, ok := replica.Epochs[resp.EpochID.String()]
+	if !ok {
+		k.log.WithFields(Locate(logrus.Fields{
+			"resp":    resp,
+			"replica": replica,
+		})).Error("Replica switchover response for unknown epoch")
+		return
+	}
+
+	// New master is still catching up
+	if !resp.Accepted {
+		return
+	}
+
+	// Drop the lease and wait to be recreated as a slave.  Our data
+	// is behind once the new master opens its epoch.
+	k.log.WithFields(Locate(logrus.Fields{
+		"replica": replica.Name,
+		"lsn":     resp.LSN,
+	})).Info("Switchover handed over master")
+	epoch.LeaseOwner = false
+	epoch.LeaseExpireUptime = 0
+	epoch.LeaseConfirmedUptime = 0
+	newMasterID := resp.SrcID
+	replica.MasterServerID = &newMasterID
+	replica.MemberType = api.ReplicaQuorumMemberTypeSync
+	replica.DataState = api.DataStateCatchUp
+	replica.SwitchoverServerID = nil
+	mgr.saveResource(replica.ID)
+}
@@ -0,0 +1,371 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+	"github.com/watercraft/ketch/msg"
+)
+
+// Deleting a replica is coordinated by its master.  The master stops
+// its database and asks every quorum member of each epoch to tear down:
+// members stop their database, drop the database manager and dispose of
+// the data.  A member also removes its acceptor record of the epoch
+// asked about, but only once the epoch can no longer be leased by
+// anyone else: it was revoked to a successor, or the sender owns its
+// lease proposal.  So a delete request from a stale master, or one
+// delayed or duplicated, never erases the acceptor state of a live
+// epoch.  The master tears down last.  Members that are down keep their
+// copy.
+//
+// Servers dropped from the quorum by a new epoch are retired the same
+// way once the prior epoch is revoked, keeping their data.  They are
+// asked again when they come back up.
+
+// startReplicaDelete
+// marks the named replica for deletion.
+// Returns the replica, error and http status
+func startReplicaDelete(m *ResourceMgr, name string, disposition api.DataDisposition) (api.Resource, error, int) {
+
+	switch disposition {
+	case "":
+		disposition = api.DataDispositionKeep
+	case api.DataDispositionKeep, api.DataDispositionArchive, api.DataDispositionRemove:
+	default:
+		return nil, fmt.Errorf("Unknown data disposition %s", disposition), http.StatusBadRequest
+	}
+	id, ok := m.resourceByName[name]
+	if !ok {
+		return nil, fmt.Errorf("Replica not found"), http.StatusNotFound
+	}
+	replica := m.resource[id].(*api.Replica)
+	if replica.MasterServerID != nil {
+		return nil, fmt.Errorf("Replica is not master on this server"), http.StatusConflict
+	}
+	if replica.PendingState == api.StateDelete {
+		// Already deleting
+		return replica.Clone(), nil, http.StatusOK
+	}
+	if replica.Demoted {
+		return nil, fmt.Errorf("Replica is demoted on this server"), http.StatusConflict
+	}
+	if (replica.PendingState != "") || (replica.SwitchoverServerID != nil) {
+		return nil, fmt.Errorf("Replica is busy"), http.StatusConflict
+	}
+
+	m.k.log.WithFields(Locate(logrus.Fields{
+		"replica":         replica.Name,
+		"dataDisposition": disposition,
+	})).Info("Replica delete started")
+	replica.PendingState = api.StateDelete
+	replica.DataDisposition = disposition
+	m.saveResource(replica.ID)
+	return replica.Clone(), nil, http.StatusOK
+}
+
+// Tear down a replica pending delete.
+func deleteReplica(m *ResourceMgr, replica *api.Replica, nextPeriod *time.Duration, outMsgs *msg.MsgList) {
+
+	// Slaves tear down when asked by the master
+	if replica.MasterServerID != nil {
+		if !teardownReplica(m, replica) {
+			if *nextPeriod > m.k.config.RetransmitInterval {
+				*nextPeriod = m.k.config.RetransmitInterval
+			}
+		}
+		return
+	}
+
+	// Stop our database, so that no more changes are made
+	if !stopReplicaDB(m, replica) {
+		if *nextPeriod > m.k.config.RetransmitInterval {
+			*nextPeriod = m.k.config.RetransmitInterval
+		}
+		return
+	}
+
+	// Ask members of all epochs to tear down, once for each epoch so
+	// that they remove each of their acceptor records
+	reqSent := false
+	for _, epoch := range replica.Epochs {
+		for _, mbr := range epoch.Quorum {
+			if (mbr.ID == m.k.runtime.ID) || (mbr.PendingState == api.StateDelete) {
+				continue
+			}
+			if _, ok := m.k.resourceMgr[api.TypeServer].resource[mbr.ID]; !ok {
+				m.k.log.WithFields(Locate(logrus.Fields{
+					"replica": replica.Name,
+					"mbr":     mbr,
+				})).Info("Replica delete skipping member that is down")
+				continue
+			}
+			msg := &msg.MsgReplicaDeleteReq{
+				Common: msg.Common{
+					Type:      msg.MsgTypeReplicaDeleteReq,
+					DestID:    mbr.ID,
+					SrcID:     m.k.runtime.ID,
+					ReplicaID: replica.ID,
+					EpochID:   epoch.ID,
+				},
+				DataDisposition: replica.DataDisposition,
+			}
+			m.k.sendMsg(msg, outMsgs)
+			reqSent = true
+		}
+	}
+	if reqSent {
+		if *nextPeriod > m.k.config.RetransmitInterval {
+			*nextPeriod = m.k.config.RetransmitInterval
+		}
+		return
+	}
+
+	teardownReplica(m, replica)
+}
+
+// retireDroppedMembers records members of the epoch that are not in the
+// current epoch for retirement.
+func retireDroppedMembers(m *ResourceMgr, replica *api.Replica, epochID *uuid.UUID) {
+
+	epoch, ok := replica.Epochs[epochID.String()]
+	if !ok {
+		return
+	}
+	current := replica.Epochs[replica.CurrentEpochID.String()]
+	for _, mbr := range epoch.Quorum {
+		if (mbr.ID == m.k.runtime.ID) || epochHasMember(current, mbr.ID) {
+			continue
+		}
+		retiring := false
+		for _, id := range replica.RetiringServerIDs {
+			if id == mbr.ID {
+				retiring = true
+				break
+			}
+		}
+		if !retiring {
+			replica.RetiringServerIDs = append(replica.RetiringServerIDs, mbr.ID)
+		}
+	}
+}
+
+// Ask retiring servers that are up to tear down their copy of the replica.
+func sendReplicaRetireReqs(m *ResourceMgr, replica *api.Replica, nextPeriod *time.Duration, outMsgs *msg.MsgList) {
+
+	current := replica.Epochs[replica.CurrentEpochID.String()]
+	reqSent := false
+	for _, id := range replica.RetiringServerIDs {
+		if epochHasMember(current, id) {
+			continue
+		}
+		if _, ok := m.k.resourceMgr[api.TypeServer].resource[id]; !ok {
+			continue
+		}
+		msg := &msg.MsgReplicaDeleteReq{
+			Common: msg.Common{
+				Type:      msg.MsgTypeReplicaDeleteReq,
+				DestID:    id,
+				SrcID:     m.k.runtime.ID,
+				ReplicaID: replica.ID,
+				EpochID:   *replica.CurrentEpochID,
+			},
+			DataDisposition: api.DataDispositionKeep,
+			Retire:          true,
+		}
+		m.k.sendMsg(msg, outMsgs)
+		reqSent = true
+	}
+	if reqSent && (*nextPeriod > m.k.config.RetransmitInterval) {
+		*nextPeriod = m.k.config.RetransmitInterval
+	}
+}
+
+// Returns true when the replica is removed.
+func teardownReplica(m *ResourceMgr, replica *api.Replica) bool {
+
+	if !stopReplicaDB(m, replica) {
+		return false
+	}
+
+	// Remove epochs, database manager and data
+	removeReplicaEpochs(m.k, replica.ID)
+	delete(m.k.resourceMgr[api.TypeDBMgr].resource, replica.ID)
+	disposeReplicaData(m, replica)
+
+	// Remove replica
+	m.k.log.WithFields(Locate(logrus.Fields{
+		"replica":         replica.Name,
+		"dataDisposition": replica.DataDisposition,
+	})).Info("Replica deleted")
+	delete(m.resource, replica.ID)
+	if uuid.Equal(m.resourceByName[replica.Name], replica.ID) {
+		delete(m.resourceByName, replica.Name)
+	}
+	m.saveResource(replica.ID)
+	return true
+}
+
+// removeReplicaEpochs removes the epochs accepted for the replica
+// being torn down here.
+func removeReplicaEpochs(k *Ketch, replicaID uuid.UUID) {
+	mgr := k.resourceMgr[api.TypeEpoch]
+	for _, resource := range mgr.resource {
+		epoch := resource.(*api.Epoch)
+		if epoch.ReplicaID == replicaID {
+			delete(mgr.resource, epoch.ID)
+			mgr.saveResource(epoch.ID)
+		}
+	}
+}
+
+// disposeReplicaData keeps, archives or removes the data directory on
+// the worker of the replica, as removing a large directory is slow.
+// Called locked.
+func disposeReplicaData(m *ResourceMgr, replica *api.Replica) {
+
+	k := m.k
+	dir := path.Join(k.config.DataDir, replica.ID.String())
+	name := replica.Name
+	disposition := replica.DataDisposition
+	k.replicaWork(replica.ID, func() {
+		err := os.Remove(dir + DBPWExt)
+		if err != nil && !os.IsNotExist(err) {
+			k.log.WithFields(Locate(logrus.Fields{
+				"replica": name,
+				"err":     err,
+			})).Error("Failed to remove password file")
+		}
+		if _, err = os.Stat(dir); os.IsNotExist(err) {
+			return
+		}
+
+		switch disposition {
+		case api.DataDispositionArchive:
+			archive := fmt.Sprintf("%s.%s", dir, time.Now().UTC().Format("20060102T150405Z"))
+			err = os.Rename(dir, archive)
+		case api.DataDispositionRemove:
+			err = os.RemoveAll(dir)
+		}
+		if err != nil {
+			k.log.WithFields(Locate(logrus.Fields{
+				"replica":         name,
+				"dataDisposition": disposition,
+				"err":             err,
+			})).Error("Failed to dispose of database directory")
+		}
+	})
+}
+
+func (k *Ketch) onReplicaDeleteReq(req *msg.MsgReplicaDeleteReq, outMsgs *msg.MsgList) {
+
+	// Mark replica for teardown; deleted once it is gone
+	var resp msg.MsgReplicaDeleteResp
+	resp.Deleted = true
+	mgr := k.resourceMgr[api.TypeReplica]
+	replica, ok := mgr.resource[req.ReplicaID].(*api.Replica)
+	if ok {
+		// A slave left behind by an earlier master, or a demoted
+		// copy, is retired
+		// when its data is kept
+		retire := ((replica.MasterServerID != nil) || replica.Demoted) &&
+			(req.DataDisposition == api.DataDispositionKeep)
+		if !retire && ((replica.MasterServerID == nil) || (*replica.MasterServerID != req.SrcID)) {
+			k.log.WithFields(Locate(logrus.Fields{
+				"req":     req,
+				"replica": replica,
+			})).Error("Replica delete request from other than current master")
+			return
+		}
+		if replica.PendingState != api.StateDelete {
+			replica.PendingState = api.StateDelete
+			replica.DataDisposition = req.DataDisposition
+			mgr.saveResource(replica.ID)
+		}
+		resp.Deleted = false
+	}
+
+	// Remove the epoch for which we are an acceptor, if it is done
+	removeDeletedEpoch(k, req)
+
+	// Send response
+	resp.Common = req.Common
+	resp.SrcID = req.DestID
+	resp.DestID = req.SrcID
+	resp.Type = msg.MsgTypeReplicaDeleteResp
+	k.sendMsg(&resp, outMsgs)
+}
+
+// removeDeletedEpoch removes our acceptor record of the epoch of a
+// delete request once no one but the sender can lease it: the epoch was
+// revoked to a successor, or the sender owns its lease proposal.  A
+// retire request names the current epoch, which is never removed for
+// it.
+func removeDeletedEpoch(k *Ketch, req *msg.MsgReplicaDeleteReq) {
+
+	mgr := k.resourceMgr[api.TypeEpoch]
+	epoch, ok := mgr.resource[req.EpochID].(*api.Epoch)
+	if !ok || !uuid.Equal(epoch.ReplicaID, req.ReplicaID) {
+		return
+	}
+	revoked := epoch.SuccessorEpochID != nil
+	owned := uuid.Equal(epoch.Acceptor.ProposalOwnerID, req.SrcID)
+	if !revoked && (req.Retire || !owned) {
+		k.log.WithFields(Locate(logrus.Fields{
+			"req":   req,
+			"epoch": epoch,
+		})).Info("Replica delete request keeps live epoch")
+		return
+	}
+	delete(mgr.resource, epoch.ID)
+	mgr.saveResource(epoch.ID)
+}
+
+func (k *Ketch) onReplicaDeleteResp(resp *msg.MsgReplicaDeleteResp) {
+
+	// Replica is gone once deleted here, so later responses are normal
+	mgr := k.resourceMgr[api.TypeReplica]
+	replica, ok := mgr.resource[resp.ReplicaID].(*api.Replica)
+	if !ok || !resp.Deleted {
+		return
+	}
+
+	// Retired server is done
+	if replica.PendingState != api.StateDelete {
+		var retiring []uuid.UUID
+		for _, id := range replica.RetiringServerIDs {
+			if id != resp.SrcID {
+				retiring = append(retiring, id)
+			}
+		}
+		if len(retiring) != len(replica.RetiringServerIDs) {
+			k.log.WithFields(Locate(logrus.Fields{
+				"replica": replica.Name,
+				"server":  resp.SrcID,
+			})).Info("Replica retired from server")
+			replica.RetiringServerIDs = retiring
+			mgr.saveResource(replica.ID)
+		}
+		return
+	}
+
+	// Mark member torn down in the epoch asked about
+	if epoch, ok := replica.Epochs[resp.EpochID.String()]; ok {
+		for i, mbr := range epoch.Quorum {
+			if mbr.ID == resp.SrcID {
+				epoch.Quorum[i].PendingState = api.StateDelete
+			}
+		}
+	}
+	mgr.saveResource(replica.ID)
+}
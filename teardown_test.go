@@ -0,0 +1,91 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+	"github.com/watercraft/ketch/msg"
+)
+
+// addTestAcceptedEpoch adds our acceptor record of an epoch of a
+// replica whose lease proposal is owned by owner.
+func addTestAcceptedEpoch(k *Ketch, replicaID uuid.UUID, owner uuid.UUID) *api.Epoch {
+	epoch := &api.Epoch{
+		Common:    api.Common{ID: uuid.NewV4(), State: api.StateOpen},
+		ReplicaID: replicaID,
+		Acceptor: api.AcceptorState{
+			HighestPromised:      api.BallotNumber{Sequence: 3, ServerID: owner},
+			ProposalOwnerID:      owner,
+			ProposalExpireUptime: k.uptime + durationMs(k.config.LeasePeriod),
+		},
+	}
+	k.resourceMgr[api.TypeEpoch].resource[epoch.ID] = epoch
+	return epoch
+}
+
+// sendTestDeleteReq passes a replica delete request for an epoch.
+func sendTestDeleteReq(k *Ketch, src uuid.UUID, epoch *api.Epoch, retire bool) {
+	var outMsgs msg.MsgList
+	k.onReplicaDeleteReq(&msg.MsgReplicaDeleteReq{
+		Common: msg.Common{
+			Type:      msg.MsgTypeReplicaDeleteReq,
+			DestID:    k.runtime.ID,
+			SrcID:     src,
+			ReplicaID: epoch.ReplicaID,
+			EpochID:   epoch.ID,
+		},
+		DataDisposition: api.DataDispositionKeep,
+		Retire:          retire,
+	}, &outMsgs)
+}
+
+// hasTestEpoch returns true if we still accept for an epoch.
+func hasTestEpoch(k *Ketch, epoch *api.Epoch) bool {
+	_, ok := k.resourceMgr[api.TypeEpoch].resource[epoch.ID]
+	return ok
+}
+
+func TestReplicaDeleteKeepsLiveEpoch(t *testing.T) {
+	k := newTestKetch(NewFakeClock(time.Hour))
+	master, stale := uuid.NewV4(), uuid.NewV4()
+	addTestServer(k, "server2", master)
+	addTestServer(k, "server3", stale)
+
+	// As a witness, holding no copy of the replica, the live epoch is
+	// kept when a former master or a retire request asks
+	replicaID := uuid.NewV4()
+	live := addTestAcceptedEpoch(k, replicaID, master)
+	sendTestDeleteReq(k, stale, live, false)
+	if !hasTestEpoch(k, live) {
+		t.Fatal("Delete request from a stale master removed the live epoch")
+	}
+	sendTestDeleteReq(k, master, live, true)
+	if !hasTestEpoch(k, live) {
+		t.Fatal("Retire request removed the current epoch")
+	}
+	if !live.Acceptor.HighestPromised.Equal(&api.BallotNumber{Sequence: 3, ServerID: master}) {
+		t.Fatal("Acceptor state of the live epoch changed")
+	}
+
+	// An epoch revoked to a successor is removed whoever asks
+	revoked := addTestAcceptedEpoch(k, replicaID, stale)
+	successor := live.ID
+	revoked.SuccessorEpochID = &successor
+	sendTestDeleteReq(k, stale, revoked, true)
+	if hasTestEpoch(k, revoked) {
+		t.Fatal("Revoked epoch not removed")
+	}
+
+	// The owner of the proposal removes the live epoch
+	sendTestDeleteReq(k, master, live, false)
+	if hasTestEpoch(k, live) {
+		t.Fatal("Delete request from the master did not remove its epoch")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/watercraft/ketch/api"
+)
+
+// Transport carries encoded protocol messages between Ketch members.
+// Delivery is best effort, like UDP; the protocol retransmits on its own.
+type Transport interface {
+	// Open links the transport to a Ketch instance.  Incoming messages
+	// are passed to recv, which does not block.
+	Open(k *Ketch, recv func(buf []byte)) error
+	// SendTo sends an encoded message to the member at dest.
+	SendTo(dest api.Endpoint, buf []byte) error
+	// Close stops delivery of incoming messages.
+	Close() error
+}
+
+// MemberlistTransport sends messages as memberlist UDP user messages.
+// This is the default transport.
+type MemberlistTransport struct {
+	k *Ketch
+}
+
+// NewMemberlistTransport returns a transport using the Ketch memberlist.
+func NewMemberlistTransport() *MemberlistTransport {
+	return &MemberlistTransport{}
+}
+
+// Open registers recv for user messages passed to the memberlist delegate.
+func (t *MemberlistTransport) Open(k *Ketch, recv func(buf []byte)) error {
+	t.k = k
+	k.notifyMsg = recv
+	return nil
+}
+
+// SendTo sends the message over memberlist UDP.
+func (t *MemberlistTransport) SendTo(dest api.Endpoint, buf []byte) error {
+	node := &memberlist.Node{
+		Addr: dest.Addr,
+		Port: dest.Port,
+	}
+	return t.k.list.SendToUDP(node, buf)
+}
+
+// Close stops delivery of memberlist user messages.
+func (t *MemberlistTransport) Close() error {
+	t.k.notifyMsg = nil
+	return nil
+}
+
+// ChannelNetwork connects channel transports within a single process so
+// several Ketch instances can exchange messages without sockets.
+type ChannelNetwork struct {
+	sync.Mutex
+	transports map[string]*ChannelTransport
+}
+
+// NewChannelNetwork returns an empty in-process network.
+func NewChannelNetwork() *ChannelNetwork {
+	return &ChannelNetwork{
+		transports: make(map[string]*ChannelTransport),
+	}
+}
+
+// NewTransport returns a transport reachable at the given endpoint once opened.
+func (n *ChannelNetwork) NewTransport(endpoint api.Endpoint) *ChannelTransport {
+	return &ChannelTransport{
+		net:  n,
+		addr: endpoint.String(),
+	}
+}
+
+// ChannelTransport is an in-process transport attached to a ChannelNetwork.
+type ChannelTransport struct {
+	net  *ChannelNetwork
+	addr string
+	recv func(buf []byte)
+}
+
+// Open attaches the transport to its network.
+func (t *ChannelTransport) Open(k *Ketch, recv func(buf []byte)) error {
+	t.net.Lock()
+	defer t.net.Unlock()
+	if _, ok := t.net.transports[t.addr]; ok {
+		return fmt.Errorf("Address %s already in use", t.addr)
+	}
+	t.recv = recv
+	t.net.transports[t.addr] = t
+	return nil
+}
+
+// SendTo delivers a copy of the message to the transport at dest.
+func (t *ChannelTransport) SendTo(dest api.Endpoint, buf []byte) error {
+	t.net.Lock()
+	peer, ok := t.net.transports[dest.String()]
+	t.net.Unlock()
+	if !ok {
+		return fmt.Errorf("No route to %s", dest.String())
+	}
+	out := make([]byte, len(buf))
+	copy(out, buf)
+	peer.recv(out)
+	return nil
+}
+
+// Close detaches the transport from its network.
+func (t *ChannelTransport) Close() error {
+	t.net.Lock()
+	defer t.net.Unlock()
+	if peer, ok := t.net.transports[t.addr]; ok && peer == t {
+		delete(t.net.transports, t.addr)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/watercraft/ketch/api"
+)
+
+// Changes to the quorum of a live replica are rolled out through a new
+// epoch: the master records the change and closes the current epoch, so
+// clients cannot write until the new epoch opens.  The new epoch is
+// sized by the new quorum settings and keeps existing members where it
+// can.  Servers dropped from the quorum tear down their copy, keeping
+// the data.
+//
+// Changes to the port or password restart the databases one at a time
+// while the master keeps serving:
+//
+// 1. The master changes the password in its database; slaves replicate
+//    it and restarted slaves connect with it.  The master keeps its
+//    port, recorded as MasterPort for slaves to connect to.
+// 2. With all members in-sync, the master asks the next slave to restart
+//    by sending it a create request with the new settings.  The slave
+//    restarts and reports in-sync only once running with them.
+// 3. Once every slave has restarted, a master still on the old port
+//    switches over to an in-sync member, which opens on the new port,
+//    and rejoins as a slave with the new settings.  A master with no
+//    member to take over closes the epoch and reopens on the new port.
+// A new epoch recreates every member with the current settings, so it
+// ends any rollout in progress.  The closed port applies when the
+// master is next closed.
+
+// startReplicaUpdate
+// applies patch to the named replica and starts its rollout.
+// Returns the replica, error and http status
+func startReplicaUpdate(m *ResourceMgr, name string, patch *api.ReplicaPatch) (api.Resource, error, int) {
+
+	id, ok := m.resourceByName[name]
+	if !ok {
+		return nil, fmt.Errorf("Replica not found"), http.StatusNotFound
+	}
+	replica := m.resource[id].(*api.Replica)
+	if replica.MasterServerID != nil {
+		return nil, fmt.Errorf("Replica is not master on this server"), http.StatusConflict
+	}
+	if replica.Demoted {
+		return nil, fmt.Errorf("Replica is demoted on this server"), http.StatusConflict
+	}
+	if (replica.CurrentEpochID == nil) || (replica.PendingState != "") ||
+		(replica.SwitchoverServerID != nil) ||
+		(len(replica.RestartServerIDs) != 0) || (replica.MasterPort != 0) {
+		return nil, fmt.Errorf("Replica is busy"), http.StatusConflict
+	}
+
+	// Apply patch to a copy
+	updated := *replica
+	if patch.QuorumGroupSize != nil {
+		updated.QuorumGroupSize = *patch.QuorumGroupSize
+		updated.SyncMemberCount = quorumMajority(updated.QuorumGroupSize)
+	}
+	if patch.SyncMemberCount != nil {
+		updated.SyncMemberCount = *patch.SyncMemberCount
+	}
+	if patch.WitnessCount != nil {
+		updated.WitnessCount = *patch.WitnessCount
+	}
+	if patch.Spread != nil {
+		updated.Spread = *patch.Spread
+	}
+	if patch.DBConfig != nil {
+		if patch.DBConfig.Password != nil {
+			updated.DBConfig.Password = *patch.DBConfig.Password
+		}
+		if patch.DBConfig.Port != nil {
+			updated.DBConfig.Port = *patch.DBConfig.Port
+		}
+		if patch.DBConfig.ClosedPort != nil {
+			updated.DBConfig.ClosedPort = *patch.DBConfig.ClosedPort
+		}
+	}
+
+	// Validate
+	if err := validateReplicaQuorum(&updated); err != nil {
+		return nil, err, http.StatusBadRequest
+	}
+	if err := validateReplicaSpread(&updated); err != nil {
+		return nil, err, http.StatusBadRequest
+	}
+	if err := validateReplicaPGVersion(m.k, &updated); err != nil {
+		return nil, err, http.StatusBadRequest
+	}
+	if (updated.DBConfig.Port == 0) || (updated.DBConfig.Port == updated.DBConfig.ClosedPort) {
+		return nil, fmt.Errorf("Port and closed port must be set and differ"), http.StatusBadRequest
+	}
+	if updated.DBConfig.Password == "" {
+		return nil, fmt.Errorf("Password must be set"), http.StatusBadRequest
+	}
+
+	// Nothing to do
+	quorumChanged := (updated.QuorumGroupSize != replica.QuorumGroupSize) ||
+		(updated.SyncMemberCount != replica.SyncMemberCount) ||
+		(updated.WitnessCount != replica.WitnessCount) ||
+		!reflect.DeepEqual(updated.Spread, replica.Spread)
+	restart := (updated.DBConfig.Port != replica.DBConfig.Port) ||
+		(updated.DBConfig.Password != replica.DBConfig.Password)
+	if !quorumChanged && (updated.DBConfig == replica.DBConfig) {
+		return replica.Clone(), nil, http.StatusOK
+	}
+
+	// A new epoch would restart every member at once
+	if quorumChanged && restart {
+		return nil, fmt.Errorf("Change the quorum and the port or password in separate patches"), http.StatusBadRequest
+	}
+
+	// Refuse a quorum we couldn't form now; the replica would stay
+	// closed until enough servers join.
+	if quorumChanged {
+		data, witness := countServers(m.k)
+		dataCount := updated.QuorumGroupSize - updated.WitnessCount
+		if (data < dataCount) || (data+witness < updated.QuorumGroupSize) {
+			return nil, fmt.Errorf("Not enough servers for quorum group size %d", updated.QuorumGroupSize), http.StatusConflict
+		}
+		if _, _, ok := placeQuorum(m, &updated); !ok {
+			return nil, fmt.Errorf("Not enough servers to meet spread constraints"), http.StatusConflict
+		}
+	}
+
+	m.k.log.WithFields(Locate(logrus.Fields{
+		"replica":         replica.Name,
+		"quorumGroupSize": updated.QuorumGroupSize,
+		"syncMemberCount": updated.SyncMemberCount,
+		"witnessCount":    updated.WitnessCount,
+		"spread":          updated.Spread,
+		"port":            updated.DBConfig.Port,
+		"closedPort":      updated.DBConfig.ClosedPort,
+	})).Info("Replica update started")
+	replica.QuorumGroupSize = updated.QuorumGroupSize
+	replica.SyncMemberCount = updated.SyncMemberCount
+	replica.WitnessCount = updated.WitnessCount
+	replica.Spread = updated.Spread
+	if quorumChanged {
+		replica.PendingState = api.StateClosed
+	}
+
+	// Restart slaves first; the master keeps its port until it hands over
+	if restart {
+		for _, mbr := range replica.Epochs[replica.CurrentEpochID.String()].Quorum {
+			if (mbr.ID != m.k.runtime.ID) && (mbr.MemberType != api.ReplicaQuorumMemberTypeWitness) {
+				replica.RestartServerIDs = append(replica.RestartServerIDs, mbr.ID)
+			}
+		}
+		if updated.DBConfig.Port != replica.DBConfig.Port {
+			replica.MasterPort = replica.DBConfig.Port
+		}
+	}
+	replica.DBConfig = updated.DBConfig
+	m.saveResource(replica.ID)
+	return replica.Clone(), nil, http.StatusOK
+}
+
+// masterPort returns the port the master's database serves on.
+func masterPort(replica *api.Replica) uint16 {
+	if replica.MasterPort != 0 {
+		return replica.MasterPort
+	}
+	return replica.DBConfig.Port
+}
+
+// restartReplicaMembers rolls out changed database settings of a
+// replica mastered here with all members in-sync.  It asks the next
+// slave waiting to restart to do so and, once none is left, hands over
+// the master role if this server still serves on the old port.
+// Returns true if either was started.
+// Called locked.
+func restartReplicaMembers(m *ResourceMgr, replica *api.Replica, nextPeriod *time.Duration) bool {
+
+	k := m.k
+	if (replica.PendingState != "") || (replica.SwitchoverServerID != nil) || (replica.PriorEpochID != nil) {
+		return false
+	}
+	epoch, ok := replica.Epochs[replica.CurrentEpochID.String()]
+	if !ok {
+		return false
+	}
+
+	// Restart the next slave still in the quorum.  Once it has the
+	// create request it restarts, and it is in-sync again once caught
+	// up with the new settings.
+	for len(replica.RestartServerIDs) > 0 {
+		id := replica.RestartServerIDs[0]
+		replica.RestartServerIDs = replica.RestartServerIDs[1:]
+		m.saveResource(replica.ID)
+		for i, mbr := range epoch.Quorum {
+			if (mbr.ID != id) || (mbr.MemberType == api.ReplicaQuorumMemberTypeWitness) {
+				continue
+			}
+			k.log.WithFields(Locate(logrus.Fields{
+				"replica": replica.Name,
+				"server":  mbr.Name,
+			})).Info("Replica member restarting with new settings")
+			epoch.Quorum[i].DataState = api.DataStateUninitialized
+			if *nextPeriod > k.config.RetransmitInterval {
+				*nextPeriod = k.config.RetransmitInterval
+			}
+			return true
+		}
+	}
+	if replica.MasterPort == 0 {
+		return false
+	}
+
+	// Restart the master last by handing over to a restarted member,
+	// or by closing the epoch if no member can take over
+	if _, err, _ := startReplicaSwitchover(m, replica.Name, ""); err != nil {
+		k.log.WithFields(Locate(logrus.Fields{
+			"replica": replica.Name,
+			"err":     err,
+		})).Info("Replica master restarting through a new epoch")
+		replica.PendingState = api.StateClosed
+		m.saveResource(replica.ID)
+	}
+	if *nextPeriod > k.config.RetransmitInterval {
+		*nextPeriod = k.config.RetransmitInterval
+	}
+	return true
+}
+
+// countServers returns the number of data and witness servers that are
+// up, including this one, as of the last refresh of the membership.
+// Called locked.
+func countServers(k *Ketch) (data uint, witness uint) {
+	data = 1
+	for _, resource := range k.resourceMgr[api.TypeServer].resource {
+		server := resource.(*api.Server)
+		switch {
+		case server.ID == k.runtime.ID:
+		case server.Witness:
+			witness++
+		default:
+			data++
+		}
+	}
+	return data, witness
+}
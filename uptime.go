@@ -5,22 +5,31 @@
 package ketch
 
 import (
-	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 )
 
-// GetUptime sets uptime seconds since boot.
+// GetUptime sets uptime milliseconds since boot.
 // We use this value for leases as it is monotonically increasing.
 // On system restart all acceptor lease values are reset, compromising availability for safety.
 func (k *Ketch) GetUptime() {
+	k.uptime = durationMs(k.clockUptime())
+}
+
+// durationMs returns d in whole milliseconds, the unit of uptime.
+func durationMs(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// clockUptime returns the uptime from the configured clock.
+func (k *Ketch) clockUptime() time.Duration {
 
-	var info syscall.Sysinfo_t
-	err := syscall.Sysinfo(&info)
+	uptime, err := k.config.Clock.Uptime()
 	if err != nil {
 		k.log.WithFields(Locate(logrus.Fields{
 			"err": err,
 		})).Fatal("Failed to retrieve uptime")
 	}
-	k.uptime = info.Uptime
+	return uptime
 }
@@ -0,0 +1,181 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+)
+
+// A lease watchdog runs for each replica whose database is open as
+// master.  It fences the database, stopping it, once the lease is
+// within LeaseFenceBefore of expiring without renewal.  The watchdog
+// runs on its own timer and never takes the Ketch lock, so it fences
+// even when the service loop is stuck on a slow write or a blocked lock.
+// The service loop arms the watchdog and lease renewals extend it; a
+// fired watchdog is reported to the loop, which demotes the replica.
+
+// leaseWatchdog fences the master database of one replica.
+type leaseWatchdog struct {
+	sync.Mutex
+	// name of the replica, for logging
+	name string
+	// deadline is the uptime in milliseconds to fence at
+	deadline int64
+	// proc is the master database process; nil once fenced
+	proc api.Process
+	// fired is set once the database is fenced
+	fired bool
+	// resetCh wakes the watchdog to reread its deadline
+	resetCh chan struct{}
+	// stopCh is closed to stop the watchdog
+	stopCh chan struct{}
+}
+
+// run waits for the deadline and fences the database.
+func (w *leaseWatchdog) run(k *Ketch) {
+	for {
+		w.Lock()
+		deadline := time.Duration(w.deadline) * time.Millisecond
+		proc := w.proc
+		w.Unlock()
+
+		// Fence once the deadline passes
+		var timeout <-chan time.Time
+		if proc != nil {
+			wait := deadline - k.clockUptime()
+			if wait <= 0 {
+				w.fence(k, proc)
+				continue
+			}
+			timeout = k.config.Clock.After(wait)
+		}
+
+		select {
+		case <-timeout:
+		case <-w.resetCh:
+		case <-w.stopCh:
+			return
+		case <-k.shutdownCh:
+			return
+		}
+	}
+}
+
+// fence stops the database with a "fast" shutdown, which refuses new
+// connections and ends open sessions at once while leaving the data
+// clean for a later rewind.
+func (w *leaseWatchdog) fence(k *Ketch, proc api.Process) {
+	w.Lock()
+	if w.proc != proc {
+		// Rearmed meanwhile
+		w.Unlock()
+		return
+	}
+	w.proc = nil
+	w.fired = true
+	w.Unlock()
+
+	k.log.WithFields(Locate(logrus.Fields{
+		"replica": w.name,
+	})).Error("Lease watchdog fencing database")
+	proc.Signal(syscall.SIGINT)
+
+	// Wake service loop to demote the replica
+	k.wakeAllReplicas()
+}
+
+// updateLeaseWatchdog arms the watchdog of a replica whose database is
+// open as master, with the deadline from the current epoch's confirmed
+// lease, and stops it otherwise.  A proposal not yet accepted by a
+// majority does not move the deadline, as the acceptors may still let
+// the lease lapse at the confirmed expiry.
+func (k *Ketch) updateLeaseWatchdog(replica *api.Replica) {
+
+	var proc api.Process
+	var deadline int64
+	resource, ok := k.resourceMgr[api.TypeDBMgr].resource[replica.ID]
+	if ok && (replica.MasterServerID == nil) && !replica.Demoted && (replica.CurrentEpochID != nil) {
+		dbmgr := resource.(*api.DBMgr)
+		epoch, ok := replica.Epochs[replica.CurrentEpochID.String()]
+		if ok && (dbmgr.State == api.StateOpen) && (dbmgr.DBState == api.DBStateMaster) &&
+			(dbmgr.PendingState == "") {
+			proc = dbmgr.RunCmd
+			deadline = epoch.LeaseConfirmedUptime - durationMs(k.config.LeaseFenceBefore)
+		}
+	}
+
+	w, ok := k.watchdogs[replica.ID]
+	if proc == nil {
+		if ok && !w.fired {
+			k.stopLeaseWatchdog(replica.ID)
+		}
+		return
+	}
+	if !ok {
+		w = &leaseWatchdog{
+			name:    replica.Name,
+			resetCh: make(chan struct{}, 1),
+			stopCh:  make(chan struct{}),
+		}
+		k.watchdogs[replica.ID] = w
+		go w.run(k)
+	}
+	w.Lock()
+	defer w.Unlock()
+	if w.fired || ((w.proc == proc) && (w.deadline == deadline)) {
+		return
+	}
+	w.proc = proc
+	w.deadline = deadline
+	select {
+	case w.resetCh <- struct{}{}:
+	default:
+	}
+}
+
+// stopLeaseWatchdog stops the watchdog of a replica, if any.
+func (k *Ketch) stopLeaseWatchdog(id uuid.UUID) {
+	if w, ok := k.watchdogs[id]; ok {
+		close(w.stopCh)
+		delete(k.watchdogs, id)
+	}
+}
+
+// checkLeaseWatchdog demotes a replica whose watchdog fenced its
+// database.
+func checkLeaseWatchdog(m *ResourceMgr, replica *api.Replica) {
+
+	w, ok := m.k.watchdogs[replica.ID]
+	if !ok {
+		return
+	}
+	w.Lock()
+	fired := w.fired
+	w.Unlock()
+	if fired {
+		m.k.stopLeaseWatchdog(replica.ID)
+		demoteReplica(m, replica)
+	}
+}
+
+// updateLeaseWatchdogs arms and stops watchdogs for all replicas.
+func (k *Ketch) updateLeaseWatchdogs() {
+	replicaMgr := k.resourceMgr[api.TypeReplica]
+	for id := range k.watchdogs {
+		if _, ok := replicaMgr.resource[id]; !ok {
+			k.stopLeaseWatchdog(id)
+		}
+	}
+	for _, resource := range replicaMgr.resource {
+		k.updateLeaseWatchdog(resource.(*api.Replica))
+	}
+}
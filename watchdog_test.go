@@ -0,0 +1,190 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+	"github.com/watercraft/ketch/msg"
+)
+
+// testProcess is a database process that records signals.
+type testProcess struct {
+	signals chan os.Signal
+}
+
+func newTestProcess() *testProcess {
+	return &testProcess{signals: make(chan os.Signal, 10)}
+}
+
+func (p *testProcess) Signal(sig os.Signal) error {
+	p.signals <- sig
+	return nil
+}
+
+func (p *testProcess) Wait() error {
+	return nil
+}
+
+// signalled waits up to timeout for the process to be signalled.
+func (p *testProcess) signalled(timeout time.Duration) (os.Signal, bool) {
+	select {
+	case sig := <-p.signals:
+		return sig, true
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+// addTestMaster adds a replica whose database is open as master, with
+// the lease of its current epoch expiring after leaseLeft.
+func addTestMaster(k *Ketch, leaseLeft time.Duration) (*api.Replica, *api.EpochSpec, *testProcess) {
+	epoch := &api.EpochSpec{
+		Common: api.Common{
+			ID:    uuid.NewV4(),
+			State: api.StateOpen,
+		},
+		LeaseOwner:           true,
+		LeaseExpireUptime:    k.uptime + durationMs(leaseLeft),
+		LeaseConfirmedUptime: k.uptime + durationMs(leaseLeft),
+	}
+	replica := &api.Replica{
+		Common: api.Common{
+			Name:  "mydb1",
+			ID:    uuid.NewV4(),
+			State: api.StateOpen,
+		},
+		CurrentEpochID: &epoch.ID,
+		Epochs:         map[string]*api.EpochSpec{epoch.ID.String(): epoch},
+	}
+	proc := newTestProcess()
+	k.resourceMgr[api.TypeReplica].resource[replica.ID] = replica
+	k.resourceMgr[api.TypeDBMgr].resource[replica.ID] = &api.DBMgr{
+		Common: api.Common{
+			Name:  replica.Name,
+			ID:    replica.ID,
+			State: api.StateOpen,
+		},
+		DBState: api.DBStateMaster,
+		RunCmd:  proc,
+	}
+	return replica, epoch, proc
+}
+
+func TestLeaseWatchdogFences(t *testing.T) {
+	clock := NewFakeClock(time.Hour)
+	k := newTestKetch(clock)
+	defer close(k.shutdownCh)
+	replica, _, proc := addTestMaster(k, k.config.LeasePeriod)
+	k.updateLeaseWatchdog(replica)
+	waitForWaiters(t, clock, 1)
+
+	// Not fenced until LeaseFenceBefore ahead of the lease expiring
+	fenceAfter := k.config.LeasePeriod - k.config.LeaseFenceBefore
+	clock.Advance(fenceAfter - time.Millisecond)
+	if _, ok := proc.signalled(20 * time.Millisecond); ok {
+		t.Fatal("Database fenced before the watchdog deadline")
+	}
+	clock.Advance(time.Millisecond)
+	sig, ok := proc.signalled(5 * time.Second)
+	if !ok {
+		t.Fatal("Database not fenced at the watchdog deadline")
+	}
+	if sig != syscall.SIGINT {
+		t.Fatalf("Database fenced with %v, expected %v", sig, syscall.SIGINT)
+	}
+	if atomic.LoadInt32(&k.allReplicasDue) == 0 {
+		t.Fatal("Service loop not woken to demote the replica")
+	}
+	if !k.watchdogs[replica.ID].fired {
+		t.Fatal("Watchdog not reported as fired")
+	}
+}
+
+func TestLeaseWatchdogRenewed(t *testing.T) {
+	clock := NewFakeClock(time.Hour)
+	k := newTestKetch(clock)
+	defer close(k.shutdownCh)
+	replica, epoch, proc := addTestMaster(k, k.config.LeasePeriod)
+	k.updateLeaseWatchdog(replica)
+	waitForWaiters(t, clock, 1)
+
+	// Renewing the lease moves the deadline
+	renewAfter := k.config.LeasePeriod - k.config.LeaseRenewBefore
+	advanceTestKetch(k, clock, renewAfter)
+	epoch.LeaseExpireUptime = k.uptime + durationMs(k.config.LeasePeriod)
+	epoch.LeaseConfirmedUptime = epoch.LeaseExpireUptime
+	k.updateLeaseWatchdog(replica)
+	waitForWaiters(t, clock, 2)
+	clock.Advance(k.config.LeaseRenewBefore)
+	if _, ok := proc.signalled(20 * time.Millisecond); ok {
+		t.Fatal("Database fenced at the deadline of a renewed lease")
+	}
+
+	// Fenced at the deadline of the renewed lease
+	clock.Advance(renewAfter - k.config.LeaseFenceBefore)
+	if _, ok := proc.signalled(5 * time.Second); !ok {
+		t.Fatal("Database not fenced at the renewed deadline")
+	}
+}
+
+func TestLeaseWatchdogProposeLost(t *testing.T) {
+	clock := NewFakeClock(time.Hour)
+	k := newTestKetch(clock)
+	defer close(k.shutdownCh)
+	member1, member2 := uuid.NewV4(), uuid.NewV4()
+	addTestServer(k, "server2", member1)
+	addTestServer(k, "server3", member2)
+	replica := addTestQuorum(k, member1, member2)
+	epoch := replica.Epochs[replica.CurrentEpochID.String()]
+	for i := range epoch.Quorum {
+		epoch.Quorum[i].State = api.StateOpen
+	}
+	proc := k.resourceMgr[api.TypeDBMgr].resource[replica.ID].(*api.DBMgr).RunCmd.(*testProcess)
+	k.updateLeaseWatchdog(replica)
+	waitForWaiters(t, clock, 1)
+
+	// Renew the lease; a majority promises but the proposal is lost
+	renewAfter := k.config.LeasePeriod - k.config.LeaseRenewBefore + time.Millisecond
+	advanceTestKetch(k, clock, renewAfter)
+	var outMsgs msg.MsgList
+	nextPeriod := k.config.LeasePeriod
+	sendLeasePrepareReqs(k.resourceMgr[api.TypeReplica], replica, &epoch.ID, nil, &nextPeriod, &outMsgs)
+	for _, id := range []uuid.UUID{member1, member2} {
+		k.onLeasePrepareResp(&msg.MsgLeasePrepareResp{
+			Common: msg.Common{
+				Type:      msg.MsgTypeLeasePrepareResp,
+				DestID:    k.runtime.ID,
+				SrcID:     id,
+				ReplicaID: replica.ID,
+				EpochID:   epoch.ID,
+			},
+			BallotNumber:    epoch.BallotNumber,
+			ProposalOwnerID: &k.runtime.ID,
+		}, &outMsgs)
+	}
+	if epoch.LeasePhase != api.LeasePhasePropose {
+		t.Fatalf("Lease phase %v, expected %v", epoch.LeasePhase, api.LeasePhasePropose)
+	}
+	k.updateLeaseWatchdog(replica)
+
+	// Fenced at the deadline of the lease a majority last accepted
+	fenceAfter := k.config.LeasePeriod - k.config.LeaseFenceBefore - renewAfter
+	clock.Advance(fenceAfter - time.Millisecond)
+	if _, ok := proc.signalled(20 * time.Millisecond); ok {
+		t.Fatal("Database fenced before the watchdog deadline")
+	}
+	clock.Advance(time.Millisecond)
+	if _, ok := proc.signalled(5 * time.Second); !ok {
+		t.Fatal("Database not fenced with its lease proposal lost")
+	}
+}
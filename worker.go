@@ -0,0 +1,85 @@
+// Copyright 2016 F. Alan Jones.  All rights reserved.
+// Use of this source code is governed by a Mozilla
+// license that can be found in the LICENSE file.
+
+package ketch
+
+import (
+	"sync"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/watercraft/ketch/api"
+)
+
+// The Ketch lock guards only in-memory state.  Bolt commits are batched
+// off the lock by the journal, and work on a replica's database that
+// may block, starting its commands and disposing of its data, runs on
+// a worker of the replica outside the lock.  A worker runs the work of
+// its replica in the order queued, so the commands of one replica never
+// overlap, while a command stuck on a slow disk or a hung binary holds
+// up only its own replica.  The service loop queues work under the lock
+// and marks the database manager pending until the work reports back.
+
+// replicaWorker runs the queued work of one replica in order.
+type replicaWorker struct {
+	sync.Mutex
+	// queue of work not yet started
+	queue []func()
+	// running is set while a goroutine drains the queue
+	running bool
+}
+
+// replicaWork queues work to run on the worker of a replica, starting
+// the worker if it is idle.
+// Called locked.
+func (k *Ketch) replicaWork(id uuid.UUID, work func()) {
+	w, ok := k.workers[id]
+	if !ok {
+		w = &replicaWorker{}
+		k.workers[id] = w
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.queue = append(w.queue, work)
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+}
+
+// run drains the queue and exits once it is empty.
+func (w *replicaWorker) run() {
+	for {
+		w.Lock()
+		if len(w.queue) == 0 {
+			w.running = false
+			w.Unlock()
+			return
+		}
+		work := w.queue[0]
+		w.queue = w.queue[1:]
+		w.Unlock()
+		work()
+	}
+}
+
+// idle returns true if the worker has no work running or queued.
+func (w *replicaWorker) idle() bool {
+	w.Lock()
+	defer w.Unlock()
+	return !w.running && (len(w.queue) == 0)
+}
+
+// removeReplicaWorkers forgets idle workers of removed replicas.  A
+// worker still disposing of the data of a removed replica is kept until
+// done, so a replica created again with the same ID queues behind it.
+// Called locked.
+func (k *Ketch) removeReplicaWorkers() {
+	replicaMgr := k.resourceMgr[api.TypeReplica]
+	for id, w := range k.workers {
+		if _, ok := replicaMgr.resource[id]; !ok && w.idle() {
+			delete(k.workers, id)
+		}
+	}
+}